@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogEntry holds everything a formatter may need about a finished request
+type accessLogEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	URI        string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+}
+
+// accessLogFormatter renders a single entry, including the trailing newline
+type accessLogFormatter func(buf *bytes.Buffer, entry *accessLogEntry)
+
+var accessLogFormatters = map[string]accessLogFormatter{
+	"combined": formatCombined,
+	"json":     formatJSON,
+}
+
+// accessLogFormatNames returns the supported formats for help and error messages
+func accessLogFormatNames() string {
+	names := make([]string, 0, len(accessLogFormatters))
+	for name := range accessLogFormatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// formatCombined writes the Apache combined log format
+func formatCombined(buf *bytes.Buffer, e *accessLogEntry) {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	fmt.Fprintf(buf, "%s - - [%s] \"%s %s %s\" %d %s %q %q\n",
+		e.RemoteAddr,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URI, e.Proto,
+		e.Status, size,
+		orDash(e.Referer), orDash(e.UserAgent))
+}
+
+// formatJSON writes one JSON object per line
+func formatJSON(buf *bytes.Buffer, e *accessLogEntry) {
+	json.NewEncoder(buf).Encode(struct {
+		Time       string  `json:"time"`
+		RemoteAddr string  `json:"remote_addr"`
+		Method     string  `json:"method"`
+		URI        string  `json:"uri"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMs float64 `json:"duration_ms"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+	}{
+		Time:       e.Time.Format(time.RFC3339Nano),
+		RemoteAddr: e.RemoteAddr,
+		Method:     e.Method,
+		URI:        e.URI,
+		Proto:      e.Proto,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		DurationMs: float64(e.Duration.Microseconds()) / 1000,
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessLogger writes one formatted line per request to its output,
+// separately from the application slog output
+type accessLogger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	format  accessLogFormatter
+	exclude []string
+}
+
+// newAccessLogger opens the destination for the given format. An empty path
+// or "-" writes to stdout. Requests for the excluded paths aren't logged.
+func newAccessLogger(format, path string, exclude []string) (*accessLogger, error) {
+	formatter, ok := accessLogFormatters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown access log format %q (supported: %s)", format, accessLogFormatNames())
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "" && path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open access log: %w", err)
+		}
+		out = file
+	}
+
+	return &accessLogger{out: out, format: formatter, exclude: exclude}, nil
+}
+
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isExcludedPath(l.exclude, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		entry := &accessLogEntry{
+			Time:       start,
+			RemoteAddr: remoteHost(r),
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     rec.statusCode(),
+			Bytes:      rec.bytes,
+			Duration:   time.Since(start),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		}
+		if redactFilenames {
+			entry.URI = redactRequestURI(entry.URI)
+		}
+
+		var buf bytes.Buffer
+		l.format(&buf, entry)
+
+		l.mu.Lock()
+		l.out.Write(buf.Bytes())
+		l.mu.Unlock()
+	})
+}
+
+// isExcludedPath reports whether path is one of the excluded paths, or below
+// one of them ending in /
+func isExcludedPath(exclude []string, path string) bool {
+	for _, excluded := range exclude {
+		if path == excluded || strings.HasSuffix(excluded, "/") && strings.HasPrefix(path, excluded) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestLogger logs every request to the application log, for setups that
+// collect that rather than a separate access log. Requests for the excluded
+// paths, e.g. health checks, are logged at debug level only. Bodies, uploads
+// included, are never logged.
+type requestLogger struct {
+	exclude []string
+	proxies []netip.Prefix
+}
+
+func newRequestLogger(exclude []string, proxies []netip.Prefix) *requestLogger {
+	return &requestLogger{exclude: exclude, proxies: proxies}
+}
+
+func (l *requestLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if isExcludedPath(l.exclude, r.URL.Path) {
+			level = slog.LevelDebug
+		}
+		client := remoteHost(r)
+		if addr, ok := clientAddr(r, l.proxies); ok {
+			client = addr.String()
+		}
+		path := r.URL.Path
+		if redactFilenames {
+			path = redactRequestURI(path)
+		}
+		slog.Log(r.Context(), level, "Request",
+			"method", r.Method,
+			"path", path,
+			"client", client,
+			"status", rec.statusCode(),
+			"bytes", rec.bytes,
+			"duration", time.Since(start))
+	})
+}
+
+// remoteHost strips the port from the request's remote address
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder captures the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which tusd
+// relies on to extend read deadlines during uploads
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
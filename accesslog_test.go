@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAccessLogEntry() *accessLogEntry {
+	return &accessLogEntry{
+		Time:       time.Date(2024, time.March, 5, 14, 7, 9, 0, time.FixedZone("", 3600)),
+		RemoteAddr: "192.0.2.7",
+		Method:     http.MethodPatch,
+		URI:        "/files/abc123",
+		Proto:      "HTTP/1.1",
+		Status:     http.StatusNoContent,
+		Bytes:      0,
+		Duration:   1500 * time.Microsecond,
+		Referer:    "https://example.com/",
+		UserAgent:  `tus-js-client "4.1"`,
+	}
+}
+
+func TestFormatCombined(t *testing.T) {
+	var buf bytes.Buffer
+	formatCombined(&buf, testAccessLogEntry())
+	want := `192.0.2.7 - - [05/Mar/2024:14:07:09 +0100] "PATCH /files/abc123 HTTP/1.1" 204 - "https://example.com/" "tus-js-client \"4.1\""` + "\n"
+	if buf.String() != want {
+		t.Errorf("combined line\n got %q\nwant %q", buf.String(), want)
+	}
+
+	entry := testAccessLogEntry()
+	entry.Status, entry.Bytes, entry.Referer, entry.UserAgent = http.StatusOK, 512, "", ""
+	buf.Reset()
+	formatCombined(&buf, entry)
+	if !strings.HasSuffix(buf.String(), `" 200 512 "-" "-"`+"\n") {
+		t.Errorf("combined line without referer and user agent = %q", buf.String())
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	var buf bytes.Buffer
+	formatJSON(&buf, testAccessLogEntry())
+	if !strings.HasSuffix(buf.String(), "}\n") || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("JSON entry is not a single line: %q", buf.String())
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"time":        "2024-03-05T14:07:09+01:00",
+		"remote_addr": "192.0.2.7",
+		"method":      "PATCH",
+		"uri":         "/files/abc123",
+		"proto":       "HTTP/1.1",
+		"status":      float64(204),
+		"bytes":       float64(0),
+		"duration_ms": 1.5,
+		"referer":     "https://example.com/",
+		"user_agent":  `tus-js-client "4.1"`,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("JSON entry has %d fields, want %d: %s", len(got), len(want), buf.String())
+	}
+}
+
+func TestAccessLoggerMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	l, err := newAccessLogger("json", "", []string{"/healthz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.out = &out
+	h := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if out.Len() != 0 {
+		t.Errorf("excluded path logged: %s", out.String())
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/files/", nil))
+	var entry struct {
+		Method string `json:"method"`
+		URI    string `json:"uri"`
+		Status int    `json:"status"`
+		Bytes  int64  `json:"bytes"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	if entry.Method != http.MethodPost || entry.URI != "/files/" || entry.Status != http.StatusCreated || entry.Bytes != 7 {
+		t.Errorf("logged %+v", entry)
+	}
+}
+
+func TestNewAccessLoggerUnknownFormat(t *testing.T) {
+	if _, err := newAccessLogger("common", "", nil); err == nil || !strings.Contains(err.Error(), "combined, json") {
+		t.Errorf("unknown format error = %v", err)
+	}
+}
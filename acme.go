@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// validateACME rejects --acme-domain combined with options for a certificate
+// from disk, which would leave it unclear where the certificate comes from
+func validateACME(domains []string, certFile, keyFile string, ocspStaple bool) error {
+	if len(domains) == 0 {
+		return nil
+	}
+	if certFile != "" || keyFile != "" {
+		return errors.New("--acme-domain can't be combined with --cert and --key")
+	}
+	if ocspStaple {
+		return errors.New("--ocsp-staple only works with --cert and --key")
+	}
+	return nil
+}
+
+// newACMEManager obtains and renews certificates for the domains from Let's
+// Encrypt. Certificates are kept in cacheDir across restarts, as Let's Encrypt
+// rate limits issuing new ones; an empty cacheDir keeps them in memory only.
+func newACMEManager(domains []string, cacheDir string) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+	}
+	if cacheDir != "" {
+		manager.Cache = autocert.DirCache(cacheDir)
+	}
+	return manager
+}
+
+// acmeNextProtos are the ALPN protocols of the HTTPS listener with ACME. The
+// challenge protocol lets Let's Encrypt validate the domain on that port
+// (TLS-ALPN-01), so no plain HTTP listener is needed.
+var acmeNextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
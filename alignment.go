@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// chunkAlignmentHeader advertises --chunk-alignment to clients. It is not part of
+// the tus protocol; clients that know it pick a chunk size that is a multiple.
+const chunkAlignmentHeader = "Upload-Chunk-Alignment"
+
+// chunkAlignment rejects upload data that doesn't start and end on a multiple
+// of boundary, except for the chunk completing the upload. The check runs
+// before tusd sees the request, so misaligned data is never written.
+type chunkAlignment struct {
+	store    *fileStore
+	boundary int64
+}
+
+func newChunkAlignment(store *fileStore, boundary int64) *chunkAlignment {
+	return &chunkAlignment{store: store, boundary: boundary}
+}
+
+func (a *chunkAlignment) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(chunkAlignmentHeader, strconv.FormatInt(a.boundary, 10))
+
+		// Creation-with-upload carries data in the POST as well
+		hasData := r.Method == http.MethodPatch ||
+			(r.Method == http.MethodPost && r.Header.Get("Content-Type") == "application/offset+octet-stream")
+		if !hasData {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var offset int64
+		size := int64(-1)
+		if r.Method == http.MethodPatch {
+			upload, err := a.store.GetUpload(r.Context(), r.URL.Path)
+			if err != nil {
+				// Let tusd produce its usual answer for unknown uploads
+				next.ServeHTTP(w, r)
+				return
+			}
+			info, err := upload.GetInfo(r.Context())
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			offset, err = strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !info.SizeIsDeferred {
+				size = info.Size
+			}
+		}
+		if size < 0 {
+			if v, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64); err == nil {
+				size = v
+			}
+		}
+
+		if offset%a.boundary != 0 {
+			http.Error(w, fmt.Sprintf("Upload-Offset must be a multiple of %d bytes", a.boundary), http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength < 0 {
+			http.Error(w, "Content-Length is required when chunk alignment is enforced", http.StatusLengthRequired)
+			return
+		}
+		end := offset + r.ContentLength
+		if end != size && end%a.boundary != 0 {
+			http.Error(w, fmt.Sprintf("chunk must end on a multiple of %d bytes unless it completes the upload", a.boundary), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
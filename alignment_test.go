@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestChunkAlignment(t *testing.T) {
+	store := newFileStore(t.TempDir(), false, 0, "")
+	upload, err := store.NewUpload(context.Background(), tusd.FileInfo{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := upload.GetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deferred, err := store.NewUpload(context.Background(), tusd.FileInfo{SizeIsDeferred: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deferredInfo, err := deferred.GetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix("/files/", newChunkAlignment(store, 4).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	tests := []struct {
+		name, method, id string
+		offset, length   int
+		// uploadLength is sent as Upload-Length when set
+		uploadLength string
+		wantCode     int
+	}{
+		{"aligned chunk", http.MethodPatch, info.ID, 0, 4, "", http.StatusNoContent},
+		{"aligned middle chunk", http.MethodPatch, info.ID, 4, 4, "", http.StatusNoContent},
+		{"short last chunk", http.MethodPatch, info.ID, 8, 2, "", http.StatusNoContent},
+		{"rest of the upload", http.MethodPatch, info.ID, 4, 6, "", http.StatusNoContent},
+		{"misaligned end", http.MethodPatch, info.ID, 0, 3, "", http.StatusBadRequest},
+		{"misaligned start", http.MethodPatch, info.ID, 2, 2, "", http.StatusBadRequest},
+		{"past the end", http.MethodPatch, info.ID, 8, 3, "", http.StatusBadRequest},
+		{"deferred length aligned", http.MethodPatch, deferredInfo.ID, 0, 8, "", http.StatusNoContent},
+		{"deferred length misaligned", http.MethodPatch, deferredInfo.ID, 0, 6, "", http.StatusBadRequest},
+		{"deferred length declared with the last chunk", http.MethodPatch, deferredInfo.ID, 0, 6, "6", http.StatusNoContent},
+		{"unknown upload left to tusd", http.MethodPatch, "unknown", 1, 1, "", http.StatusNoContent},
+		{"creation with aligned data", http.MethodPost, "", 0, 4, "10", http.StatusNoContent},
+		{"creation with the whole upload", http.MethodPost, "", 0, 10, "10", http.StatusNoContent},
+		{"creation with misaligned data", http.MethodPost, "", 0, 3, "10", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/files/"+tt.id, strings.NewReader(strings.Repeat("x", tt.length)))
+			r.Header.Set("Content-Type", "application/offset+octet-stream")
+			if tt.method == http.MethodPatch {
+				r.Header.Set("Upload-Offset", strconv.Itoa(tt.offset))
+			}
+			if tt.uploadLength != "" {
+				r.Header.Set("Upload-Length", tt.uploadLength)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("%s of %d bytes at %d: status %d, want %d", tt.method, tt.length, tt.offset, w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get(chunkAlignmentHeader); got != "4" {
+				t.Errorf("%s is %q, want 4", chunkAlignmentHeader, got)
+			}
+		})
+	}
+
+	// Without a length the end of the chunk is unknown
+	r := httptest.NewRequest(http.MethodPatch, "/files/"+info.ID, strings.NewReader("xxxx"))
+	r.ContentLength = -1
+	r.Header.Set("Upload-Offset", "0")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusLengthRequired {
+		t.Errorf("PATCH without Content-Length: status %d, want 411", w.Code)
+	}
+
+	// Creating an upload without data isn't checked
+	r = httptest.NewRequest(http.MethodPost, "/files/", nil)
+	r.Header.Set("Upload-Length", "10")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("POST without data: status %d, want it passed on", w.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// writeJSON sends v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write JSON response", "error", err)
+	}
+}
+
+// writeJSONError sends an error message in the JSON body used by all API endpoints
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// hasBearerToken reports whether the request's Authorization header carries the
+// given bearer token, comparing in constant time
+func hasBearerToken(r *http.Request, token string) bool {
+	got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// liveToken holds a bearer token that reloading --config can replace. Whether a
+// token is set decides which endpoints exist, so it only changes to another
+// non-empty token.
+type liveToken struct {
+	value atomic.Pointer[string]
+}
+
+func newLiveToken(token string) *liveToken {
+	t := &liveToken{}
+	t.set(token)
+	return t
+}
+
+func (t *liveToken) get() string {
+	return *t.value.Load()
+}
+
+func (t *liveToken) set(token string) {
+	t.value.Store(&token)
+}
+
+// requireAdmin checks the request's bearer token against --admin-token, answering
+// 401 and returning false when it doesn't match
+func requireAdmin(w http.ResponseWriter, r *http.Request, adminToken *liveToken) bool {
+	if !hasBearerToken(r, adminToken.get()) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, "admin token required")
+		return false
+	}
+	return true
+}
+
+// requireUploadToken only lets requests carrying --auth-token through, or all of
+// them when it is empty. CORS preflights can't carry credentials and pass
+// unchecked, and users logged in with --htpasswd can't send the token besides
+// their credentials and pass as well.
+func requireUploadToken(next http.Handler, authToken *liveToken) http.Handler {
+	if authToken.get() == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, loggedIn := loginUser(r)
+		if r.Method != http.MethodOptions && !loggedIn && !hasBearerToken(r, authToken.get()) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "upload token required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseContentRange parses a "bytes first-last/size" Content-Range header
+func parseContentRange(header string) (first, last, size int64, err error) {
+	_, err = fmt.Sscanf(header, "bytes %d-%d/%d", &first, &last, &size)
+	return first, last, size, err
+}
+
+// handleUnknownAPI answers requests below /api/ that no endpoint matched, so API
+// clients get a JSON error instead of the web UI's file server
+func handleUnknownAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "no such API endpoint")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestUnknownAPIPathsVersusUIRoutes(t *testing.T) {
+	// Registered as runServer does
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{})
+	})
+	mux.HandleFunc("/api/", handleUnknownAPI)
+	mux.Handle("/", http.FileServer(http.FS(fstest.MapFS{
+		"index.html": {Data: []byte("<html>")},
+		"app.js":     {Data: []byte("app()")},
+	})))
+
+	tests := []struct {
+		method, path string
+		wantCode     int
+		wantJSON     bool
+	}{
+		{http.MethodGet, "/api/files", http.StatusOK, true},
+		{http.MethodGet, "/api/nope", http.StatusNotFound, true},
+		{http.MethodPost, "/api/files/report.txt/nope", http.StatusNotFound, true},
+		{http.MethodGet, "/api/", http.StatusNotFound, true},
+		{http.MethodGet, "/", http.StatusOK, false},
+		{http.MethodGet, "/app.js", http.StatusOK, false},
+		{http.MethodGet, "/missing.js", http.StatusNotFound, false},
+		{http.MethodGet, "/apis", http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			isJSON := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+			if isJSON != tt.wantJSON {
+				t.Errorf("Content-Type %q, want JSON %v", w.Header().Get("Content-Type"), tt.wantJSON)
+			}
+			if tt.wantJSON && tt.wantCode == http.StatusNotFound {
+				var body map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+					t.Errorf("body %q (%v), want a JSON error", w.Body, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// pooledUpload copies request bodies into the upload through buffers taken from
+// a shared pool, instead of the filestore allocating a new one for every PATCH
+type pooledUpload struct {
+	tusd.Upload
+	pool *sync.Pool
+}
+
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}}
+}
+
+func (u *pooledUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	buf := u.pool.Get().(*[]byte)
+	defer u.pool.Put(buf)
+	return u.Upload.WriteChunk(ctx, offset, &pooledReader{src: src, buf: *buf})
+}
+
+// pooledReader makes io.Copy use buf: its WriteTo is preferred over the
+// destination's ReadFrom, which would fall back to allocating its own buffer
+type pooledReader struct {
+	src io.Reader
+	buf []byte
+}
+
+func (r *pooledReader) Read(p []byte) (int, error) {
+	return r.src.Read(p)
+}
+
+func (r *pooledReader) WriteTo(w io.Writer) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r.src}, r.buf)
+}
+
+// unwrapUpload returns the filestore's own upload, as its As* methods and
+// concatenation only accept those
+func unwrapUpload(upload tusd.Upload) tusd.Upload {
+	if p, ok := upload.(*pooledUpload); ok {
+		return p.Upload
+	}
+	return upload
+}
+
+// concatableUpload unwraps the partial uploads before handing them to the filestore
+type concatableUpload struct {
+	tusd.ConcatableUpload
+}
+
+func (u concatableUpload) ConcatUploads(ctx context.Context, partialUploads []tusd.Upload) error {
+	unwrapped := make([]tusd.Upload, len(partialUploads))
+	for i, upload := range partialUploads {
+		unwrapped[i] = unwrapUpload(upload)
+	}
+	return u.ConcatableUpload.ConcatUploads(ctx, unwrapped)
+}
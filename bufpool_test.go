@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"strconv"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestPooledUploadWritesChunk(t *testing.T) {
+	store := newFileStore(t.TempDir(), false, 16, "")
+	ctx := context.Background()
+	upload, err := store.NewUpload(ctx, tusd.FileInfo{Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	// Like a request body, without WriteTo of its own
+	n, err := upload.WriteChunk(ctx, 0, struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("WriteChunk = %d, %v", n, err)
+	}
+
+	upload, err = store.GetUpload(ctx, mustUploadID(t, upload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := upload.GetReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("stored %q, want %q", got, data)
+	}
+}
+
+func mustUploadID(t *testing.T, upload tusd.Upload) string {
+	t.Helper()
+	info, err := upload.GetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.ID
+}
+
+// BenchmarkUploadWrite writes 1 MiB uploads from many goroutines at once,
+// without the pool and with --write-buffer-size. Besides throughput and
+// allocations it reports the GC pause time per upload.
+func BenchmarkUploadWrite(b *testing.B) {
+	const uploadSize = 1 << 20
+	data := bytes.Repeat([]byte{'x'}, uploadSize)
+
+	for _, bufferSize := range []int{0, 32 << 10, 256 << 10} {
+		name := "unpooled"
+		if bufferSize > 0 {
+			name = "pooled-" + strconv.Itoa(bufferSize>>10) + "KiB"
+		}
+		b.Run(name, func(b *testing.B) {
+			store := newFileStore(b.TempDir(), false, bufferSize, "")
+			ctx := context.Background()
+			b.SetBytes(uploadSize)
+			b.ReportAllocs()
+			b.SetParallelism(8)
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					upload, err := store.NewUpload(ctx, tusd.FileInfo{Size: uploadSize})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := upload.WriteChunk(ctx, 0, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+						b.Error(err)
+						return
+					}
+					if err := store.AsTerminatableUpload(upload).Terminate(ctx); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+		})
+	}
+}
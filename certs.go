@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves the TLS certificate for both listeners and reloads it from
+// disk on SIGHUP, so renewed certificates are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	// ocspStaple fetches a new OCSP response whenever the certificate changes
+	ocspStaple bool
+
+	mu            sync.RWMutex
+	cert          *tls.Certificate
+	stapleExpires time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.stapleExpires = time.Time{}
+	r.mu.Unlock()
+	return nil
+}
+
+// watchSignals reloads the certificate on every SIGHUP. A certificate that fails
+// to load is logged and the previous one stays in use.
+func (r *certReloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := r.reload(); err != nil {
+				slog.Error("Failed to reload TLS certificate, keeping the current one",
+					"cert_file", r.certFile,
+					"key_file", r.keyFile,
+					"error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS certificate", "cert_file", r.certFile)
+			if r.ocspStaple {
+				r.refreshStaple()
+			}
+		}
+	}()
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
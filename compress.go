@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the smallest response worth compressing, when its length
+// is known up front
+const minCompressSize = 1024
+
+// uncompressedPrefixes are the paths --compress leaves alone: the tus endpoints
+// and downloads carry files clients expect byte for byte, with Range support,
+// and the event streams must reach the client the moment they are written.
+// /metrics compresses on its own.
+var uncompressedPrefixes = []string{
+	"/files", "/api/download", "/api/thumbnail/", "/api/logs", "/api/events", "/metrics",
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	zstdWriters = sync.Pool{New: func() any {
+		// Without concurrency the encoder starts no goroutines of its own
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+		return w
+	}}
+)
+
+// compressMiddleware compresses the UI assets and the JSON API with zstd or
+// gzip, whichever the client prefers in Accept-Encoding
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range uncompressedPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		// Ranges are of the uncompressed content
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks zstd or gzip from an Accept-Encoding header, by the
+// client's q-values and zstd on a tie; empty when neither is acceptable
+func negotiateEncoding(header string) string {
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name != "zstd" && name != "gzip" || q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && name == "zstd" {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// isCompressibleType reports whether a Content-Type is text of some kind,
+// rather than media that is compressed already
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/manifest+json",
+		"image/svg+xml", "image/x-icon", "application/wasm":
+		return true
+	}
+	return false
+}
+
+// compressWriter decides on the first write whether the response gets
+// compressed, going by its status, type and length
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	decided  bool
+	out      io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decide(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) decide(status int) {
+	w.decided = true
+	h := w.Header()
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent || h.Get("Content-Encoding") != "" {
+		return
+	}
+	if h.Get("Content-Type") == "" || !isCompressibleType(h.Get("Content-Type")) {
+		return
+	}
+	if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && length < minCompressSize {
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	// The compressed bytes differ, so a strong validator must not be reused
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	switch w.encoding {
+	case "zstd":
+		enc := zstdWriters.Get().(*zstd.Encoder)
+		enc.Reset(w.ResponseWriter)
+		w.out = pooledWriter{enc, func() { zstdWriters.Put(enc) }}
+	default:
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w.ResponseWriter)
+		w.out = pooledWriter{gz, func() { gzipWriters.Put(gz) }}
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		// Handlers writing without a Content-Type rely on it being sniffed,
+		// which has to happen before Content-Encoding is decided
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.out == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.out.Write(p)
+}
+
+// Flush sends what was compressed so far
+func (w *compressWriter) Flush() {
+	if f, ok := w.out.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) close() {
+	if w.out != nil {
+		w.out.Close()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// pooledWriter returns its compressor to the pool once closed
+type pooledWriter struct {
+	compressor interface {
+		io.WriteCloser
+		Flush() error
+	}
+	release func()
+}
+
+func (p pooledWriter) Write(b []byte) (int, error) {
+	return p.compressor.Write(b)
+}
+
+func (p pooledWriter) Flush() error {
+	return p.compressor.Flush()
+}
+
+func (p pooledWriter) Close() error {
+	err := p.compressor.Close()
+	p.release()
+	return err
+}
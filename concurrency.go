@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	// uploadSlotIdleTimeout frees the slot of an upload that sent no data for
+	// this long, e.g. one the client abandoned. It takes a slot again when it
+	// resumes.
+	uploadSlotIdleTimeout = 10 * time.Minute
+
+	// uploadSlotGrace is how long a slot taken by the pre-create hook waits for
+	// tusd to create the upload, after which a later hook or the store refused it
+	uploadSlotGrace = time.Minute
+
+	// uploadSlotRetryAfter is the Retry-After sent while all slots are taken
+	uploadSlotRetryAfter = 30 * time.Second
+)
+
+// uploadSlots bounds how many uploads are in progress at once, since each one
+// holds open files and buffers. An upload takes a slot when it is created and
+// frees it when it completes, is terminated or goes idle.
+type uploadSlots struct {
+	limit int
+
+	mu sync.Mutex
+	// pending are the slots taken for uploads tusd hasn't reported created yet
+	pending []time.Time
+	// active holds the uploads in progress, by the time they last sent data
+	active map[string]time.Time
+}
+
+func newUploadSlots(limit int) *uploadSlots {
+	return &uploadSlots{limit: limit, active: make(map[string]time.Time)}
+}
+
+// take is a pre-create hook rejecting new uploads with 503 while all slots are
+// in use. The final upload of a concatenation carries no data of its own and
+// takes none.
+func (s *uploadSlots) take(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	if hook.Upload.IsFinal {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	expired := 0
+	for expired < len(s.pending) && now.Sub(s.pending[expired]) >= uploadSlotGrace {
+		expired++
+	}
+	s.pending = s.pending[expired:]
+	for id, last := range s.active {
+		if now.Sub(last) >= uploadSlotIdleTimeout {
+			delete(s.active, id)
+		}
+	}
+
+	if len(s.active)+len(s.pending) >= s.limit {
+		err := tusd.NewError("ERR_TOO_MANY_UPLOADS", "the server is handling too many uploads at once", http.StatusServiceUnavailable)
+		err.HTTPResponse = err.HTTPResponse.MergeWith(tusd.HTTPResponse{Header: tusd.HTTPHeader{
+			"Retry-After": strconv.Itoa(int(uploadSlotRetryAfter.Seconds())),
+		}})
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, err
+	}
+	s.pending = append(s.pending, now)
+	return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+}
+
+// created moves the oldest pending slot to the upload tusd created
+func (s *uploadSlots) created(event tusd.HookEvent) {
+	if event.Upload.IsFinal {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) > 0 {
+		s.pending = s.pending[1:]
+	}
+	s.active[event.Upload.ID] = time.Now()
+}
+
+// progress keeps an upload's slot from going idle, and takes one again for an
+// upload resuming after its slot was freed
+func (s *uploadSlots) progress(event tusd.HookEvent) {
+	if event.Upload.IsFinal || !event.Upload.SizeIsDeferred && event.Upload.Offset >= event.Upload.Size {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[event.Upload.ID] = time.Now()
+}
+
+// release frees the slot of an upload that completed or was terminated
+func (s *uploadSlots) release(event tusd.HookEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, event.Upload.ID)
+}
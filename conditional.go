@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// conflictMetadataKey records in the upload's metadata what to do if its
+// filename is taken on completion. Only conditionalUploads sets it; values sent
+// by clients are dropped.
+const conflictMetadataKey = "on_conflict"
+
+const (
+	onConflictFail    = "fail"
+	onConflictReplace = "replace"
+)
+
+// Policies of --on-conflict for uploads created without a condition
+const (
+	conflictRename    = "rename"
+	conflictOverwrite = "overwrite"
+	conflictReject    = "reject"
+)
+
+// errNameTaken reports an upload kept under its ID by --on-conflict reject
+var errNameTaken = errors.New("a file with this name already exists")
+
+var (
+	errFileExists          = tusd.NewError("ERR_FILE_EXISTS", "a file with this name already exists", http.StatusPreconditionFailed)
+	errFileNotFound        = tusd.NewError("ERR_FILE_NOT_FOUND", "no file with this name exists to replace", http.StatusPreconditionFailed)
+	errOverwriteDisabled   = tusd.NewError("ERR_OVERWRITE_DISABLED", "replacing files is not enabled on this server", http.StatusForbidden)
+	errConditionNoFilename = tusd.NewError("ERR_CONDITION_WITHOUT_FILENAME", "conditional uploads need a filename in the metadata", http.StatusBadRequest)
+	errConditionValue      = tusd.NewError("ERR_INVALID_CONDITION", "only * is supported in If-Match and If-None-Match", http.StatusBadRequest)
+	errNameConflict        = tusd.NewError("ERR_NAME_CONFLICT", "a file with this name already exists and this server doesn't replace or rename files", http.StatusConflict)
+)
+
+// conditionalUploads lets the creation request decide how a filename collision
+// is resolved instead of always adding a _1 suffix: If-None-Match: * only
+// accepts the upload if no file of that name exists, If-Match: * only if one
+// does, which it then replaces.
+type conditionalUploads struct {
+	lookup         nameLookup
+	allowOverwrite bool
+}
+
+// nameLookup reports whether a finished upload with the sanitized name exists,
+// and whether it is a regular file that could be replaced
+type nameLookup func(name string) (exists, regular bool)
+
+// localLookup looks names up where an upload finishing now would be published:
+// the uploads dir or the --route-by-ext directory of the name, and with
+// --layout date today's subdirectory
+func localLookup(routes []uploadRoute) nameLookup {
+	return func(name string) (bool, bool) {
+		dir := routeDir(routes, name)
+		info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(uploadSubdir(time.Now())), name))
+		return err == nil, err == nil && info.Mode().IsRegular()
+	}
+}
+
+func newConditionalUploads(lookup nameLookup, allowOverwrite bool) *conditionalUploads {
+	return &conditionalUploads{lookup: lookup, allowOverwrite: allowOverwrite}
+}
+
+func (c *conditionalUploads) checkConditions(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	metadata := maps.Clone(hook.Upload.MetaData)
+	delete(metadata, conflictMetadataKey)
+
+	ifNoneMatch := hook.HTTPRequest.Header.Get("If-None-Match")
+	ifMatch := hook.HTTPRequest.Header.Get("If-Match")
+	if hook.Upload.IsPartial {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{MetaData: metadata}, nil
+	}
+	if ifNoneMatch == "" && ifMatch == "" {
+		// With --on-conflict reject a taken name is refused right away, rather
+		// than after the data was sent; a name taken later is caught on completion
+		if conflictPolicy == conflictReject {
+			upload := hook.Upload
+			upload.MetaData = metadata
+			if filename := uploadFilename(upload, time.Now()); filename != "" {
+				if exists, _ := c.lookup(sanitizeFilename(filename)); exists {
+					return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errNameConflict
+				}
+			}
+		}
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{MetaData: metadata}, nil
+	}
+	if (ifNoneMatch != "" && ifNoneMatch != "*") || (ifMatch != "" && ifMatch != "*") {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errConditionValue
+	}
+	upload := hook.Upload
+	upload.MetaData = metadata
+	filename := uploadFilename(upload, time.Now())
+	if filename == "" {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errConditionNoFilename
+	}
+
+	exists, regular := c.lookup(sanitizeFilename(filename))
+	switch {
+	case ifNoneMatch == "*":
+		if exists {
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errFileExists
+		}
+		metadata[conflictMetadataKey] = onConflictFail
+	case !c.allowOverwrite:
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errOverwriteDisabled
+	default:
+		if !exists || !regular {
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errFileNotFound
+		}
+		metadata[conflictMetadataKey] = onConflictReplace
+	}
+	return tusd.HTTPResponse{}, tusd.FileInfoChanges{MetaData: metadata}, nil
+}
+
+// publishConditional publishes a finished upload according to the condition it
+// was created with, or else --on-conflict. A file that appeared after an
+// If-None-Match upload was accepted can't be answered with 412 anymore, so the
+// upload falls back to a suffixed name rather than being lost, or with
+// --on-conflict reject stays under its ID. That is reported as errNameTaken.
+// Publishing holds the directory's lock, so each policy sees a consistent
+// directory while other uploads complete.
+func publishConditional(oldPath, dir, filename, onConflict string) (string, error) {
+	defer lockPublishDir(dir)()
+
+	sanitized := sanitizeFilename(filename)
+	switch conflictAction(onConflict) {
+	case onConflictFail:
+		err := renameNoReplace(oldPath, filepath.Join(dir, sanitized))
+		if !errors.Is(err, fs.ErrExist) {
+			return sanitized, err
+		}
+		if conflictPolicy == conflictReject {
+			return sanitized, errNameTaken
+		}
+		slog.Warn("File appeared while an If-None-Match upload was running, publishing under another name",
+			"filename", sanitized)
+	case onConflictReplace:
+		target := filepath.Join(dir, sanitized)
+		if info, err := os.Lstat(target); err == nil && !info.Mode().IsRegular() {
+			return sanitized, fmt.Errorf("%s is not a regular file", sanitized)
+		}
+		// Readers see either the old or the new file, never a partial one
+		return sanitized, os.Rename(oldPath, target)
+	}
+	return claimUniqueName(oldPath, dir, filename)
+}
+
+// conflictAction returns what to do when the name of an upload created with
+// the on_conflict metadata value is taken: onConflictFail, onConflictReplace or,
+// empty, give it a counter
+func conflictAction(onConflict string) string {
+	if onConflict == "" {
+		switch conflictPolicy {
+		case conflictOverwrite:
+			return onConflictReplace
+		case conflictReject:
+			return onConflictFail
+		}
+	}
+	return onConflict
+}
+
+// publishLocks serializes publishing into the same directory
+var publishLocks sync.Map
+
+func lockPublishDir(dir string) func() {
+	mu, _ := publishLocks.LoadOrStore(filepath.Clean(dir), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
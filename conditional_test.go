@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestCheckConditions(t *testing.T) {
+	defer func(saved string) { conflictPolicy = saved }(conflictPolicy)
+	// report.txt is a finished upload, thumbs a directory
+	lookup := func(name string) (bool, bool) {
+		return name == "report.txt" || name == "thumbs", name == "report.txt"
+	}
+	tests := []struct {
+		name                 string
+		filename             string
+		ifNoneMatch, ifMatch string
+		allowOverwrite       bool
+		policy               string
+		wantErr              error
+		wantOnConflict       string
+	}{
+		{"If-None-Match on a free name", "new.txt", "*", "", false, conflictRename, nil, onConflictFail},
+		{"If-None-Match on a taken name", "report.txt", "*", "", false, conflictRename, errFileExists, ""},
+		{"If-Match on a taken name", "report.txt", "", "*", true, conflictRename, nil, onConflictReplace},
+		{"If-Match on a free name", "new.txt", "", "*", true, conflictRename, errFileNotFound, ""},
+		{"If-Match on a directory", "thumbs", "", "*", true, conflictRename, errFileNotFound, ""},
+		{"If-Match without --allow-overwrite", "report.txt", "", "*", false, conflictRename, errOverwriteDisabled, ""},
+		{"ETag condition", "report.txt", `"abc"`, "", false, conflictRename, errConditionValue, ""},
+		{"condition without a filename", "", "*", "", false, conflictRename, errConditionNoFilename, ""},
+		{"no condition", "report.txt", "", "", false, conflictRename, nil, ""},
+		{"no condition with --on-conflict reject", "report.txt", "", "", false, conflictReject, errNameConflict, ""},
+		{"free name with --on-conflict reject", "new.txt", "", "", false, conflictReject, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflictPolicy = tt.policy
+			r := httptest.NewRequest("POST", "/files/", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			// A client can't choose the outcome through the metadata itself
+			metadata := tusd.MetaData{conflictMetadataKey: onConflictReplace}
+			if tt.filename != "" {
+				metadata["filename"] = tt.filename
+			}
+			_, changes, err := newConditionalUploads(lookup, tt.allowOverwrite).checkConditions(tusd.HookEvent{
+				HTTPRequest: tusd.HTTPRequest{Header: r.Header},
+				Upload:      tusd.FileInfo{MetaData: metadata},
+			})
+			if !errors.Is(err, tt.wantErr) || (err != nil && tt.wantErr == nil) {
+				t.Fatalf("checkConditions = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got, ok := changes.MetaData[conflictMetadataKey]; got != tt.wantOnConflict || ok != (tt.wantOnConflict != "") {
+				t.Errorf("%s metadata is %q, want %q", conflictMetadataKey, got, tt.wantOnConflict)
+			}
+			if changes.MetaData["filename"] != tt.filename {
+				t.Errorf("filename became %q", changes.MetaData["filename"])
+			}
+		})
+	}
+
+	// Parts of a concatenated upload are only checked with the final upload
+	r := httptest.NewRequest("POST", "/files/", nil)
+	r.Header.Set("If-None-Match", "*")
+	_, changes, err := newConditionalUploads(lookup, false).checkConditions(tusd.HookEvent{
+		HTTPRequest: tusd.HTTPRequest{Header: r.Header},
+		Upload:      tusd.FileInfo{IsPartial: true, MetaData: tusd.MetaData{"filename": "report.txt", conflictMetadataKey: onConflictReplace}},
+	})
+	if err != nil || changes.MetaData[conflictMetadataKey] != "" {
+		t.Errorf("partial upload: %v with %v, want it accepted without a condition", err, changes.MetaData)
+	}
+}
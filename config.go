@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// envPrefix starts the environment variable of every flag
+const envPrefix = "SIMPLE_UPLOAD_"
+
+// flagEnvName is the environment variable of a flag, e.g. SIMPLE_UPLOAD_UPLOADS_DIR
+// for --uploads-dir
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnvironment sets the flags not given on the command line from their
+// environment variables. Values are parsed like on the command line, repeatable
+// flags take one value per line. They take precedence over the config file, so
+// a secret can be kept out of it.
+func loadEnvironment(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		env := flagEnvName(flag.Name)
+		value := os.Getenv(env)
+		if err != nil || flag.Changed || flag.Name == "help" || value == "" {
+			return
+		}
+		values := []string{value}
+		if flag.Value.Type() == "stringArray" {
+			values = strings.Split(strings.TrimRight(value, "\n"), "\n")
+		}
+		for _, v := range values {
+			if setErr := flags.Set(flag.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value for $%s: %w", env, setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// logEffectiveConfig logs the options set on the command line, through the
+// environment or in the config file, with those that look like secrets redacted
+func logEffectiveConfig(flags *pflag.FlagSet) {
+	var attrs []any
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if !flag.Changed {
+			return
+		}
+		value := flag.Value.String()
+		if isRedactedKey(flag.Name) {
+			value = "[REDACTED]"
+		}
+		attrs = append(attrs, flag.Name, value)
+	})
+	slog.Info("Effective configuration", attrs...)
+}
+
+// loadConfigFile sets the flags not given on the command line, nor through
+// their environment variables, from a YAML or TOML file (by extension) whose keys
+// are the flag names, with - or _. Unknown keys are an error, so a typo doesn't
+// go unnoticed.
+func loadConfigFile(flags *pflag.FlagSet, path string) error {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	keys := v.AllKeys()
+	slices.Sort(keys)
+	var unknown []string
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" || name == "help" {
+			unknown = append(unknown, key)
+			continue
+		}
+		// Also set when given through the environment
+		if flag.Changed {
+			continue
+		}
+
+		var err error
+		if list, ok := flag.Value.(pflag.SliceValue); ok {
+			var values []string
+			if values, err = cast.ToStringSliceE(v.Get(key)); err == nil {
+				err = list.Replace(values)
+			}
+		} else {
+			err = flag.Value.Set(cast.ToString(v.Get(key)))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: invalid value for %s: %w", path, key, err)
+		}
+		// Counts as given, for the checks of which flags are combined
+		flag.Changed = true
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%s: unknown options %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// printEffectiveConfig writes every option with the value it ends up with, as
+// --name=value lines, with those that look like secrets redacted
+func printEffectiveConfig(w io.Writer, flags *pflag.FlagSet) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		value := flag.Value.String()
+		if isRedactedKey(flag.Name) && value != "" {
+			value = "[REDACTED]"
+		}
+		fmt.Fprintf(w, "--%s=%s\n", flag.Name, value)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// conversionRule maps uploads with one extension to a command producing another
+// format. The command is run directly, not through a shell, with {in} and {out}
+// replaced by the source and destination paths.
+type conversionRule struct {
+	from    string
+	to      string
+	command []string
+}
+
+// parseConversionRule parses a --convert value of the form
+// "from:to=command {in} {out}", e.g. "wav:flac=ffmpeg -y -i {in} {out}"
+func parseConversionRule(value string) (conversionRule, error) {
+	formats, command, ok := strings.Cut(value, "=")
+	from, to, ok2 := strings.Cut(formats, ":")
+	args := strings.Fields(command)
+	if !ok || !ok2 || from == "" || to == "" || len(args) == 0 {
+		return conversionRule{}, fmt.Errorf("expected from:to=command, got %q", value)
+	}
+	if !strings.Contains(command, "{in}") || !strings.Contains(command, "{out}") {
+		return conversionRule{}, fmt.Errorf("command for %s:%s must contain {in} and {out}", from, to)
+	}
+	return conversionRule{
+		from:    "." + strings.ToLower(strings.TrimPrefix(from, ".")),
+		to:      "." + strings.ToLower(strings.TrimPrefix(to, ".")),
+		command: args,
+	}, nil
+}
+
+// uploadConverter converts finished uploads as background jobs. A conversion
+// that fails or times out leaves the original untouched.
+type uploadConverter struct {
+	rules        []conversionRule
+	timeout      time.Duration
+	keepOriginal bool
+	jobs         *jobRegistry
+}
+
+func newUploadConverter(rules []conversionRule, timeout time.Duration, keepOriginal bool, jobs *jobRegistry) *uploadConverter {
+	return &uploadConverter{
+		rules:        rules,
+		timeout:      timeout,
+		keepOriginal: keepOriginal,
+		jobs:         jobs,
+	}
+}
+
+// convert starts a conversion job for the file if a rule matches its extension
+func (c *uploadConverter) convert(path string) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, rule := range c.rules {
+		if rule.from != ext {
+			continue
+		}
+		j := c.jobs.start("convert", func(ctx context.Context, j *job) error {
+			return c.run(ctx, rule, path)
+		})
+		slog.Info("Converting upload",
+			"path", path,
+			"to", rule.to,
+			"job_id", j.id)
+		return
+	}
+}
+
+func (c *uploadConverter) run(ctx context.Context, rule conversionRule, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	// The command writes into a scratch directory so a half-written output is
+	// never visible under a final name. It is next to the original, on the same
+	// file system as where the output is published.
+	scratch, err := os.MkdirTemp(filepath.Dir(path), ".convert-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + rule.to
+	out := filepath.Join(scratch, name)
+
+	args := make([]string, len(rule.command))
+	for i, arg := range rule.command {
+		arg = strings.ReplaceAll(arg, "{in}", path)
+		args[i] = strings.ReplaceAll(arg, "{out}", out)
+	}
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		slog.Warn("Conversion failed, keeping original",
+			"path", path,
+			"command", args[0],
+			"output", strings.TrimSpace(string(output)),
+			"error", err)
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+
+	// Next to the original, which is in a subdirectory with --layout date
+	finalName, err := publishUnique(out, filepath.Dir(path), name)
+	if err != nil {
+		return err
+	}
+	slog.Info("Upload converted",
+		"path", path,
+		"converted", finalName)
+
+	if !c.keepOriginal {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("Failed to remove original after conversion",
+				"path", path,
+				"error", err)
+		}
+		os.Remove(path + metaSuffix)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseConversionRule(t *testing.T) {
+	rule, err := parseConversionRule(".WAV:flac=ffmpeg -y -i {in} {out}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.from != ".wav" || rule.to != ".flac" || len(rule.command) != 5 || rule.command[0] != "ffmpeg" {
+		t.Errorf("parseConversionRule = %+v", rule)
+	}
+	for _, value := range []string{"", "wav:flac", "wav=ffmpeg {in} {out}", ":flac=ffmpeg {in} {out}", "wav:flac=", "wav:flac=ffmpeg {in}", "wav:flac=ffmpeg {out}"} {
+		if _, err := parseConversionRule(value); err == nil {
+			t.Errorf("parseConversionRule(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+// TestConverterHelperProcess is the conversion command of the converter tests,
+// the test binary run again with behavior, {in} and {out} as arguments
+func TestConverterHelperProcess(t *testing.T) {
+	if os.Getenv("SIMPLE_UPLOAD_CONVERTER_HELPER") != "1" {
+		return
+	}
+	args := os.Args[len(os.Args)-3:]
+	switch args[0] {
+	case "upper":
+		data, err := os.ReadFile(args[1])
+		if err == nil {
+			err = os.WriteFile(args[2], bytes.ToUpper(data), 0o644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "fail":
+		os.WriteFile(args[2], []byte("half"), 0o644)
+		fmt.Fprintln(os.Stderr, "unsupported codec")
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+	}
+	os.Exit(0)
+}
+
+func helperConversionRule(t *testing.T, behavior string) conversionRule {
+	t.Setenv("SIMPLE_UPLOAD_CONVERTER_HELPER", "1")
+	return conversionRule{
+		from:    ".txt",
+		to:      ".md",
+		command: []string{os.Args[0], "-test.run=^TestConverterHelperProcess$", "--", behavior, "{in}", "{out}"},
+	}
+}
+
+func TestUploadConverterRun(t *testing.T) {
+	tests := []struct {
+		behavior     string
+		keepOriginal bool
+		wantErr      bool
+	}{
+		{"upper", false, false},
+		{"upper", true, false},
+		{"fail", false, true},
+		{"hang", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s keep %v", tt.behavior, tt.keepOriginal), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "notes.txt")
+			if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			writeUploadMeta(dir, "notes.txt", "notes?.txt", "upload-id")
+			c := newUploadConverter([]conversionRule{helperConversionRule(t, tt.behavior)}, 2*time.Second, tt.keepOriginal, newJobRegistry())
+			if tt.behavior == "hang" {
+				c.timeout = 100 * time.Millisecond
+			}
+
+			err := c.run(context.Background(), c.rules[0], path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run = %v, want error %v", err, tt.wantErr)
+			}
+			converted, errConverted := os.ReadFile(filepath.Join(dir, "notes.md"))
+			original, errOriginal := os.ReadFile(path)
+			_, errMeta := os.Stat(path + metaSuffix)
+			switch {
+			case tt.wantErr:
+				// A failed conversion leaves nothing but the original behind
+				if errConverted == nil || string(original) != "hello" || errMeta != nil {
+					t.Errorf("after a failed conversion: converted %q, original %q (%v)", converted, original, errMeta)
+				}
+			case string(converted) != "HELLO":
+				t.Errorf("converted file holds %q (%v), want HELLO", converted, errConverted)
+			case tt.keepOriginal && (string(original) != "hello" || errMeta != nil):
+				t.Errorf("kept original holds %q (%v, sidecar %v)", original, errOriginal, errMeta)
+			case !tt.keepOriginal && (!os.IsNotExist(errOriginal) || !os.IsNotExist(errMeta)):
+				t.Errorf("original left after the conversion (%v, sidecar %v)", errOriginal, errMeta)
+			}
+			if scratch, _ := filepath.Glob(filepath.Join(dir, ".convert-*")); len(scratch) != 0 {
+				t.Errorf("scratch directories %v left behind", scratch)
+			}
+		})
+	}
+}
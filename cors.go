@@ -0,0 +1,35 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// corsConfig builds tusd's CORS configuration for --cors-origins: "*" allows
+// every origin, anything else is an exact allowlist of origins such as
+// https://cdn.example.com. Listed origins may send credentials, so a UI on
+// another origin keeps its resume session cookie.
+func corsConfig(origins []string) *tusd.CorsConfig {
+	config := tusd.DefaultCorsConfig
+	// Conditional uploads and the headers the server adds to tus responses
+	config.AllowHeaders += ", If-Match, If-None-Match"
+	config.ExposeHeaders += ", " + chunkAlignmentHeader + ", X-RateLimit-Limit, X-RateLimit-Remaining, Retry-After, " +
+		finalFilenameHeader + ", " + downloadURLHeader
+
+	quoted := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			config.AllowOrigin = regexp.MustCompile(".*")
+			return &config
+		}
+		if origin != "" {
+			quoted = append(quoted, regexp.QuoteMeta(origin))
+		}
+	}
+	config.AllowOrigin = regexp.MustCompile("^(" + strings.Join(quoted, "|") + ")$")
+	config.AllowCredentials = true
+	return &config
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// checksumMetadataKey is the metadata field in which clients declare the SHA-256
+// of the file they are about to upload, encoded as hex
+const checksumMetadataKey = "expected_sha256"
+
+// inflightUploads tracks in-progress uploads by their declared checksum so a
+// second, identical upload can be turned away while the first is still running
+type inflightUploads struct {
+	store *fileStore
+
+	mu         sync.Mutex
+	byChecksum map[string]inflightUpload
+}
+
+type inflightUpload struct {
+	id string
+	// at is when the checksum was claimed, before tusd created the upload
+	at time.Time
+}
+
+func newInflightUploads(store *fileStore) *inflightUploads {
+	return &inflightUploads{
+		store:      store,
+		byChecksum: make(map[string]inflightUpload),
+	}
+}
+
+// declaredChecksum is the expected_sha256 an upload declares, normalized the
+// way it is compared with the stored file
+func declaredChecksum(metadata tusd.MetaData) string {
+	return strings.ToLower(strings.TrimSpace(metadata[checksumMetadataKey]))
+}
+
+// running reports whether the upload is still waiting for data. Finished,
+// terminated or expired uploads no longer hold their checksum. One the store
+// doesn't have yet holds it for as long as quota reservations wait for tusd
+// to create the upload.
+func (u *inflightUploads) running(upload inflightUpload, now time.Time) bool {
+	ctx := context.Background()
+	stored, err := u.store.GetUpload(ctx, upload.id)
+	if err != nil {
+		return now.Sub(upload.at) < quotaReservationGrace
+	}
+	info, err := stored.GetInfo(ctx)
+	if err != nil {
+		return false
+	}
+	return info.SizeIsDeferred || info.Offset < info.Size
+}
+
+// rejectDuplicates is a pre-create hook which refuses an upload when another
+// upload with the same declared checksum is in flight. The upload ID is assigned
+// here so the reservation can be tied to it before tusd creates the upload.
+func (u *inflightUploads) rejectDuplicates(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	checksum := declaredChecksum(hook.Upload.MetaData)
+	if checksum == "" || hook.Upload.IsPartial {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := u.byChecksum[checksum]; ok {
+		if u.running(existing, now) {
+			slog.Info("Rejecting duplicate of in-flight upload",
+				"existing_upload_id", existing.id,
+				"filename", hook.Upload.MetaData["filename"],
+				"sha256", checksum)
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{},
+				tusd.NewError("ERR_DUPLICATE_UPLOAD", "an identical upload is already in progress as "+existing.id, http.StatusConflict)
+		}
+		delete(u.byChecksum, checksum)
+	}
+
+	id := hook.Upload.ID
+	if id == "" {
+		id = u.store.newUploadID()
+	}
+	u.byChecksum[checksum] = inflightUpload{id: id, at: now}
+
+	return tusd.HTTPResponse{}, tusd.FileInfoChanges{ID: id}, nil
+}
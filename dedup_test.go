@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestRejectDuplicatesSimultaneousUploads(t *testing.T) {
+	store := newFileStore(t.TempDir(), false, 0, "")
+	inflight := newInflightUploads(store)
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	// The same checksum as two clients may declare it
+	declared := []string{" " + sum + "\n", "2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824"}
+	ids := make([]string, len(declared))
+	errs := make([]error, len(declared))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, checksum := range declared {
+		wg.Go(func() {
+			<-start
+			_, changes, err := inflight.rejectDuplicates(tusd.HookEvent{Upload: tusd.FileInfo{
+				Size:     5,
+				MetaData: tusd.MetaData{"filename": "a.txt", checksumMetadataKey: checksum},
+			}})
+			ids[i], errs[i] = changes.ID, err
+		})
+	}
+	close(start)
+	wg.Wait()
+
+	accepted := ""
+	for i, err := range errs {
+		if err == nil {
+			accepted = ids[i]
+		}
+	}
+	if accepted == "" || (errs[0] == nil) == (errs[1] == nil) {
+		t.Fatalf("rejectDuplicates returned %v, want exactly one upload refused", errs)
+	}
+
+	// Once the accepted upload finished, the checksum is free again
+	if _, err := store.NewUpload(context.Background(), tusd.FileInfo{ID: accepted}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := inflight.rejectDuplicates(tusd.HookEvent{Upload: tusd.FileInfo{
+		MetaData: tusd.MetaData{"filename": "b.txt", checksumMetadataKey: sum},
+	}}); err != nil {
+		t.Errorf("upload after the first finished: %v, want it accepted", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// availableSpace is not implemented on this platform, so --min-free-space
+// isn't enforced
+func availableSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// folderDownloads streams directories of the uploads dir as tar archives. All
+// access goes through the os.Root file systems of the storageRoots, so neither
+// ".." nor symlinks can escape them.
+type folderDownloads struct {
+	fsys fs.FS
+}
+
+func newFolderDownloads(fsys fs.FS) *folderDownloads {
+	return &folderDownloads{fsys: fsys}
+}
+
+// cleanFolderPath turns a client supplied folder into a path relative to the
+// uploads dir, "." being the uploads dir itself
+func cleanFolderPath(p string) string {
+	cleaned := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if cleaned == "" {
+		return "."
+	}
+	return cleaned
+}
+
+// stagingPrefixes name the temporary files and directories the server creates
+// next to the uploads while processing them. Uploaded names never start with a
+// dot, see sanitizeFilename.
+var stagingPrefixes = []string{".convert-", ".normalize-", ".writable-check-", ".route-", ".sparse-"}
+
+// isUploadBookkeeping reports whether a file is not a finished upload: tusd's info
+// and lock files, the data of uploads still in progress, quarantined uploads,
+// receipts, filename sidecars, thumbnails and staging files
+func isUploadBookkeeping(fsys fs.FS, name string) bool {
+	if isBookkeepingName(name) {
+		return true
+	}
+	_, err := fs.Stat(fsys, name+".info")
+	return err == nil
+}
+
+// isBookkeepingName is the part of isUploadBookkeeping that goes by the name
+// alone, for callers that know which .info files exist
+func isBookkeepingName(name string) bool {
+	for _, element := range strings.Split(name, "/") {
+		if element == thumbnailDir || element == webhookQueueDir {
+			return true
+		}
+		for _, prefix := range stagingPrefixes {
+			if strings.HasPrefix(element, prefix) {
+				return true
+			}
+		}
+	}
+	for _, suffix := range []string{".info", ".lock", ".corrupt", sparseSuffix, receiptSuffix, metaSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDownloadFolder serves GET /api/download-folder?path=... as a tar stream
+// of every finished upload below the folder
+func (d *folderDownloads) handleDownloadFolder(w http.ResponseWriter, r *http.Request) {
+	folder := cleanFolderPath(r.URL.Query().Get("path"))
+	fsys := d.fsys
+
+	info, err := fs.Stat(fsys, folder)
+	if err != nil || !info.IsDir() {
+		http.Error(w, "folder not found", http.StatusNotFound)
+		return
+	}
+
+	name := path.Base(folder)
+	if folder == "." {
+		name = "uploads"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".tar"}))
+
+	tw := tar.NewWriter(w)
+	err = fs.WalkDir(fsys, folder, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || isUploadBookkeeping(fsys, p) {
+			return nil
+		}
+		return addTarFile(tw, fsys, p, strings.TrimPrefix(p, folder+"/"))
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		// The headers are already sent, so the only way to tell the client is to
+		// cut the response short instead of ending the archive cleanly
+		slog.Error("Failed to stream folder download",
+			"path", folder,
+			"error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func addTarFile(tw *tar.Writer, fsys fs.FS, p, name string) error {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return err
+	}
+	return nil
+}
+
+// handleDownloadFile serves GET /api/download/{name}, a finished upload by its
+// final name, as an attachment. http.ServeContent answers Range and conditional
+// requests, with the ETag of /api/files/{name}/info: an If-Range matching it or
+// the Last-Modified time gets the range, any other the whole file. Only paths
+// of names sanitizeFilename leaves unchanged are accepted, and the roots behind
+// fsys confine the lookup to the storage directories.
+func handleDownloadFile(fsys fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !isUploadPath(name) || isUploadBookkeeping(fsys, name) {
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		// The files of an os.Root seek
+		content, ok := f.(io.ReadSeeker)
+		if err != nil || !ok || !info.Mode().IsRegular() {
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		}
+
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+		w.Header().Set("ETag", fileETag(info))
+		http.ServeContent(w, r, name, info.ModTime(), content)
+	}
+}
+
+// maxZipRequestSize bounds the JSON body of POST /api/download-zip
+const maxZipRequestSize = 1 << 20
+
+// handleDownloadZip serves POST /api/download-zip, a JSON body {"files": [...]}
+// of final names, as a ZIP archive built while it is sent. Names are checked like
+// for /api/download/{name}, and all of them must exist: a missing or invalid name
+// answers 400 before anything is streamed, rather than an archive the client
+// can't tell is incomplete. Repeated names are only added once.
+func handleDownloadZip(fsys fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Files []string `json:"files"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxZipRequestSize)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if len(req.Files) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "files must name at least one file")
+			return
+		}
+
+		names := make([]string, 0, len(req.Files))
+		seen := make(map[string]bool, len(req.Files))
+		for _, name := range req.Files {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if !isUploadPath(name) || isUploadBookkeeping(fsys, name) {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("file not found: %s", name))
+				return
+			}
+			if info, err := fs.Stat(fsys, name); err != nil || !info.Mode().IsRegular() {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("file not found: %s", name))
+				return
+			}
+			names = append(names, name)
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "files.zip"}))
+
+		zw := zip.NewWriter(w)
+		var err error
+		for _, name := range names {
+			if err = addZipFile(zw, fsys, name); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			// Same as for folder downloads, a truncated response marks the failure
+			slog.Error("Failed to stream ZIP download",
+				"files", len(names),
+				"error", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+func addZipFile(zw *zip.Writer, fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, f)
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileIfRange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Whole seconds, as Last-Modified has no more
+	modTime := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/download/{name...}", handleDownloadFile(root.FS()))
+
+	download := func(ifRange string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/download/report.txt", nil)
+		r.Header.Set("Range", "bytes=2-4")
+		if ifRange != "" {
+			r.Header.Set("If-Range", ifRange)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+	etag := download("").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("download has no ETag")
+	}
+
+	tests := []struct {
+		name, ifRange string
+		wantCode      int
+		wantBody      string
+	}{
+		{"no If-Range", "", http.StatusPartialContent, "234"},
+		{"matching ETag", etag, http.StatusPartialContent, "234"},
+		{"matching Last-Modified", modTime.Format(http.TimeFormat), http.StatusPartialContent, "234"},
+		{"other ETag", `"a-1"`, http.StatusOK, "0123456789"},
+		{"other Last-Modified", modTime.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK, "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := download(tt.ifRange)
+			if rec.Code != tt.wantCode || rec.Body.String() != tt.wantBody {
+				t.Errorf("status %d with %q, want %d with %q", rec.Code, rec.Body, tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+
+	// A rewritten file has another ETag, so a stale If-Range gets all of it
+	if err := os.WriteFile(path, []byte("abcdefghij"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := download(etag); rec.Code != http.StatusOK || rec.Body.String() != "abcdefghij" {
+		t.Errorf("If-Range of the old file: status %d with %q, want the new file", rec.Code, rec.Body)
+	}
+}
+
+func TestDownloadFolderTar(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"reports/q1.txt":                      "first",
+		"reports/2024/q2.txt":                 "second",
+		"reports/upload-id":                   "in progress",
+		"reports/upload-id.info":              "{}",
+		"reports/upload-id.lock":              "",
+		"reports/broken.corrupt":              "bad",
+		"reports/q1.txt" + receiptSuffix:      "{}",
+		"reports/q1.txt" + metaSuffix:         "{}",
+		"reports/.route-other-id":             "staged",
+		"reports/" + thumbnailDir + "/q1.png": "thumbnail",
+		"elsewhere.txt":                       "outside",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	downloads := newFolderDownloads(root.FS())
+
+	download := func(folder string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		downloads.handleDownloadFolder(w, httptest.NewRequest(http.MethodGet, "/api/download-folder?path="+folder, nil))
+		return w
+	}
+	untar := func(w *httptest.ResponseRecorder) map[string]string {
+		t.Helper()
+		entries := map[string]string{}
+		tr := tar.NewReader(w.Body)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return entries
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[header.Name] = string(data)
+		}
+	}
+
+	w := download("reports")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-tar" || w.Header().Get("Content-Disposition") != `attachment; filename=reports.tar` {
+		t.Fatalf("status %d, headers %v", w.Code, w.Header())
+	}
+	want := map[string]string{"q1.txt": "first", "2024/q2.txt": "second"}
+	if entries := untar(w); !maps.Equal(entries, want) {
+		t.Errorf("archive holds %v, want only the finished uploads %v", slices.Sorted(maps.Keys(entries)), slices.Sorted(maps.Keys(want)))
+	}
+
+	// Escaping the uploads dir ends up at its top
+	w = download("../..")
+	if entries := untar(w); w.Header().Get("Content-Disposition") != `attachment; filename=uploads.tar` || len(entries) != 3 || entries["elsewhere.txt"] != "outside" {
+		t.Errorf("archive of ../.. holds %v, want the whole uploads dir", slices.Sorted(maps.Keys(entries)))
+	}
+
+	for _, folder := range []string{"missing", "elsewhere.txt"} {
+		if w := download(folder); w.Code != http.StatusNotFound {
+			t.Errorf("folder %s: status %d, want 404", folder, w.Code)
+		}
+	}
+}
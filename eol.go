@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// maxNormalizeSize bounds the files --normalize-eol reads into memory; larger
+// ones are left alone
+const maxNormalizeSize = 32 << 20
+
+var lineEndings = map[string][]byte{
+	"lf":   []byte("\n"),
+	"crlf": []byte("\r\n"),
+}
+
+// isPlainText reports whether data is confidently text: valid UTF-8 without NUL
+// bytes or control characters other than the usual whitespace and escape.
+// Anything else, including legacy 8-bit encodings, counts as binary.
+func isPlainText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != 0x1b {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeLineEndings rewrites the line endings of a text file to eol ("lf" or
+// "crlf") and reports whether the file changed. Binary files, ambiguous ones
+// and files above maxNormalizeSize are skipped. Lone CRs are kept since they
+// may be content rather than line breaks.
+func normalizeLineEndings(path, eol string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() > maxNormalizeSize {
+		f.Close()
+		return false, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || !isPlainText(data) {
+		return false, err
+	}
+
+	normalized := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if eol != "lf" {
+		normalized = bytes.ReplaceAll(normalized, []byte("\n"), lineEndings[eol])
+	}
+	if bytes.Equal(normalized, data) {
+		return false, nil
+	}
+
+	// Replace the file in one rename so it is never seen half rewritten
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".normalize-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(normalized)
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
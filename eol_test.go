@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPlainText(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"empty", "", true},
+		{"LF", "one\ntwo\n", true},
+		{"CRLF", "one\r\ntwo\r\n", true},
+		{"lone CR", "one\rtwo", true},
+		{"tab, form feed and escape", "a\tb\fc\x1b[0m", true},
+		{"UTF-8", "café\n", true},
+		{"NUL", "one\x00two", false},
+		{"other control character", "one\x07two", false},
+		{"invalid UTF-8", "caf\xe9\n", false},
+		{"PNG", "\x89PNG\r\n\x1a\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPlainText([]byte(tt.data)); got != tt.want {
+				t.Errorf("isPlainText(%q) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	tests := []struct {
+		name, eol, in, want string
+	}{
+		{"CRLF to LF", "lf", "one\r\ntwo\r\n", "one\ntwo\n"},
+		{"LF to CRLF", "crlf", "one\ntwo\n", "one\r\ntwo\r\n"},
+		{"mixed to LF", "lf", "one\r\ntwo\nthree\r\n", "one\ntwo\nthree\n"},
+		{"mixed to CRLF", "crlf", "one\r\ntwo\nthree", "one\r\ntwo\r\nthree"},
+		{"already LF", "lf", "one\ntwo\n", "one\ntwo\n"},
+		{"already CRLF", "crlf", "one\r\ntwo\r\n", "one\r\ntwo\r\n"},
+		{"lone CR kept with LF", "lf", "one\rtwo\r\n", "one\rtwo\n"},
+		{"lone CR kept with CRLF", "crlf", "one\rtwo\n", "one\rtwo\r\n"},
+		{"binary", "lf", "one\r\n\x00two\r\n", "one\r\n\x00two\r\n"},
+		{"invalid UTF-8", "lf", "caf\xe9\r\n", "caf\xe9\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, []byte(tt.in), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			changed, err := normalizeLineEndings(path, tt.eol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want || changed != (tt.in != tt.want) {
+				t.Errorf("normalizeLineEndings(%q, %s) = %q, changed %v, want %q", tt.in, tt.eol, data, changed, tt.want)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0o640 {
+				t.Errorf("file mode after normalizing is %v, want 0640", info.Mode().Perm())
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// eventsKeepAlive is how often /api/events sends a comment to idle clients, so
+// proxies don't close the connection
+const eventsKeepAlive = 30 * time.Second
+
+// dispatchHookEvents hands every event of one of tusd's notification channels
+// to each consumer in turn. tusd's channels can only be read once, so the
+// features interested in the same notifications share a dispatcher.
+func dispatchHookEvents(events <-chan tusd.HookEvent, consumers ...func(tusd.HookEvent)) {
+	if len(consumers) == 0 {
+		return
+	}
+	go func() {
+		for event := range events {
+			for _, consume := range consumers {
+				consume(event)
+			}
+		}
+	}()
+}
+
+// uploadEvent is an upload's state as streamed by /api/events
+type uploadEvent struct {
+	Type     string    `json:"type"`
+	UploadID string    `json:"upload_id"`
+	Filename string    `json:"filename,omitempty"`
+	Offset   int64     `json:"offset"`
+	Size     int64     `json:"size"`
+	Deferred bool      `json:"size_deferred,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// uploadEvents fans tusd's created, progress and completed notifications out
+// to the connected /api/events clients
+type uploadEvents struct {
+	mu          sync.Mutex
+	subscribers map[chan uploadEvent]struct{}
+}
+
+func newUploadEvents() *uploadEvents {
+	return &uploadEvents{subscribers: make(map[chan uploadEvent]struct{})}
+}
+
+func (e *uploadEvents) publish(kind string, hook tusd.HookEvent) {
+	event := uploadEvent{
+		Type:     kind,
+		UploadID: hook.Upload.ID,
+		Filename: hook.Upload.MetaData["filename"],
+		Offset:   hook.Upload.Offset,
+		Size:     hook.Upload.Size,
+		Deferred: hook.Upload.SizeIsDeferred,
+		Time:     time.Now().UTC(),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subscribers {
+		// A client that can't keep up misses events rather than holding up tusd
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (e *uploadEvents) created(hook tusd.HookEvent) { e.publish("created", hook) }
+
+// progress leaves out the progress notification tusd sends for the last bytes,
+// which can arrive after the completed event
+func (e *uploadEvents) progress(hook tusd.HookEvent) {
+	if hook.Upload.SizeIsDeferred || hook.Upload.Offset < hook.Upload.Size {
+		e.publish("progress", hook)
+	}
+}
+
+func (e *uploadEvents) completed(hook tusd.HookEvent) { e.publish("completed", hook) }
+
+func (e *uploadEvents) subscribe() chan uploadEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan uploadEvent, 64)
+	e.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (e *uploadEvents) unsubscribe(ch chan uploadEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.subscribers, ch)
+}
+
+// handleEvents serves GET /api/events as a Server-Sent Events stream of the
+// uploads created, progressing and completed from now on, across all clients.
+// The event name is the type, the data the JSON uploadEvent. Requires the admin
+// token, since it reveals every client's filenames.
+func (e *uploadEvents) handleEvents(adminToken *liveToken) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !requireAdmin(w, req, adminToken) {
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		ch := e.subscribe()
+		defer e.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if rc.Flush() != nil {
+			return
+		}
+
+		keepAlive := time.NewTicker(eventsKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			var err error
+			select {
+			case <-req.Context().Done():
+				return
+			case <-keepAlive.C:
+				_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			case event := <-ch:
+				var data []byte
+				if data, err = json.Marshal(event); err == nil {
+					_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+				}
+			}
+			if err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
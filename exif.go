@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+var (
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader    = []byte("Exif\x00\x00")
+	xmpHeaders    = [][]byte{[]byte("http://ns.adobe.com/xap/1.0/\x00"), []byte("http://ns.adobe.com/xmp/extension/\x00")}
+	iptcHeader    = []byte("Photoshop 3.0\x00")
+	errNotTIFF    = errors.New("not a TIFF header")
+	errBadSegment = errors.New("malformed segment")
+)
+
+// pngMetadataChunks are the PNG chunks --strip-exif drops: EXIF, the text
+// chunks XMP and camera software write to, and the modification time
+var pngMetadataChunks = []string{"eXIf", "tEXt", "zTXt", "iTXt", "tIME"}
+
+// tiffMetadataTags are the TIFF tags --strip-exif removes: the EXIF and GPS
+// IFDs, XMP, IPTC and Photoshop blocks, and the camera and software fields
+var tiffMetadataTags = []uint16{
+	0x8769, 0x8825, 0x02bc, 0x83bb, 0x8649,
+	0x010f, 0x0110, 0x0131, 0x0132, 0x013b, 0x013c,
+}
+
+// tiffPointerTags point at IFDs of their own, zeroed along with the tag. The
+// interoperability IFD hangs off the EXIF IFD.
+var tiffPointerTags = []uint16{0x8769, 0x8825, 0xa005}
+
+// stripImageMetadata rewrites a JPEG, PNG or TIFF file without its EXIF, XMP
+// and IPTC metadata and reports whether it changed. Other files are left alone,
+// and so are images that don't parse, with the error saying why. Image data is
+// copied byte for byte.
+func stripImageMetadata(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, 8)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	head = head[:n]
+
+	var strip func(tmp *os.File) (bool, error)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8, 0xff}):
+		strip = func(tmp *os.File) (bool, error) { return stripJPEG(tmp, f) }
+	case bytes.Equal(head, pngSignature):
+		strip = func(tmp *os.File) (bool, error) { return stripPNG(tmp, f) }
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		// Metadata is zeroed in place, so all offsets stay valid. BigTIFF has
+		// another header and is left alone.
+		strip = func(tmp *os.File) (bool, error) {
+			if _, err := io.Copy(tmp, f); err != nil {
+				return false, err
+			}
+			return stripTIFF(tmp)
+		}
+	default:
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// Replace the file in one rename so it is never seen half rewritten
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".strip-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	changed, err := strip(tmp)
+	if err == nil && changed {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// stripJPEG copies a JPEG without its EXIF, XMP and IPTC segments. They all
+// come before the first scan, which is copied as is with everything after it.
+// The EXIF orientation is kept in a minimal EXIF segment of its own, as
+// viewers would otherwise show the image rotated.
+func stripJPEG(dst io.Writer, src io.Reader) (bool, error) {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		return false, err
+	}
+	w.Write(soi)
+
+	changed := false
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		if b != 0xff {
+			return false, fmt.Errorf("%w: expected a JPEG marker", errBadSegment)
+		}
+		marker := byte(0xff)
+		for marker == 0xff {
+			if marker, err = r.ReadByte(); err != nil {
+				return false, err
+			}
+		}
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image, nothing to strip past here
+			w.Write([]byte{0xff, marker})
+			if _, err := io.Copy(w, r); err != nil {
+				return false, err
+			}
+			return changed, w.Flush()
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			w.Write([]byte{0xff, marker})
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return false, err
+		}
+		if length < 2 {
+			return false, fmt.Errorf("%w: JPEG segment length %d", errBadSegment, length)
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return false, err
+		}
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, exifHeader):
+			changed = true
+			if orientation := exifOrientation(payload[len(exifHeader):]); orientation > 1 {
+				w.Write(orientationSegment(orientation))
+			}
+			continue
+		case marker == 0xe1 && slices.ContainsFunc(xmpHeaders, func(h []byte) bool { return bytes.HasPrefix(payload, h) }),
+			marker == 0xed && bytes.HasPrefix(payload, iptcHeader):
+			changed = true
+			continue
+		}
+		w.Write([]byte{0xff, marker})
+		binary.Write(w, binary.BigEndian, length)
+		w.Write(payload)
+	}
+}
+
+// exifOrientation returns the orientation tag of IFD0 of EXIF data, 0 if it
+// has none or doesn't parse
+func exifOrientation(tiff []byte) uint16 {
+	order, err := tiffByteOrder(tiff)
+	if err != nil || len(tiff) < 8 {
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// A SHORT, stored in the entry itself
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return order.Uint16(tiff[entry+8:])
+		}
+	}
+	return 0
+}
+
+// orientationSegment returns an APP1 segment of EXIF data holding only the
+// orientation
+func orientationSegment(orientation uint16) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xff, 0xe1, 0x00, 0x22})
+	b.Write(exifHeader)
+	b.Write([]byte("MM\x00*\x00\x00\x00\x08"))
+	// One entry: orientation, SHORT, count 1, then no next IFD
+	binary.Write(&b, binary.BigEndian, []uint16{1, 0x0112, 3, 0, 1, orientation, 0, 0, 0})
+	return b.Bytes()
+}
+
+// stripPNG copies a PNG without its EXIF and text chunks
+func stripPNG(dst io.Writer, src io.Reader) (bool, error) {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	if _, err := io.CopyN(w, r, int64(len(pngSignature))); err != nil {
+		return false, err
+	}
+
+	changed := false
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return false, err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > 1<<31-1 {
+			return false, fmt.Errorf("%w: PNG chunk length %d", errBadSegment, length)
+		}
+		chunkType := string(header[4:])
+		// Data and CRC
+		size := int64(length) + 4
+		if slices.Contains(pngMetadataChunks, chunkType) {
+			changed = true
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return false, err
+			}
+			continue
+		}
+		w.Write(header)
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return false, err
+		}
+		if chunkType == "IEND" {
+			return changed, w.Flush()
+		}
+	}
+}
+
+func tiffByteOrder(header []byte) (binary.ByteOrder, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte("II*\x00")):
+		return binary.LittleEndian, nil
+	case bytes.HasPrefix(header, []byte("MM\x00*")):
+		return binary.BigEndian, nil
+	}
+	return nil, errNotTIFF
+}
+
+// tiffTypeSizes are the sizes of the TIFF field types, by type number
+var tiffTypeSizes = map[uint16]int64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// tiffFile reads and zeroes the IFDs of a classic TIFF file in place
+type tiffFile struct {
+	f     *os.File
+	size  int64
+	order binary.ByteOrder
+	// seen guards against IFDs pointing back at each other
+	seen map[int64]bool
+}
+
+// tiffEntry is a 12 byte IFD entry
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    [4]byte
+}
+
+// stripTIFF removes the metadata tags from every IFD of the TIFF file f and
+// zeroes what they point at. The entries left are moved up in their IFD,
+// keeping it sorted.
+func stripTIFF(f *os.File) (bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return false, err
+	}
+	order, err := tiffByteOrder(header)
+	if err != nil {
+		return false, err
+	}
+	t := &tiffFile{f: f, size: info.Size(), order: order, seen: make(map[int64]bool)}
+
+	changed := false
+	for offset := int64(order.Uint32(header[4:])); offset != 0; {
+		entries, next, err := t.readIFD(offset)
+		if err != nil {
+			return false, err
+		}
+		var kept []tiffEntry
+		for _, entry := range entries {
+			if !slices.Contains(tiffMetadataTags, entry.tag) {
+				kept = append(kept, entry)
+				continue
+			}
+			if err := t.zeroEntry(entry); err != nil {
+				return false, err
+			}
+		}
+		if len(kept) < len(entries) {
+			changed = true
+			if err := t.writeIFD(offset, len(entries), kept, next); err != nil {
+				return false, err
+			}
+		}
+		offset = next
+	}
+	return changed, nil
+}
+
+// readIFD returns the entries of the IFD at offset and the offset of the next
+func (t *tiffFile) readIFD(offset int64) ([]tiffEntry, int64, error) {
+	if t.seen[offset] || offset < 8 || offset+2 > t.size {
+		return nil, 0, fmt.Errorf("%w: TIFF IFD at %d", errBadSegment, offset)
+	}
+	t.seen[offset] = true
+	countBytes := make([]byte, 2)
+	if _, err := t.f.ReadAt(countBytes, offset); err != nil {
+		return nil, 0, err
+	}
+	count := int64(t.order.Uint16(countBytes))
+	if offset+2+12*count+4 > t.size {
+		return nil, 0, fmt.Errorf("%w: TIFF IFD at %d", errBadSegment, offset)
+	}
+	data := make([]byte, 12*count+4)
+	if _, err := t.f.ReadAt(data, offset+2); err != nil {
+		return nil, 0, err
+	}
+	entries := make([]tiffEntry, count)
+	for i := range entries {
+		raw := data[12*i:]
+		entries[i] = tiffEntry{tag: t.order.Uint16(raw), typ: t.order.Uint16(raw[2:]), count: t.order.Uint32(raw[4:])}
+		copy(entries[i].value[:], raw[8:12])
+	}
+	return entries, int64(t.order.Uint32(data[12*count:])), nil
+}
+
+// writeIFD rewrites the IFD at offset, which had count entries, with the
+// entries kept, zeroing the slots they no longer use
+func (t *tiffFile) writeIFD(offset int64, count int, kept []tiffEntry, next int64) error {
+	var b bytes.Buffer
+	binary.Write(&b, t.order, uint16(len(kept)))
+	for _, entry := range kept {
+		binary.Write(&b, t.order, []uint16{entry.tag, entry.typ})
+		binary.Write(&b, t.order, entry.count)
+		b.Write(entry.value[:])
+	}
+	binary.Write(&b, t.order, uint32(next))
+	b.Write(make([]byte, 12*(count-len(kept))))
+	_, err := t.f.WriteAt(b.Bytes(), offset)
+	return err
+}
+
+// zeroEntry zeroes the value of an entry stored outside of it and, for the
+// pointer tags, the IFD it points at with everything it references
+func (t *tiffFile) zeroEntry(entry tiffEntry) error {
+	if slices.Contains(tiffPointerTags, entry.tag) {
+		offset := int64(t.order.Uint32(entry.value[:]))
+		entries, _, err := t.readIFD(offset)
+		if err != nil {
+			return err
+		}
+		for _, nested := range entries {
+			if err := t.zeroEntry(nested); err != nil {
+				return err
+			}
+		}
+		return t.zero(offset, 2+12*int64(len(entries))+4)
+	}
+
+	typeSize, ok := tiffTypeSizes[entry.typ]
+	if !ok {
+		return fmt.Errorf("%w: TIFF field type %d", errBadSegment, entry.typ)
+	}
+	size := typeSize * int64(entry.count)
+	if size <= 4 {
+		// Stored within the entry, which is removed
+		return nil
+	}
+	return t.zero(int64(t.order.Uint32(entry.value[:])), size)
+}
+
+func (t *tiffFile) zero(offset, size int64) error {
+	if offset < 8 || offset+size > t.size {
+		return fmt.Errorf("%w: TIFF value at %d", errBadSegment, offset)
+	}
+	_, err := t.f.WriteAt(make([]byte, size), offset)
+	return err
+}
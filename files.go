@@ -0,0 +1,343 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileEntry describes one finished upload in /api/files. OriginalName is the
+// filename the client sent, which differs from Name when it had to be changed.
+type fileEntry struct {
+	Name         string    `json:"name"`
+	OriginalName string    `json:"original_name"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"modtime"`
+}
+
+// fileDetails is /api/files/{name}/info: the listing entry, plus the content
+// type sniffed from the first bytes and an ETag that changes with the file
+type fileDetails struct {
+	fileEntry
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag"`
+}
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// fileListPage is one page of /api/files. Total counts the files matching the
+// filters across all pages. Next is the ?after= cursor of the following page
+// and is empty on the last one.
+type fileListPage struct {
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Items  []fileEntry `json:"items"`
+	Next   string      `json:"next,omitempty"`
+}
+
+// fileSorts compare the listed files; by name needs no file info, so it is nil
+// there and only the page is stat-ed
+var fileSorts = map[string]func(a, b fileEntry) int{
+	"name":  nil,
+	"size":  func(a, b fileEntry) int { return cmp.Compare(a.Size, b.Size) },
+	"mtime": func(a, b fileEntry) int { return a.ModTime.Compare(b.ModTime) },
+}
+
+// fileList lists the finished uploads at the top of the uploads directory, or
+// below it as well when recursive, named by their slash separated path
+type fileList struct {
+	fsys      fs.FS
+	recursive bool
+}
+
+func newFileList(fsys fs.FS, recursive bool) *fileList {
+	return &fileList{fsys: fsys, recursive: recursive}
+}
+
+// fileFilter selects the listed files by a case-insensitive substring of the
+// name and by extension
+type fileFilter struct {
+	query string
+	ext   string
+}
+
+func newFileFilter(query, ext string) fileFilter {
+	if ext != "" {
+		ext = "." + strings.TrimPrefix(ext, ".")
+	}
+	return fileFilter{query: strings.ToLower(query), ext: strings.ToLower(ext)}
+}
+
+func (f fileFilter) match(name string) bool {
+	if f.ext != "" && strings.ToLower(path.Ext(name)) != f.ext {
+		return false
+	}
+	return f.query == "" || strings.Contains(strings.ToLower(name), f.query)
+}
+
+// names walks the directory for the finished uploads matching filter. It goes
+// by the directory entries alone, without stat-ing the files.
+func (l *fileList) names(filter fileFilter) (map[string]fs.DirEntry, error) {
+	entries := make(map[string]fs.DirEntry)
+	err := fs.WalkDir(l.fsys, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if p != "." && (!l.recursive || isUploadBookkeeping(l.fsys, p)) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		entries[p] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	matches := make(map[string]fs.DirEntry)
+	for p, entry := range entries {
+		// Uploads in progress are the files next to a tusd .info file
+		_, inProgress := entries[p+".info"]
+		if !inProgress && entry.Type().IsRegular() && !isBookkeepingName(p) && filter.match(p) {
+			matches[p] = entry
+		}
+	}
+	return matches, nil
+}
+
+// fileCursor is the ?after= cursor continuing a listing sorted by sortBy after
+// file. By name it is the name, as for /api/manifest; by size or mtime the
+// sort key comes first, so the cursor still has its place once the file is gone.
+func fileCursor(file fileEntry, sortBy string) string {
+	switch sortBy {
+	case "size":
+		return strconv.FormatInt(file.Size, 10) + ":" + file.Name
+	case "mtime":
+		return strconv.FormatInt(file.ModTime.UnixNano(), 10) + ":" + file.Name
+	}
+	return file.Name
+}
+
+// parseFileCursor is the reverse of fileCursor
+func parseFileCursor(cursor, sortBy string) (fileEntry, bool) {
+	if sortBy == "name" {
+		return fileEntry{Name: cursor}, true
+	}
+	key, name, ok := strings.Cut(cursor, ":")
+	n, err := strconv.ParseInt(key, 10, 64)
+	if !ok || err != nil {
+		return fileEntry{}, false
+	}
+	if sortBy == "size" {
+		return fileEntry{Name: name, Size: n}, true
+	}
+	return fileEntry{Name: name, ModTime: time.Unix(0, n).UTC()}, true
+}
+
+// handleList serves GET /api/files?sort=name|size|mtime&order=asc|desc with
+// ?q= and ?ext= filters, paged by ?limit= and either ?offset= or ?after=.
+// Offsets shift when files are added or removed between requests, so a client
+// walking the whole listing follows the next cursor of each page instead,
+// which neither skips nor repeats files that stay.
+func (l *fileList) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sortBy := cmp.Or(query.Get("sort"), "name")
+	compare, ok := fileSorts[sortBy]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "sort must be name, size or mtime")
+		return
+	}
+	order := cmp.Or(query.Get("order"), "asc")
+	if order != "asc" && order != "desc" {
+		writeJSONError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxListLimit))
+			return
+		}
+		limit = n
+	}
+	offset := 0
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+		offset = n
+	}
+	var cursor fileEntry
+	after := query.Get("after")
+	if after != "" {
+		if query.Has("offset") {
+			writeJSONError(w, http.StatusBadRequest, "offset and after can't be combined")
+			return
+		}
+		if cursor, ok = parseFileCursor(after, sortBy); !ok {
+			writeJSONError(w, http.StatusBadRequest, "after must be the next cursor of a page sorted by "+sortBy)
+			return
+		}
+	}
+	// directed turns an ascending comparison into one in the listing's order
+	directed := func(c int) int {
+		if order == "desc" {
+			return -c
+		}
+		return c
+	}
+
+	entries, err := l.names(newFileFilter(query.Get("q"), query.Get("ext")))
+	if err != nil {
+		slog.Error("Failed to list files", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list files")
+		return
+	}
+	page := fileListPage{Total: len(entries), Limit: limit, Items: []fileEntry{}}
+
+	if compare == nil {
+		names := slices.Sorted(maps.Keys(entries))
+		if order == "desc" {
+			slices.Reverse(names)
+		}
+		if after != "" {
+			var found bool
+			offset, found = slices.BinarySearchFunc(names, cursor.Name, func(name, target string) int {
+				return directed(strings.Compare(name, target))
+			})
+			if found {
+				offset++
+			}
+		}
+		page.Offset = offset
+		end := min(offset+limit, len(names))
+		if end < len(names) {
+			page.Next = fileCursor(fileEntry{Name: names[end-1]}, sortBy)
+		}
+		for _, p := range names[min(offset, end):end] {
+			info, err := entries[p].Info()
+			if err != nil {
+				// Removed since the directory was read
+				continue
+			}
+			page.Items = append(page.Items, fileEntry{
+				Name:         p,
+				OriginalName: readOriginalFilename(l.fsys, p),
+				Size:         info.Size(),
+				ModTime:      info.ModTime().UTC(),
+			})
+		}
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+
+	// Sorting by size or modification time needs every matching file's info,
+	// but the original names are still only read for the page
+	files := make([]fileEntry, 0, len(entries))
+	for p, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, fileEntry{Name: p, Size: info.Size(), ModTime: info.ModTime().UTC()})
+	}
+	// Ties are broken by name so the order is stable between requests
+	compareFiles := func(a, b fileEntry) int {
+		return directed(cmp.Or(compare(a, b), strings.Compare(a.Name, b.Name)))
+	}
+	slices.SortFunc(files, compareFiles)
+	if after != "" {
+		var found bool
+		if offset, found = slices.BinarySearchFunc(files, cursor, compareFiles); found {
+			offset++
+		}
+	}
+	page.Offset = offset
+	end := min(offset+limit, len(files))
+	if end < len(files) {
+		page.Next = fileCursor(files[end-1], sortBy)
+	}
+	for _, file := range files[min(offset, end):end] {
+		file.OriginalName = readOriginalFilename(l.fsys, file.Name)
+		page.Items = append(page.Items, file)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleFileInfo serves GET /api/files/{name}/info, without downloading more
+// than the bytes needed to sniff the content type. Names of uploads in
+// subdirectories have their slashes escaped as %2F.
+func handleFileInfo(fsys fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !isUploadPath(name) || isUploadBookkeeping(fsys, name) {
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		}
+
+		head := make([]byte, 512)
+		n, err := io.ReadFull(f, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			slog.Error("Failed to read file", "path", name, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to read file")
+			return
+		}
+
+		// The sidecar stays behind when the file is copied or moved, the
+		// --use-xattr attributes go with it
+		originalName := readSidecarFilename(fsys, name)
+		if originalName == "" {
+			originalName = readXattrFilename(f)
+		}
+		if originalName == "" {
+			originalName = path.Base(name)
+		}
+
+		etag := fileETag(info)
+		w.Header().Set("ETag", etag)
+		writeJSON(w, http.StatusOK, fileDetails{
+			fileEntry: fileEntry{
+				Name:         name,
+				OriginalName: originalName,
+				Size:         info.Size(),
+				ModTime:      info.ModTime().UTC(),
+			},
+			ContentType: http.DetectContentType(head[:n]),
+			ETag:        etag,
+		})
+	}
+}
+
+// fileETag is the ETag of a finished upload. Size and modification time change
+// with every write, so they stand in for hashing the whole file.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
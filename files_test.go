@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListFilesAfterCursor(t *testing.T) {
+	for _, sortBy := range []string{"name", "size", "mtime"} {
+		for _, order := range []string{"asc", "desc"} {
+			t.Run(sortBy+" "+order, func(t *testing.T) {
+				dir := t.TempDir()
+				modTime := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+				write := func(name string, size int) {
+					t.Helper()
+					path := filepath.Join(dir, name)
+					if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+						t.Fatal(err)
+					}
+					// Sizes and times grow with the names, the sizes in tied pairs
+					modTime = modTime.Add(time.Duration(size) * time.Minute)
+					if err := os.Chtimes(path, modTime, modTime); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for i, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "f.txt"} {
+					write(name, i/2*2+1)
+				}
+				root, err := os.OpenRoot(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer root.Close()
+				list := newFileList(root.FS(), false)
+
+				seen := map[string]int{}
+				after := ""
+				for pages := 0; ; pages++ {
+					if pages > 10 {
+						t.Fatal("listing doesn't end")
+					}
+					query := url.Values{"sort": {sortBy}, "order": {order}, "limit": {"2"}}
+					if after != "" {
+						query.Set("after", after)
+					}
+					w := httptest.NewRecorder()
+					list.handleList(w, httptest.NewRequest(http.MethodGet, "/api/files?"+query.Encode(), nil))
+					if w.Code != http.StatusOK {
+						t.Fatalf("page after %q: status %d: %s", after, w.Code, w.Body)
+					}
+					var page fileListPage
+					if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+						t.Fatal(err)
+					}
+					for _, item := range page.Items {
+						seen[item.Name]++
+					}
+					if page.Next == "" {
+						break
+					}
+					after = page.Next
+
+					// Files listed already go away and new ones appear, which
+					// would shift the offsets
+					if pages == 0 {
+						for _, item := range page.Items {
+							os.Remove(filepath.Join(dir, item.Name))
+						}
+						write("0.txt", 1)
+					}
+				}
+				for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "f.txt"} {
+					if _, err := os.Stat(filepath.Join(dir, name)); err == nil && seen[name] != 1 {
+						t.Errorf("%s listed %d times, want once", name, seen[name])
+					}
+				}
+				for name, n := range seen {
+					if n != 1 {
+						t.Errorf("%s listed %d times", name, n)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestListFilesCursorErrors(t *testing.T) {
+	list := newFileList(os.DirFS(t.TempDir()), false)
+	for _, query := range []string{"after=a.txt&offset=2", "sort=size&after=a.txt", "sort=mtime&after=x:a.txt"} {
+		w := httptest.NewRecorder()
+		list.handleList(w, httptest.NewRequest(http.MethodGet, "/api/files?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Headers of the response completing an upload, naming where it is published
+const (
+	finalFilenameHeader = "X-Final-Filename"
+	downloadURLHeader   = "X-Download-URL"
+)
+
+// reservedName is the name decided for a completed upload before it is
+// published
+type reservedName struct {
+	// dir is the storage directory, name is relative to it and slash separated
+	dir  string
+	name string
+	// at is when the upload finished, which the layout subdirectory and the
+	// --filename-template fields are taken from
+	at time.Time
+}
+
+// finalNames decides the name of a completed upload while tusd answers the
+// request that completed it, so the response can tell the client, and holds it
+// until finalizeUpload publishes the upload under that name. Reserved names
+// count as taken for uploads completing in the meantime.
+type finalNames struct {
+	mu       sync.Mutex
+	reserved map[string]reservedName
+}
+
+func newFinalNames() *finalNames {
+	return &finalNames{reserved: make(map[string]reservedName)}
+}
+
+// reserve is the PreFinishResponseCallback naming the file in the
+// X-Final-Filename and X-Download-URL headers, both percent-encoded. Uploads
+// finalizeUpload won't publish under a name get neither.
+func (n *finalNames) reserve(hook tusd.HookEvent) (tusd.HTTPResponse, error) {
+	upload := hook.Upload
+	if upload.IsPartial || rejectEmpty && upload.Size == 0 || upload.MetaData["filename"] == "" {
+		return tusd.HTTPResponse{}, nil
+	}
+
+	now := time.Now()
+	sanitized := sanitizeFilename(uploadFilename(upload, now))
+	storageDir := routeDir(uploadRoutes, sanitized)
+	subdir := uploadSubdir(now)
+	targetDir := filepath.Join(storageDir, filepath.FromSlash(subdir))
+
+	// Under the directory's lock, as publishing decides on the name
+	defer lockPublishDir(targetDir)()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	name := sanitized
+	switch conflictAction(upload.MetaData[conflictMetadataKey]) {
+	case onConflictReplace:
+	case onConflictFail:
+		if n.isTaken(storageDir, path.Join(subdir, sanitized)) && conflictPolicy == conflictReject {
+			// Stays under its ID
+			return tusd.HTTPResponse{}, nil
+		}
+		fallthrough
+	default:
+		for i := 0; n.isTaken(storageDir, path.Join(subdir, name)); i++ {
+			name = numberedName(sanitized, i+1)
+		}
+	}
+	name = path.Join(subdir, name)
+	n.reserved[upload.ID] = reservedName{dir: storageDir, name: name, at: now}
+
+	escaped := escapePath(name)
+	return tusd.HTTPResponse{Header: tusd.HTTPHeader{
+		finalFilenameHeader: escaped,
+		downloadURLHeader:   basePath + "api/download/" + escaped,
+	}}, nil
+}
+
+// isTaken reports whether name exists in dir or is reserved there for another
+// upload. The caller holds n.mu.
+func (n *finalNames) isTaken(dir, name string) bool {
+	if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name))); !errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	for _, reserved := range n.reserved {
+		if reserved.dir == dir && reserved.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// take returns and releases the name reserved for the upload
+func (n *finalNames) take(id string) (reservedName, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reserved, ok := n.reserved[id]
+	delete(n.reserved, id)
+	return reserved, ok
+}
+
+// publishReserved publishes a finished upload under the name reserved for it,
+// falling back to publishConditional if something outside the uploads took the
+// name meanwhile, e.g. a rename through /api/files
+func publishReserved(oldPath, dir, name, filename, onConflict string) (string, error) {
+	if conflictAction(onConflict) != onConflictReplace {
+		err := func() error {
+			defer lockPublishDir(dir)()
+			return renameNoReplace(oldPath, filepath.Join(dir, name))
+		}()
+		if !errors.Is(err, fs.ErrExist) {
+			return name, err
+		}
+		slog.Warn("Reserved file name was taken, publishing under another name than announced",
+			"filename", name)
+	}
+	return publishConditional(oldPath, dir, filename, onConflict)
+}
+
+// escapePath percent-encodes each element of a slash separated path
+func escapePath(p string) string {
+	elements := strings.Split(p, "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return strings.Join(elements, "/")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Probes hit these often, so the bodies are written as is instead of encoded
+var (
+	healthyBody  = []byte(`{"status":"ok"}` + "\n")
+	notReadyBody = []byte(`{"status":"unavailable","error":"uploads directory is not writable"}` + "\n")
+)
+
+// handleHealthz answers liveness probes: the server is up once it serves them
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(healthyBody)
+}
+
+// handleReadyz answers readiness probes, failing with 503 while no file can be
+// created in dir. In S3 mode dir is empty and only liveness is checked.
+func handleReadyz(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dir != "" {
+			if err := probeWritable(dir); err != nil {
+				slog.Debug("Readiness check failed", "path", dir, "error", err)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Cache-Control", "no-store")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write(notReadyBody)
+				return
+			}
+		}
+		handleHealthz(w, r)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// preCreateHook inspects (and optionally amends) an upload before tusd creates it.
+// Returning an error rejects the upload with the error's HTTP response.
+type preCreateHook func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error)
+
+// chainPreCreateHooks runs hooks in order as a single PreUploadCreateCallback.
+// Each hook sees the changes made by the ones before it and the first error wins.
+func chainPreCreateHooks(hooks []preCreateHook) func(tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	return func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+		var resp tusd.HTTPResponse
+		var changes tusd.FileInfoChanges
+
+		for _, h := range hooks {
+			r, c, err := h(hook)
+			if err != nil {
+				return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, err
+			}
+			resp = resp.MergeWith(r)
+
+			if c.ID != "" {
+				changes.ID = c.ID
+				hook.Upload.ID = c.ID
+			}
+			if c.MetaData != nil {
+				changes.MetaData = c.MetaData
+				hook.Upload.MetaData = c.MetaData
+			}
+			if c.Storage != nil {
+				changes.Storage = c.Storage
+				hook.Upload.Storage = c.Storage
+			}
+		}
+
+		return resp, changes, nil
+	}
+}
+
+var errEmptyUpload = tusd.NewError("ERR_EMPTY_UPLOAD", "empty uploads are not allowed", http.StatusBadRequest)
+
+// rejectEmptyUploads refuses uploads that declare a length of zero up front.
+// Uploads with a deferred length are checked again on completion.
+func rejectEmptyUploads(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	if !hook.Upload.SizeIsDeferred && hook.Upload.Size == 0 {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errEmptyUpload
+	}
+	return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+}
+
+// parseDefaultMetadata turns --default-metadata key=value pairs into a map
+func parseDefaultMetadata(pairs []string) (tusd.MetaData, error) {
+	metadata := make(tusd.MetaData, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// addDefaultMetadata returns a hook which stamps every upload with the given
+// metadata. Keys sent by the client take precedence over the defaults.
+func addDefaultMetadata(defaults tusd.MetaData) preCreateHook {
+	return func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+		metadata := make(tusd.MetaData, len(defaults)+len(hook.Upload.MetaData))
+		maps.Copy(metadata, defaults)
+		maps.Copy(metadata, hook.Upload.MetaData)
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{MetaData: metadata}, nil
+	}
+}
+
+var errInvalidMetadata = tusd.NewError("ERR_INVALID_METADATA", "Upload-Metadata values must be base64 encoded UTF-8", http.StatusBadRequest)
+
+// checkMetadataEncoding returns a hook guarding against malformed
+// Upload-Metadata. tusd silently drops values that aren't valid base64 and
+// accepts any decoded bytes; with reject such uploads are refused, with replace
+// invalid UTF-8 sequences become U+FFFD and dropped values stay dropped.
+func checkMetadataEncoding(reject bool) preCreateHook {
+	return func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+		if reject {
+			for _, element := range strings.Split(hook.HTTPRequest.Header.Get("Upload-Metadata"), ",") {
+				parts := strings.Split(strings.TrimSpace(element), " ")
+				if len(parts) > 2 {
+					slog.Debug("Rejecting upload with malformed metadata element")
+					return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errInvalidMetadata
+				}
+				if len(parts) == 2 {
+					if _, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+						slog.Debug("Rejecting upload with metadata that is not valid base64", "key", parts[0])
+						return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errInvalidMetadata
+					}
+				}
+			}
+		}
+
+		var metadata tusd.MetaData
+		for key, value := range hook.Upload.MetaData {
+			if utf8.ValidString(value) {
+				continue
+			}
+			if reject {
+				slog.Debug("Rejecting upload with metadata that is not valid UTF-8", "key", key)
+				return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errInvalidMetadata
+			}
+			if metadata == nil {
+				metadata = maps.Clone(hook.Upload.MetaData)
+			}
+			metadata[key] = strings.ToValidUTF8(value, "\uFFFD")
+			slog.Debug("Replaced invalid UTF-8 in upload metadata", "key", key)
+		}
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{MetaData: metadata}, nil
+	}
+}
+
+var errTypeNotAllowed = tusd.NewError("ERR_TYPE_NOT_ALLOWED", "this type of file is not accepted", http.StatusBadRequest)
+
+// parseAllowedTypes normalizes --allowed-types: entries containing a slash are
+// MIME types ("image/*" matching any subtype), the others extensions, with or
+// without the leading dot
+func parseAllowedTypes(types []string) []string {
+	var allowed []string
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "":
+			continue
+		case !strings.Contains(t, "/") && !strings.HasPrefix(t, "."):
+			t = "." + t
+		}
+		allowed = append(allowed, t)
+	}
+	return allowed
+}
+
+// allowTypes returns a hook accepting only uploads whose filename extension or
+// filetype metadata is in the allowlist. Both are declared by the client, so
+// this keeps honest users from uploading the wrong thing rather than checking
+// the content. Partial uploads carry no name and are checked on concatenation.
+// The list is read on every upload, so reloading --config can replace it, an
+// empty list accepts everything.
+func allowTypes(allowedTypes *atomic.Pointer[[]string]) preCreateHook {
+	return func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+		allowed := *allowedTypes.Load()
+		if hook.Upload.IsPartial || len(allowed) == 0 {
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(hook.Upload.MetaData["filename"]))
+		mediaType, _, _ := mime.ParseMediaType(hook.Upload.MetaData["filetype"])
+		for _, t := range allowed {
+			switch {
+			case strings.HasPrefix(t, "."):
+				if ext == t {
+					return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+				}
+			case strings.HasSuffix(t, "/*"):
+				if strings.HasPrefix(mediaType, t[:len(t)-1]) {
+					return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+				}
+			case mediaType == t:
+				return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+			}
+		}
+		slog.Debug("Rejecting upload of a type that is not allowed", "extension", ext, "filetype", mediaType)
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errTypeNotAllowed
+	}
+}
+
+// requireFreeSpace refuses uploads that would leave less than minFree bytes
+// available on the uploads dir's filesystem, counting their declared length.
+// Where free space can't be determined the check is skipped.
+func requireFreeSpace(dir string, minFree int64) preCreateHook {
+	var low atomic.Bool
+	var unsupported sync.Once
+	return func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+		available, err := availableSpace(dir)
+		if errors.Is(err, errors.ErrUnsupported) {
+			unsupported.Do(func() {
+				slog.Warn("Free disk space can't be determined on this platform, --min-free-space is not enforced")
+			})
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+		}
+		if err != nil {
+			slog.Warn("Failed to check free disk space", "path", dir, "error", err)
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+		}
+
+		// Logged once when the space falls below the threshold, not for every
+		// upload that is too large for what is left
+		switch {
+		case available < minFree && !low.Swap(true):
+			slog.Warn("Free disk space is low, rejecting new uploads",
+				"path", dir,
+				"available", available,
+				"min_free_space", minFree)
+		case available >= minFree && low.Swap(false):
+			slog.Info("Free disk space recovered, accepting uploads again",
+				"path", dir,
+				"available", available)
+		}
+		if available-hook.Upload.Size < minFree {
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errInsufficientStorage
+		}
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+	}
+}
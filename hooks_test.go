@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestRejectEmptyUploads(t *testing.T) {
+	tests := []struct {
+		name     string
+		upload   tusd.FileInfo
+		rejected bool
+	}{
+		{"empty", tusd.FileInfo{Size: 0}, true},
+		{"one byte", tusd.FileInfo{Size: 1}, false},
+		{"deferred length", tusd.FileInfo{SizeIsDeferred: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := rejectEmptyUploads(tusd.HookEvent{Upload: tt.upload})
+			if rejected := errors.Is(err, errEmptyUpload); rejected != tt.rejected || (err != nil && !rejected) {
+				t.Errorf("rejectEmptyUploads(%+v) = %v, want rejected %v", tt.upload, err, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestParseDefaultMetadata(t *testing.T) {
+	metadata, err := parseDefaultMetadata([]string{"team=ops", "note=a=b", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (tusd.MetaData{"team": "ops", "note": "a=b", "empty": ""}); !maps.Equal(metadata, want) {
+		t.Errorf("parseDefaultMetadata = %v, want %v", metadata, want)
+	}
+	for _, pair := range []string{"team", "=ops"} {
+		if _, err := parseDefaultMetadata([]string{pair}); err == nil {
+			t.Errorf("parseDefaultMetadata(%q) succeeded, want an error", pair)
+		}
+	}
+}
+
+func TestDefaultMetadataPrecedence(t *testing.T) {
+	defaults := tusd.MetaData{"team": "ops", "retention": "30d"}
+	var seen tusd.MetaData
+	hook := chainPreCreateHooks([]preCreateHook{
+		addDefaultMetadata(defaults),
+		func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+			seen = hook.Upload.MetaData
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+		},
+	})
+
+	_, changes, err := hook(tusd.HookEvent{Upload: tusd.FileInfo{
+		MetaData: tusd.MetaData{"filename": "a.txt", "team": "dev"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client's keys win over the defaults, and later hooks see the merge
+	want := tusd.MetaData{"filename": "a.txt", "team": "dev", "retention": "30d"}
+	if !maps.Equal(changes.MetaData, want) || !maps.Equal(seen, want) {
+		t.Errorf("metadata is %v, seen by the next hook as %v, want %v", changes.MetaData, seen, want)
+	}
+	if defaults["team"] != "ops" || len(defaults) != 2 {
+		t.Errorf("defaults changed to %v", defaults)
+	}
+}
+
+func TestCheckMetadataEncoding(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name   string
+		header string
+		// wantReplaced is the metadata with replace, when it is changed
+		wantReplaced tusd.MetaData
+		wantRejected bool
+	}{
+		{"valid", "filename " + b64("café.txt") + ",flag", nil, false},
+		{"invalid UTF-8", "filename " + b64("caf\xe9.txt"), tusd.MetaData{"filename": "caf\uFFFD.txt"}, true},
+		{"invalid base64", "filename " + b64("a.txt") + ",note not-base64!", nil, true},
+		{"too many parts", "filename " + b64("a.txt") + " extra", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/files/", nil)
+			r.Header.Set("Upload-Metadata", tt.header)
+			hook := tusd.HookEvent{
+				HTTPRequest: tusd.HTTPRequest{Header: r.Header},
+				Upload:      tusd.FileInfo{MetaData: tusd.ParseMetadataHeader(tt.header)},
+			}
+
+			_, changes, err := checkMetadataEncoding(false)(hook)
+			if err != nil {
+				t.Fatalf("replace: %v", err)
+			}
+			if !maps.Equal(changes.MetaData, tt.wantReplaced) {
+				t.Errorf("replace changed the metadata to %q, want %q", changes.MetaData, tt.wantReplaced)
+			}
+
+			_, _, err = checkMetadataEncoding(true)(hook)
+			if rejected := errors.Is(err, errInvalidMetadata); rejected != tt.wantRejected || (err != nil && !rejected) {
+				t.Errorf("reject: %v, want rejected %v", err, tt.wantRejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// basicAuthCacheTTL is how long verified credentials are remembered, so
+	// not every request of a page or every chunk of an upload runs bcrypt
+	basicAuthCacheTTL = 5 * time.Minute
+
+	// maxBasicAuthCache bounds the remembered credentials, which an attacker
+	// can't grow as only correct ones are remembered
+	maxBasicAuthCache = 1024
+)
+
+// basicAuthRealm is sent in WWW-Authenticate, browsers show it in their prompt
+const basicAuthRealm = `Basic realm="simple-upload", charset="UTF-8"`
+
+// htpasswdAuth checks HTTP Basic credentials against an htpasswd file of
+// bcrypt hashes, as written by htpasswd -B. The file is reloaded on SIGHUP.
+type htpasswdAuth struct {
+	path string
+	// tokens pass without credentials on their routes, see passesWithoutLogin
+	tokens []tokenRoutes
+	// dummyHash is compared against for unknown users, so they take as long
+	// as known ones
+	dummyHash []byte
+
+	mu    sync.RWMutex
+	users map[string][]byte
+	// verified remembers the hashes of credentials that matched, until when
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newHtpasswdAuth(path string, tokens []tokenRoutes) (*htpasswdAuth, error) {
+	dummy, err := bcrypt.GenerateFromPassword([]byte("simple-upload"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	a := &htpasswdAuth{path: path, tokens: tokens, dummyHash: dummy}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *htpasswdAuth) reload() error {
+	users, err := parseHtpasswd(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.users = users
+	a.verified = make(map[[sha256.Size]byte]time.Time)
+	a.mu.Unlock()
+	return nil
+}
+
+// parseHtpasswd reads user:hash lines, skipping empty lines and # comments.
+// Hashes other than bcrypt are refused rather than letting their users never
+// log in.
+func parseHtpasswd(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %q has no bcrypt hash, create it with htpasswd -B: %w", path, line, user, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no users", path)
+	}
+	return users, nil
+}
+
+// watchSignals reloads the file on every SIGHUP. A file that fails to load is
+// logged and the previous users stay in effect.
+func (a *htpasswdAuth) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := a.reload(); err != nil {
+				slog.Error("Failed to reload htpasswd file, keeping the current users",
+					"path", a.path,
+					"error", err)
+				continue
+			}
+			slog.Info("Reloaded htpasswd file", "path", a.path)
+		}
+	}()
+}
+
+// verify reports whether the password is the user's
+func (a *htpasswdAuth) verify(user, password string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	now := time.Now()
+	a.mu.RLock()
+	until, cached := a.verified[key]
+	hash, known := a.users[user]
+	a.mu.RUnlock()
+	if cached && now.Before(until) {
+		return true
+	}
+
+	if !known {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			slog.Warn("Failed to check htpasswd hash", "user", user, "error", err)
+		}
+		return false
+	}
+
+	a.mu.Lock()
+	if len(a.verified) >= maxBasicAuthCache {
+		clear(a.verified)
+	}
+	a.verified[key] = now.Add(basicAuthCacheTTL)
+	a.mu.Unlock()
+	return true
+}
+
+// middleware answers 401 to requests without valid Basic credentials, unless
+// they pass without a login
+func (a *htpasswdAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if passesWithoutLogin(r, a.tokens) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if ok && a.verify(user, password) {
+			next.ServeHTTP(w, withLoginUser(r, user))
+			return
+		}
+		if ok {
+			slog.Warn("Rejected Basic credentials",
+				"user", user,
+				"remote_addr", r.RemoteAddr)
+		}
+		w.Header().Set("WWW-Authenticate", basicAuthRealm)
+		writeJSONError(w, http.StatusUnauthorized, "login required")
+	})
+}
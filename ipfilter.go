@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// ipFilter restricts the upload and API endpoints to client networks. Denied
+// ranges win over allowed ones; without allowed ranges every client that isn't
+// denied is let in. The UI and the health checks stay reachable for everyone.
+type ipFilter struct {
+	rules   atomic.Pointer[ipRules]
+	proxies []netip.Prefix
+}
+
+// ipRules are the ranges of --allow-cidr and --deny-cidr, replaced as a whole
+// when --config is reloaded
+type ipRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newIPFilter(allow, deny, proxies []netip.Prefix) *ipFilter {
+	f := &ipFilter{proxies: proxies}
+	f.setRules(allow, deny)
+	return f
+}
+
+func (f *ipFilter) setRules(allow, deny []netip.Prefix) {
+	f.rules.Store(&ipRules{allow: allow, deny: deny})
+}
+
+func (rules *ipRules) allowed(addr netip.Addr) bool {
+	if prefixesContain(rules.deny, addr) {
+		return false
+	}
+	return len(rules.allow) == 0 || prefixesContain(rules.allow, addr)
+}
+
+// isFilteredPath reports whether a request goes to the tus endpoints or the API
+func isFilteredPath(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/files") || strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+func (f *ipFilter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isFilteredPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rules := f.rules.Load()
+		addr, ok := clientAddr(r, f.proxies)
+		// A client without address can't be in the allowed ranges
+		if ok && rules.allowed(addr) || !ok && len(rules.allow) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		slog.Debug("Request from a network that isn't allowed", "client", addr, "path", r.URL.Path)
+		const message = "access from this network is not allowed"
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeJSONError(w, http.StatusForbidden, message)
+			return
+		}
+		http.Error(w, message, http.StatusForbidden)
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/filelocker"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// uploadJanitor removes uploads that were started but not finished within the
+// expiry. Only uploads with an .info file are considered, and only while their
+// data is incomplete, so published files are never touched.
+type uploadJanitor struct {
+	dir    string
+	store  *fileStore
+	locker filelocker.FileLocker
+	expiry time.Duration
+}
+
+func newUploadJanitor(dir string, store *fileStore, expiry, interval time.Duration) *uploadJanitor {
+	j := &uploadJanitor{
+		dir:    dir,
+		store:  store,
+		locker: filelocker.New(dir),
+		expiry: expiry,
+	}
+	go func() {
+		j.sweep(time.Now())
+		for now := range time.Tick(interval) {
+			j.sweep(now)
+		}
+	}()
+	return j
+}
+
+func (j *uploadJanitor) sweep(now time.Time) {
+	infos, err := filepath.Glob(filepath.Join(j.dir, "*.info"))
+	if err != nil {
+		slog.Warn("Failed to scan for abandoned uploads", "error", err)
+		return
+	}
+	removed := 0
+	for _, infoPath := range infos {
+		id := strings.TrimSuffix(filepath.Base(infoPath), ".info")
+		if j.abandoned(id, now) && j.remove(id) {
+			removed++
+		}
+	}
+	slog.Info("Removed abandoned uploads", "count", removed, "expiry", j.expiry)
+}
+
+// abandoned reports whether the upload is incomplete and neither its info nor
+// its data changed within the expiry
+func (j *uploadJanitor) abandoned(id string, now time.Time) bool {
+	expires, ok := j.expiresAt(context.Background(), id)
+	return ok && !now.Before(expires)
+}
+
+// expiresAt returns when the upload becomes abandoned unless it receives data:
+// the expiry after its info or data last changed. Finished uploads never expire.
+func (j *uploadJanitor) expiresAt(ctx context.Context, id string) (time.Time, bool) {
+	upload, err := j.store.GetUpload(ctx, id)
+	if err != nil {
+		// Finished and published, or removed since the scan
+		return time.Time{}, false
+	}
+	info, err := upload.GetInfo(ctx)
+	// A sparse upload can have its full size before every range arrived
+	sparse := info.Storage[sparseRangesKey] != ""
+	if err != nil || (!sparse && !info.SizeIsDeferred && info.Offset >= info.Size) {
+		return time.Time{}, false
+	}
+	dataPath := filepath.Join(j.dir, id)
+	if info.Storage["Path"] != "" {
+		dataPath = info.Storage["Path"]
+	}
+	var lastChange time.Time
+	for _, path := range []string{dataPath, filepath.Join(j.dir, id+".info")} {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if stat.ModTime().After(lastChange) {
+			lastChange = stat.ModTime()
+		}
+	}
+	return lastChange.Add(j.expiry), true
+}
+
+// expirationMiddleware implements the tus expiration extension: responses
+// creating, resuming or checking an unfinished upload carry Upload-Expires, the
+// time after which the janitor removes it if no more data arrives. The removal
+// runs every --upload-expiry-interval, so it can happen up to that much later.
+func (j *uploadJanitor) expirationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &expiresWriter{ResponseWriter: w}
+		switch r.Method {
+		case http.MethodPost:
+			// Unless created with all of its data
+			ew.size = r.Header.Get("Upload-Length")
+			ew.expires = time.Now().Add(j.expiry)
+		case http.MethodPatch:
+			if upload, err := j.store.GetUpload(r.Context(), r.URL.Path); err == nil {
+				if info, err := upload.GetInfo(r.Context()); err == nil && !info.SizeIsDeferred {
+					ew.size = strconv.FormatInt(info.Size, 10)
+				}
+			}
+			ew.expires = time.Now().Add(j.expiry)
+		case http.MethodHead:
+			ew.expires, _ = j.expiresAt(r.Context(), r.URL.Path)
+		}
+		next.ServeHTTP(ew, r)
+	})
+}
+
+// expiresWriter adds Upload-Expires to successful responses, leaving it out
+// when the response's Upload-Offset shows the upload is complete, and lists
+// the extension in Tus-Extension
+type expiresWriter struct {
+	http.ResponseWriter
+	expires     time.Time
+	size        string
+	wroteHeader bool
+}
+
+func (w *expiresWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if extensions := h.Get("Tus-Extension"); extensions != "" {
+			h.Set("Tus-Extension", extensions+",expiration")
+		}
+		complete := w.size != "" && h.Get("Upload-Offset") == w.size
+		if code/100 == 2 && !w.expires.IsZero() && !complete {
+			h.Set("Upload-Expires", w.expires.UTC().Format(http.TimeFormat))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *expiresWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which tusd
+// relies on to extend read deadlines during uploads
+func (w *expiresWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// remove terminates the upload while holding its lock, leaving it alone if a
+// request holds the lock right now
+func (j *uploadJanitor) remove(id string) bool {
+	lock, err := j.locker.NewLock(id)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lock.Lock(ctx, func() {}); err != nil {
+		if !errors.Is(err, tusd.ErrLockTimeout) {
+			slog.Warn("Failed to lock abandoned upload", "upload_id", id, "error", err)
+		}
+		return false
+	}
+	defer lock.Unlock()
+
+	if err := terminateUpload(j.store, id); err != nil {
+		slog.Warn("Failed to remove abandoned upload", "upload_id", id, "error", err)
+		return false
+	}
+	slog.Debug("Removed abandoned upload", "upload_id", id)
+	return true
+}
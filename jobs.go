@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type jobState string
+
+const (
+	jobRunning   jobState = "running"
+	jobSucceeded jobState = "succeeded"
+	jobFailed    jobState = "failed"
+	jobCanceled  jobState = "canceled"
+)
+
+// jobRetention is how long finished jobs stay queryable before being dropped
+const jobRetention = time.Hour
+
+// job is a long running operation executed in the background. Its status is
+// exposed under /api/jobs/{id} and it can be canceled through its context.
+type job struct {
+	id     string
+	kind   string
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	state    jobState
+	progress float64
+	message  string
+	err      string
+	created  time.Time
+	finished time.Time
+}
+
+// jobStatus is the JSON representation of a job
+type jobStatus struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	State      jobState   `json:"state"`
+	Progress   float64    `json:"progress"`
+	Message    string     `json:"message,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// setProgress records how far along the job is, as a fraction between 0 and 1
+func (j *job) setProgress(progress float64, message string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress = progress
+	j.message = message
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := jobStatus{
+		ID:        j.id,
+		Kind:      j.kind,
+		State:     j.state,
+		Progress:  j.progress,
+		Message:   j.message,
+		Error:     j.err,
+		CreatedAt: j.created,
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		s.FinishedAt = &finished
+	}
+	return s
+}
+
+func (j *job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	switch {
+	case err == nil:
+		j.state = jobSucceeded
+		j.progress = 1
+	case errors.Is(err, context.Canceled):
+		j.state = jobCanceled
+	default:
+		j.state = jobFailed
+		j.err = err.Error()
+	}
+}
+
+func (j *job) finishedBefore(t time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finished.IsZero() && j.finished.Before(t)
+}
+
+// jobRegistry keeps track of running and recently finished jobs in memory
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobRegistry() *jobRegistry {
+	r := &jobRegistry{jobs: make(map[string]*job)}
+	go func() {
+		for range time.Tick(jobRetention / 4) {
+			r.cleanup(time.Now().Add(-jobRetention))
+		}
+	}()
+	return r
+}
+
+// start runs fn in the background and returns the job tracking it. fn should
+// return promptly once ctx is canceled.
+func (r *jobRegistry) start(kind string, fn func(ctx context.Context, j *job) error) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:      newRandomID(),
+		kind:    kind,
+		cancel:  cancel,
+		state:   jobRunning,
+		created: time.Now(),
+	}
+
+	r.mu.Lock()
+	r.jobs[j.id] = j
+	r.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := fn(ctx, j)
+		j.finish(err)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			slog.Warn("Job failed", "job_id", j.id, "kind", kind, "error", err)
+		}
+	}()
+
+	return j
+}
+
+func (r *jobRegistry) get(id string) (*job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, ok := r.jobs[id]
+	return j, ok
+}
+
+// cleanup forgets jobs that finished before the cutoff
+func (r *jobRegistry) cleanup(cutoff time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, j := range r.jobs {
+		if j.finishedBefore(cutoff) {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// handleGet reports the status of a job. Requires the admin token.
+func (r *jobRegistry) handleGet(adminToken *liveToken) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !requireAdmin(w, req, adminToken) {
+			return
+		}
+		j, ok := r.get(req.PathValue("id"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, j.status())
+	}
+}
+
+// handleCancel cancels a running job, canceling a finished job is a no-op.
+// Requires the admin token.
+func (r *jobRegistry) handleCancel(adminToken *liveToken) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !requireAdmin(w, req, adminToken) {
+			return
+		}
+		j, ok := r.get(req.PathValue("id"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		j.cancel()
+		writeJSON(w, http.StatusAccepted, j.status())
+	}
+}
+
+// newRandomID returns a random 128 bit identifier encoded as hex
+func newRandomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJobsRequireAdmin(t *testing.T) {
+	jobs := newJobRegistry()
+	j := jobs.start("test", func(ctx context.Context, j *job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer j.cancel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/jobs/{id}", jobs.handleGet(newLiveToken("admin-secret")))
+	mux.HandleFunc("DELETE /api/jobs/{id}", jobs.handleCancel(newLiveToken("admin-secret")))
+	request := func(method, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/jobs/"+j.id, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for _, token := range []string{"", "upload-secret"} {
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			if rec := request(method, token); rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s with %q: status %d, want 401", method, token, rec.Code)
+			}
+		}
+	}
+	if got := j.status().State; got != jobRunning {
+		t.Fatalf("job is %s after unauthorized cancels, want it running", got)
+	}
+
+	if rec := request(http.MethodGet, "admin-secret"); rec.Code != http.StatusOK {
+		t.Errorf("GET with the admin token: status %d, want 200", rec.Code)
+	}
+	rec := request(http.MethodDelete, "admin-secret")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("DELETE with the admin token: status %d, want 202", rec.Code)
+	}
+	var status jobStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != j.id {
+		t.Errorf("canceled job %q, want %q", status.ID, j.id)
+	}
+}
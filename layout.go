@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layouts of --layout: flat publishes every upload at the top of the uploads
+// dir, date below YYYY/MM/DD of the day it finished
+const (
+	layoutFlat = "flat"
+	layoutDate = "date"
+)
+
+func validateLayout(layout string) error {
+	if layout != layoutFlat && layout != layoutDate {
+		return fmt.Errorf("unknown layout %q, expected flat or date", layout)
+	}
+	return nil
+}
+
+// uploadSubdir returns the slash separated directory below the uploads dir that
+// uploads finished at now are published in, "" for the flat layout
+func uploadSubdir(now time.Time) string {
+	if uploadLayout == layoutDate {
+		return now.Format("2006/01/02")
+	}
+	return ""
+}
+
+// publishDir creates dir's subdirectory for uploads finished at now and returns
+// it, relative and joined to dir
+func publishDir(dir string, now time.Time) (subdir, path string, err error) {
+	subdir = uploadSubdir(now)
+	if subdir == "" {
+		return "", dir, nil
+	}
+	path = filepath.Join(dir, filepath.FromSlash(subdir))
+	return subdir, path, os.MkdirAll(path, 0755)
+}
+
+// isUploadPath reports whether name is a slash separated path of names that
+// sanitizeFilename leaves unchanged, as finished uploads are published under
+func isUploadPath(name string) bool {
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element != sanitizeFilename(element) {
+			return false
+		}
+	}
+	return true
+}
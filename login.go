@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// uploaderMetadataKey records in an upload's metadata who logged in to create
+// it, with --htpasswd the user and with OIDC the subject
+const uploaderMetadataKey = "uploaded_by"
+
+// loginExempt are the paths open without logging in: the probes of
+// orchestrators, which can't be given credentials
+var loginExempt = []string{"/healthz", "/readyz"}
+
+// loginUserKey is the request context key of the user who logged in
+type loginUserKey struct{}
+
+// withLoginUser returns the request as authenticated as user
+func withLoginUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loginUserKey{}, user))
+}
+
+// loginUser returns the user the request was authenticated as, if any
+func loginUser(r *http.Request) (string, bool) {
+	return contextLoginUser(r.Context())
+}
+
+func contextLoginUser(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(loginUserKey{}).(string)
+	return user, ok
+}
+
+// Routes checking --auth-token with requireUploadToken and --admin-token
+// with requireAdmin, as patterns of http.ServeMux
+var (
+	uploadTokenRoutes = []string{
+		"/files/",
+		"/files",
+		"PUT /api/files/{name...}",
+		"POST /api/sparse-uploads",
+		"PUT /api/sparse-uploads/{id}",
+	}
+	adminTokenRoutes = []string{
+		"GET /api/logs",
+		"GET /api/events",
+		"GET /api/webhooks/failed",
+		"GET /api/jobs/{id}",
+		"DELETE /api/jobs/{id}",
+		"PATCH /api/files/{name...}",
+	}
+)
+
+// tokenRoutes are the routes on which a bearer token is accepted instead of a
+// login. A token is only good for the routes checking it, an upload token
+// doesn't open the downloads.
+type tokenRoutes struct {
+	token *liveToken
+	mux   *http.ServeMux
+}
+
+func newTokenRoutes(token *liveToken, patterns []string) tokenRoutes {
+	mux := http.NewServeMux()
+	for _, pattern := range patterns {
+		mux.Handle(pattern, http.NotFoundHandler())
+	}
+	return tokenRoutes{token: token, mux: mux}
+}
+
+// newLoginTokens returns the routes of the upload and admin tokens, empty
+// tokens are never accepted
+func newLoginTokens(authToken, adminToken *liveToken) []tokenRoutes {
+	return []tokenRoutes{
+		newTokenRoutes(authToken, uploadTokenRoutes),
+		newTokenRoutes(adminToken, adminTokenRoutes),
+	}
+}
+
+// accepts reports whether the request carries the token for one of the routes
+func (t tokenRoutes) accepts(r *http.Request) bool {
+	token := t.token.get()
+	if token == "" || !hasBearerToken(r, token) {
+		return false
+	}
+	_, pattern := t.mux.Handler(r)
+	return pattern != ""
+}
+
+// passesWithoutLogin reports whether a request needs no login: CORS
+// preflights, which can't carry credentials, the loginExempt paths and
+// requests with a token of the route, which its endpoint checks. A request
+// carries a single Authorization header, so it can't send both.
+func passesWithoutLogin(r *http.Request, tokens []tokenRoutes) bool {
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		return true
+	}
+	for _, path := range loginExempt {
+		if r.URL.Path == path {
+			return true
+		}
+	}
+	for _, token := range tokens {
+		if token.accepts(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordUploader is a pre-create hook storing the logged in user as
+// uploaderMetadataKey. A value sent by the client is dropped, it can't
+// claim to be someone else.
+func recordUploader(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	metadata := maps.Clone(hook.Upload.MetaData)
+	if metadata == nil {
+		metadata = make(tusd.MetaData)
+	}
+	delete(metadata, uploaderMetadataKey)
+	if hook.Context != nil {
+		if user, ok := contextLoginUser(hook.Context); ok {
+			metadata[uploaderMetadataKey] = user
+		}
+	}
+	return tusd.HTTPResponse{}, tusd.FileInfoChanges{MetaData: metadata}, nil
+}
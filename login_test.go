@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPassesWithoutLogin(t *testing.T) {
+	tokens := newLoginTokens(newLiveToken("upload-secret"), newLiveToken("admin-secret"))
+	tests := []struct {
+		method, path, token string
+		want                bool
+	}{
+		{http.MethodPost, "/files/", "upload-secret", true},
+		{http.MethodPatch, "/files/abc", "upload-secret", true},
+		{http.MethodPut, "/api/files/a/report.pdf", "upload-secret", true},
+		{http.MethodPost, "/api/sparse-uploads", "upload-secret", true},
+		{http.MethodGet, "/api/files", "upload-secret", false},
+		{http.MethodGet, "/api/download/report.pdf", "upload-secret", false},
+		{http.MethodGet, "/api/download-folder", "upload-secret", false},
+		{http.MethodPost, "/api/download-zip", "upload-secret", false},
+		{http.MethodGet, "/", "upload-secret", false},
+		{http.MethodGet, "/api/logs", "upload-secret", false},
+		{http.MethodGet, "/api/logs", "admin-secret", true},
+		{http.MethodPatch, "/api/files/report.pdf", "admin-secret", true},
+		{http.MethodGet, "/api/jobs/abc", "admin-secret", true},
+		{http.MethodDelete, "/api/jobs/abc", "admin-secret", true},
+		{http.MethodDelete, "/api/jobs/abc", "upload-secret", false},
+		{http.MethodPost, "/files/", "admin-secret", false},
+		{http.MethodGet, "/api/download/report.pdf", "admin-secret", false},
+		{http.MethodPost, "/files/", "wrong", false},
+		{http.MethodPost, "/files/", "", false},
+		{http.MethodGet, "/healthz", "", true},
+		{http.MethodGet, "/readyz", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if got := passesWithoutLogin(r, tokens); got != tt.want {
+			t.Errorf("%s %s with %q = %v, want %v", tt.method, tt.path, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestPassesWithoutLoginEmptyTokens(t *testing.T) {
+	tokens := newLoginTokens(newLiveToken(""), newLiveToken(""))
+	r := httptest.NewRequest(http.MethodPost, "/files/", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if passesWithoutLogin(r, tokens) {
+		t.Error("empty token passed")
+	}
+}
+
+func TestPassesWithoutLoginPreflight(t *testing.T) {
+	r := httptest.NewRequest(http.MethodOptions, "/api/files", nil)
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	if !passesWithoutLogin(r, nil) {
+		t.Error("CORS preflight needs a login")
+	}
+}
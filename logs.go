@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	xslog "golang.org/x/exp/slog"
+)
+
+// logRingSize is how many recent log events /api/logs replays to new clients
+const logRingSize = 1000
+
+// redactedKeys are attribute keys, or substrings of them, whose values never
+// leave the server through /api/logs
+var redactedKeys = []string{"token", "password", "secret", "authorization", "cookie", "key"}
+
+// logEvent is a log record as streamed by /api/logs
+type logEvent struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"msg"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// logRing keeps the most recent log events and fans new ones out to the
+// connected /api/logs clients
+type logRing struct {
+	mu          sync.Mutex
+	events      []logEvent
+	next        int
+	subscribers map[chan logEvent]struct{}
+}
+
+func newLogRing() *logRing {
+	return &logRing{
+		events:      make([]logEvent, 0, logRingSize),
+		subscribers: make(map[chan logEvent]struct{}),
+	}
+}
+
+func (r *logRing) push(event logEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) < logRingSize {
+		r.events = append(r.events, event)
+	} else {
+		r.events[r.next] = event
+		r.next = (r.next + 1) % logRingSize
+	}
+	for ch := range r.subscribers {
+		// A client that can't keep up misses events rather than blocking logging
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// subscribe returns the buffered events in order along with a channel receiving
+// every later one
+func (r *logRing) subscribe() ([]logEvent, chan logEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recent := slices.Concat(r.events[r.next:], r.events[:r.next])
+	ch := make(chan logEvent, 64)
+	r.subscribers[ch] = struct{}{}
+	return recent, ch
+}
+
+func (r *logRing) unsubscribe(ch chan logEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subscribers, ch)
+}
+
+// ringHandler is a slog.Handler which passes records on to next and also pushes
+// them, redacted, into the ring
+type ringHandler struct {
+	next   slog.Handler
+	ring   *logRing
+	attrs  []slog.Attr
+	prefix string
+}
+
+func newRingHandler(next slog.Handler, ring *logRing) *ringHandler {
+	return &ringHandler{next: next, ring: ring}
+}
+
+func (h *ringHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *ringHandler) Handle(ctx context.Context, record slog.Record) error {
+	event := logEvent{
+		Time:    record.Time,
+		Level:   record.Level.String(),
+		Message: record.Message,
+		Attrs:   make(map[string]any),
+	}
+	for _, attr := range h.attrs {
+		addLogAttr(event.Attrs, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		addLogAttr(event.Attrs, h.prefix, attr)
+		return true
+	})
+	h.ring.push(event)
+
+	return h.next.Handle(ctx, record)
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithAttrs(attrs)
+	clone.attrs = slices.Clone(h.attrs)
+	for _, attr := range attrs {
+		attr.Key = h.prefix + attr.Key
+		clone.attrs = append(clone.attrs, attr)
+	}
+	return &clone
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.next = h.next.WithGroup(name)
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+// addLogAttr flattens groups into dotted keys and redacts sensitive values
+func addLogAttr(attrs map[string]any, prefix string, attr slog.Attr) {
+	value := attr.Value.Resolve()
+	key := prefix + attr.Key
+	if value.Kind() == slog.KindGroup {
+		for _, a := range value.Group() {
+			addLogAttr(attrs, key+".", a)
+		}
+		return
+	}
+	if isRedactedKey(attr.Key) {
+		attrs[key] = "[REDACTED]"
+		return
+	}
+	if err, ok := value.Any().(error); ok {
+		attrs[key] = err.Error()
+		return
+	}
+	attrs[key] = value.Any()
+}
+
+func isRedactedKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, redacted := range redactedKeys {
+		if strings.Contains(key, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleLogs serves GET /api/logs as a Server-Sent Events stream: the buffered
+// events first, then new ones as they are logged. Requires the admin token.
+func (r *logRing) handleLogs(adminToken *liveToken) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !requireAdmin(w, req, adminToken) {
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		recent, ch := r.subscribe()
+		defer r.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(event logEvent) error {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+			return nil
+		}
+		for _, event := range recent {
+			if send(event) != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case event := <-ch:
+				if send(event) != nil || rc.Flush() != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// expSlogHandler lets tusd, which logs through golang.org/x/exp/slog, write to
+// the log/slog handler used by the rest of the server
+type expSlogHandler struct {
+	next slog.Handler
+}
+
+func (h expSlogHandler) Enabled(ctx context.Context, level xslog.Level) bool {
+	return h.next.Enabled(ctx, slog.Level(level))
+}
+
+func (h expSlogHandler) Handle(ctx context.Context, r xslog.Record) error {
+	record := slog.NewRecord(r.Time, slog.Level(r.Level), r.Message, r.PC)
+	r.Attrs(func(attr xslog.Attr) bool {
+		record.AddAttrs(convertExpAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, record)
+}
+
+func (h expSlogHandler) WithAttrs(attrs []xslog.Attr) xslog.Handler {
+	converted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		converted[i] = convertExpAttr(attr)
+	}
+	return expSlogHandler{h.next.WithAttrs(converted)}
+}
+
+func (h expSlogHandler) WithGroup(name string) xslog.Handler {
+	return expSlogHandler{h.next.WithGroup(name)}
+}
+
+func convertExpAttr(attr xslog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	if value.Kind() != xslog.KindGroup {
+		return slog.Any(attr.Key, value.Any())
+	}
+	group := value.Group()
+	converted := make([]slog.Attr, len(group))
+	for i, a := range group {
+		converted[i] = convertExpAttr(a)
+	}
+	return slog.Attr{Key: attr.Key, Value: slog.GroupValue(converted...)}
+}
@@ -1,20 +1,37 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/quic-go/quic-go/http3"
 	"github.com/spf13/cobra"
 	"github.com/tus/tusd/v2/pkg/filelocker"
-	"github.com/tus/tusd/v2/pkg/filestore"
 	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	xslog "golang.org/x/exp/slog"
+	"golang.org/x/text/unicode/norm"
 )
 
 //go:embed ui/dist/*
@@ -22,10 +39,140 @@ var webUIFiles embed.FS
 var webUIFS, _ = fs.Sub(webUIFiles, "ui/dist")
 
 var (
-	port       int
-	uploadsDir string
-	certFile   string
-	keyFile    string
+	port        int
+	uploadsDir  string
+	baseURL     string
+	basePath    string
+	certFile    string
+	keyFile     string
+	preallocate bool
+	maxSizeFlag string
+	maxSize     int64
+	verifySize  bool
+	rejectEmpty bool
+
+	allowedTypes []string
+
+	minFreeSpaceFlag string
+
+	writeBufferSize int
+	chunkAlignBytes int64
+	idPrefix        string
+	useXattr        bool
+	normalizeEOL    string
+
+	filenameTemplate string
+
+	convertRules        []string
+	convertTimeout      time.Duration
+	convertKeepOriginal bool
+
+	tlsMinVersion string
+	tlsCiphers    []string
+	ocspStaple    bool
+
+	uploadInactivityTimeout time.Duration
+	writableCheckInterval   time.Duration
+	uploadExpiry            time.Duration
+	uploadExpiryInterval    time.Duration
+
+	inflightDuplicates string
+	maxUploadsPerHour  int
+	defaultMetadata    []string
+	invalidMetadata    string
+	allowOverwrite     bool
+	conflictPolicy     string
+
+	rateLimit      float64
+	rateBurst      int
+	trustedProxies []string
+	allowCIDRs     []string
+	denyCIDRs      []string
+
+	sparseUploadsEnabled bool
+
+	resumeSessionsEnabled bool
+	resumeSessionTTL      time.Duration
+
+	logFormat string
+	logLevel  string
+
+	accessLogFormat  string
+	accessLogFile    string
+	accessLogExclude []string
+	requestLogging   bool
+	redactFilenames  bool
+
+	uiDir        string
+	faviconFile  string
+	manifestFile string
+
+	hostname    string
+	corsOrigins []string
+
+	adminToken string
+	authToken  string
+
+	receiptKeyFile string
+
+	s3Opts s3Options
+
+	webhookURL     string
+	webhookSecret  string
+	webhookRetries []time.Duration
+
+	otelEndpoint string
+
+	statsdAddr   string
+	statsdPrefix string
+
+	metricsEnabled bool
+
+	shutdownTimeout time.Duration
+
+	configFile string
+
+	postHookCommand     string
+	postHookTimeout     time.Duration
+	postHookRequired    bool
+	postHookConcurrency int
+
+	acmeDomains  []string
+	acmeCacheDir string
+
+	uploadLayout string
+
+	unixSocket string
+	socketMode string
+
+	thumbnailSize int
+
+	http3Enabled bool
+	quicOpts     quicOptions
+
+	maxTotalSizeFlag string
+
+	checkConfig bool
+
+	verifyContentType string
+
+	maxConcurrentUploads int
+
+	compressResponses bool
+
+	routeByExt   string
+	uploadRoutes []uploadRoute
+
+	stripEXIF bool
+
+	htpasswdPath string
+
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+
+	quotaWarnAt []int
 )
 
 var rootCmd = &cobra.Command{
@@ -37,29 +184,139 @@ for resumable file uploads. It includes a web UI for easy file management.`,
 }
 
 func init() {
+	rootCmd.Flags().StringVar(&configFile, "config", "", "Read options from this YAML or TOML file, keys named like the flags (e.g. uploads_dir: /srv/uploads), flags and environment variables take precedence")
+	rootCmd.Flags().BoolVar(&checkConfig, "check", false, "Validate the options, uploads dir and TLS certificate, print the effective configuration and exit without serving, non-zero on the first error")
 	rootCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port to listen on")
+	rootCmd.Flags().StringVar(&unixSocket, "unix-socket", "", "Listen on a Unix domain socket at this path instead of --port, e.g. for a reverse proxy on the same host; disables HTTP/3")
+	rootCmd.Flags().StringVar(&socketMode, "socket-mode", "0660", "Permissions of the --unix-socket file, in octal")
 	rootCmd.Flags().StringVarP(&uploadsDir, "uploads-dir", "d", "./uploads", "Directory to store uploaded files")
+	rootCmd.Flags().StringVar(&uploadLayout, "layout", layoutFlat, "Where finished uploads are stored in the uploads dir: flat, or date for YYYY/MM/DD subdirectories of the day they finished")
+	rootCmd.Flags().StringVar(&routeByExt, "route-by-ext", "", "Publish finished uploads with these extensions to other directories than the uploads dir, e.g. \"mp4,mov=/mnt/media;pdf,docx=/mnt/docs\"")
+	rootCmd.Flags().StringVar(&baseURL, "base-url", "/", "Path prefix to serve the UI and all endpoints under, e.g. /upload/ behind a reverse proxy")
+	rootCmd.Flags().BoolVar(&compressResponses, "compress", false, "Compress the web UI and the JSON API with zstd or gzip for clients accepting it; uploads and downloads are never compressed")
+	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "On SIGTERM or SIGINT, wait this long for running requests before closing their connections")
 	rootCmd.Flags().StringVarP(&certFile, "cert", "c", "", "Path to TLS certificate file (enables HTTPS and HTTP/3)")
 	rootCmd.Flags().StringVarP(&keyFile, "key", "k", "", "Path to TLS private key file (enables HTTPS and HTTP/3)")
+	rootCmd.Flags().StringSliceVar(&acmeDomains, "acme-domain", nil, "Get and renew a Let's Encrypt certificate for these comma separated domains (enables HTTPS and HTTP/3, instead of --cert and --key); needs to be reachable on port 443")
+	rootCmd.Flags().StringVar(&acmeCacheDir, "acme-cache-dir", "./acme-cache", "Directory keeping the Let's Encrypt account and certificates across restarts")
+	rootCmd.Flags().BoolVar(&http3Enabled, "http3", true, "Serve HTTP/3 over QUIC (UDP) next to HTTPS and advertise it with Alt-Svc; --http3=false serves plain HTTPS only")
+	rootCmd.Flags().DurationVar(&quicOpts.idleTimeout, "quic-idle-timeout", 30*time.Second, "Close HTTP/3 connections that saw no network activity for this long")
+	rootCmd.Flags().Int64Var(&quicOpts.maxStreams, "quic-max-streams", 100, "Maximum number of concurrent requests a client may run on one HTTP/3 connection")
+	rootCmd.Flags().DurationVar(&quicOpts.altSvcMaxAge, "alt-svc-max-age", 5*time.Minute, "How long clients may remember that HTTP/3 is available, sent as the Alt-Svc max age")
+	rootCmd.Flags().StringVar(&tlsMinVersion, "tls-min-version", "1.2", "Minimum TLS version to accept for HTTPS: 1.2 or 1.3")
+	rootCmd.Flags().StringSliceVar(&tlsCiphers, "tls-ciphers", nil, "Comma separated TLS 1.2 cipher suites to allow (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), Go's defaults when empty")
+	rootCmd.Flags().BoolVar(&ocspStaple, "ocsp-staple", false, "Staple an OCSP response from the certificate's responder to TLS handshakes, refreshed hourly")
+	rootCmd.Flags().StringVar(&hostname, "hostname", "", "Only serve requests for this host name, answering others with 421 Misdirected Request")
+	rootCmd.Flags().StringSliceVar(&corsOrigins, "cors-origins", nil, "Comma separated origins (e.g. https://cdn.example.com) allowed to upload from browsers on other origins, or * for any")
+	rootCmd.Flags().StringVar(&otelEndpoint, "otel-endpoint", "", "Export OpenTelemetry traces via OTLP/HTTP to this URL (e.g. http://localhost:4318), disabled when empty")
+	rootCmd.Flags().StringVar(&statsdAddr, "statsd-addr", "", "Send upload metrics to this StatsD/DogStatsD host:port over UDP, disabled when empty")
+	rootCmd.Flags().StringVar(&statsdPrefix, "statsd-prefix", "simple_upload", "Prefix of the StatsD metric names")
+	rootCmd.Flags().BoolVar(&metricsEnabled, "metrics", false, "Serve Prometheus metrics at /metrics")
+	rootCmd.Flags().StringVar(&htpasswdPath, "htpasswd", "", "Require HTTP Basic credentials from this htpasswd file of bcrypt hashes for the UI, the API and uploads, reloaded on SIGHUP")
+	rootCmd.Flags().StringVar(&oidcIssuer, "oidc-issuer", "", "Require logging in through this OpenID Connect provider, e.g. https://accounts.example.com")
+	rootCmd.Flags().StringVar(&oidcClientID, "oidc-client-id", "", "Client ID registered with the --oidc-issuer")
+	rootCmd.Flags().StringVar(&oidcClientSecret, "oidc-client-secret", "", "Client secret registered with the --oidc-issuer, empty for a public client (falls back to $SIMPLE_UPLOAD_OIDC_CLIENT_SECRET)")
+	rootCmd.Flags().StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "Callback URL registered with the --oidc-issuer, ending in auth/callback; derived from the request's host when empty")
+	rootCmd.Flags().StringVar(&authToken, "auth-token", "", "Require this bearer token for uploads (falls back to $SIMPLE_UPLOAD_AUTH_TOKEN), uploads are open when empty")
+	rootCmd.Flags().StringVar(&adminToken, "admin-token", "", "Bearer token for the admin endpoints (/api/logs, /api/jobs, PATCH /api/files), which are disabled when empty")
+	rootCmd.Flags().StringVar(&webhookURL, "webhook-url", "", "POST a JSON description of every finished upload to this URL, disabled when empty")
+	rootCmd.Flags().StringVar(&webhookSecret, "webhook-secret", "", "Sign webhook bodies with this HMAC-SHA256 key in X-Simple-Upload-Signature (falls back to $SIMPLE_UPLOAD_WEBHOOK_SECRET)")
+	rootCmd.Flags().DurationSliceVar(&webhookRetries, "webhook-retries", defaultWebhookRetries, "Comma separated delays between the attempts of a webhook, e.g. 10s,1m,1h; webhooks failing all of them are kept for /api/webhooks/failed")
+	rootCmd.Flags().StringVar(&s3Opts.bucket, "s3-bucket", "", "Store uploads in this S3 bucket instead of --uploads-dir")
+	rootCmd.Flags().StringVar(&s3Opts.prefix, "s3-prefix", "", "Key prefix of the uploads in the S3 bucket, e.g. uploads/")
+	rootCmd.Flags().StringVar(&s3Opts.endpoint, "s3-endpoint", "", "URL of an S3 compatible service (e.g. http://localhost:9000 for MinIO), AWS when empty")
+	rootCmd.Flags().StringVar(&s3Opts.region, "s3-region", "", "S3 region, from the AWS configuration when empty")
+	rootCmd.Flags().StringVar(&s3Opts.accessKey, "s3-access-key", "", "S3 access key ID, the AWS SDK's default credentials when empty")
+	rootCmd.Flags().StringVar(&s3Opts.secretKey, "s3-secret-key", "", "S3 secret access key (falls back to $SIMPLE_UPLOAD_S3_SECRET_KEY)")
+	rootCmd.Flags().StringVar(&receiptKeyFile, "receipt-key-file", "", "Sign a receipt for every finished upload with the HMAC key in this file, served at /api/files/{name}/receipt")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", "text", "Format of the application log on stderr: text or json")
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Only log messages of this level or above: debug, info, warn or error")
+	rootCmd.Flags().StringVar(&accessLogFormat, "access-log-format", "", "Write an access log in this format ("+accessLogFormatNames()+"), disabled when empty")
+	rootCmd.Flags().StringVar(&accessLogFile, "access-log-file", "-", "File to append the access log to, \"-\" for stdout")
+	rootCmd.Flags().StringSliceVar(&accessLogExclude, "access-log-exclude", nil, "Comma separated paths, or path prefixes ending in /, left out of the access log and logged at debug level by --access-log, e.g. /healthz,/readyz")
+	rootCmd.Flags().BoolVar(&requestLogging, "access-log", false, "Log method, path, client, status, response size and duration of every request to the application log")
+	rootCmd.Flags().BoolVar(&redactFilenames, "redact-filenames", false, "Log a short hash instead of upload filenames, in the application and access logs; /api/logs keeps them")
+	rootCmd.Flags().StringVar(&uiDir, "ui-dir", "", "Serve the web UI from this directory, which needs an index.html, instead of the embedded one")
+	rootCmd.Flags().StringVar(&faviconFile, "favicon", "", "Serve this file as /favicon.ico instead of the embedded one")
+	rootCmd.Flags().StringVar(&manifestFile, "manifest", "", "Serve this file as /manifest.json instead of the embedded one")
+	rootCmd.Flags().StringVar(&maxSizeFlag, "max-size", "", "Reject uploads larger than this, e.g. 500MB or 2GB (binary units), unlimited when empty")
+	rootCmd.Flags().StringVar(&minFreeSpaceFlag, "min-free-space", "", "Reject new uploads with 507 when they would leave less than this free on the uploads dir's filesystem, e.g. 5GB, disabled when empty")
+	rootCmd.Flags().StringVar(&maxTotalSizeFlag, "max-total-size", "", "Reject new uploads with 507 when the files in the uploads dir and the declared lengths of unfinished uploads would exceed this, e.g. 100GB, disabled when empty")
+	rootCmd.Flags().IntSliceVar(&quotaWarnAt, "quota-warn-at", nil, "Comma separated percentages of --max-total-size, e.g. 80,90, at which to warn once, in the log and through --webhook-url, when the stored bytes cross them")
+	rootCmd.Flags().IntVar(&maxConcurrentUploads, "max-concurrent-uploads", 0, "Reject new uploads with 503 while this many are in progress; an upload sending no data for 10 minutes stops counting, unlimited when 0")
+	rootCmd.Flags().BoolVar(&verifySize, "verify-size", false, "Quarantine completed uploads whose stored size differs from the declared Upload-Length")
+	rootCmd.Flags().StringVar(&verifyContentType, "verify-content-type", "", "Quarantine completed uploads whose content contradicts their extension or filetype metadata: lenient for executables and media posing as other media, strict for any difference; disabled when empty")
+	rootCmd.Flags().BoolVar(&rejectEmpty, "reject-empty", false, "Reject zero-byte uploads instead of storing them")
+	rootCmd.Flags().BoolVar(&sparseUploadsEnabled, "sparse-uploads", false, "Enable the non-standard /api/sparse-uploads endpoints accepting ranges at arbitrary offsets")
+	rootCmd.Flags().BoolVar(&resumeSessionsEnabled, "resume-sessions", false, "Track anonymous browser uploads with a session cookie and expose them at /api/my-uploads")
+	rootCmd.Flags().DurationVar(&resumeSessionTTL, "resume-session-ttl", 24*time.Hour, "Lifetime of resume session cookies")
+	rootCmd.Flags().StringVar(&inflightDuplicates, "inflight-duplicates", "allow", "What to do when an upload declares the same expected_sha256 as one still in progress: allow or reject")
+	rootCmd.Flags().StringVar(&conflictPolicy, "on-conflict", conflictRename, "What to do when a finished upload's name is taken: rename it with a _1 suffix, overwrite the existing file, or reject it (refused with 409 at creation, kept under its ID if the name is taken later)")
+	rootCmd.Flags().BoolVar(&allowOverwrite, "allow-overwrite", false, "Let uploads created with If-Match: * replace the existing file of the same name")
+	rootCmd.Flags().IntVar(&maxUploadsPerHour, "max-uploads-per-hour", 0, "Reject new uploads with 429 once this many were created in the past hour, across all clients, disabled when 0")
+	rootCmd.Flags().Float64Var(&rateLimit, "rate-limit", 0, "Let each client IP create this many uploads per second on average, answering 429 beyond, disabled when 0")
+	rootCmd.Flags().IntVar(&rateBurst, "rate-burst", 10, "Let a client IP create this many uploads at once before --rate-limit applies")
+	rootCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxies", nil, "Comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For names the client for --rate-limit, --allow-cidr and --deny-cidr")
+	rootCmd.Flags().StringSliceVar(&allowCIDRs, "allow-cidr", nil, "Comma separated CIDR ranges of the only clients allowed to use the upload endpoints and the API, answering others with 403")
+	rootCmd.Flags().StringSliceVar(&denyCIDRs, "deny-cidr", nil, "Comma separated CIDR ranges of clients answered with 403 on the upload endpoints and the API, even when in --allow-cidr")
+	rootCmd.Flags().DurationVar(&uploadInactivityTimeout, "upload-inactivity-timeout", 0, "Stop and remove an upload whose PATCH request sends no data for this long, disabled when 0")
+	rootCmd.Flags().DurationVar(&uploadExpiry, "upload-expiry", 0, "Remove unfinished uploads that received no data for this long, e.g. 24h, disabled when 0")
+	rootCmd.Flags().DurationVar(&uploadExpiryInterval, "upload-expiry-interval", time.Hour, "How often to look for unfinished uploads older than --upload-expiry")
+	rootCmd.Flags().Int64Var(&chunkAlignBytes, "chunk-alignment", 0, "Reject upload chunks that don't start and end on a multiple of this many bytes, except the last one, disabled when 0")
+	rootCmd.Flags().DurationVar(&writableCheckInterval, "writable-check-interval", 0, "Check this often that the uploads dir is writable and answer new uploads with 503 while it isn't, disabled when 0")
+	rootCmd.Flags().IntVar(&writeBufferSize, "write-buffer-size", 0, "Copy upload data through pooled buffers of this many bytes instead of allocating one per request, disabled when 0")
+	rootCmd.Flags().BoolVar(&useXattr, "use-xattr", false, "Store the original filename, upload time and SHA-256 of finished uploads as extended attributes (Linux)")
+	rootCmd.Flags().BoolVar(&stripEXIF, "strip-exif", false, "Remove EXIF, XMP and IPTC metadata such as GPS position and camera from finished JPEG, PNG and TIFF uploads, keeping the image data as uploaded")
+	rootCmd.Flags().StringVar(&normalizeEOL, "normalize-eol", "", "Rewrite the line endings of finished text uploads to lf or crlf, binary files are left untouched")
+	rootCmd.Flags().StringVar(&invalidMetadata, "invalid-metadata", "replace", "What to do with Upload-Metadata that isn't base64 encoded UTF-8: replace invalid sequences or reject the upload")
+	rootCmd.Flags().StringVar(&filenameTemplate, "filename-template", "", "Compose final filenames from metadata, e.g. \"{uploader}-{date}-{filename}\", falling back to the plain filename when a field is missing")
+	rootCmd.Flags().StringArrayVar(&defaultMetadata, "default-metadata", nil, "Add key=value to the metadata of every upload unless the client sets the key (repeatable)")
+	rootCmd.Flags().StringArrayVar(&convertRules, "convert", nil, "Convert finished uploads with a command, as from:to=command {in} {out} (repeatable), e.g. \"wav:flac=ffmpeg -y -i {in} {out}\"")
+	rootCmd.Flags().DurationVar(&convertTimeout, "convert-timeout", 10*time.Minute, "Abort a conversion that runs longer than this, keeping the original")
+	rootCmd.Flags().BoolVar(&convertKeepOriginal, "convert-keep-original", false, "Keep the original upload next to the converted file")
+	rootCmd.Flags().IntVar(&thumbnailSize, "thumbnail-size", 0, "Make JPEG thumbnails of finished JPEG, PNG and GIF uploads fitting this many pixels square, served at /api/thumbnail/{name}, disabled when 0")
+	rootCmd.Flags().StringVar(&postHookCommand, "post-hook", "", "Run this executable with the path of every published upload as its argument, and SU_UPLOAD_ID, SU_FILENAME, SU_ORIGINAL_FILENAME and SU_SIZE in its environment")
+	rootCmd.Flags().DurationVar(&postHookTimeout, "post-hook-timeout", 5*time.Minute, "Kill a --post-hook command that runs longer than this")
+	rootCmd.Flags().BoolVar(&postHookRequired, "post-hook-required", false, "Quarantine uploads whose --post-hook command fails, as {name}.corrupt")
+	rootCmd.Flags().IntVar(&postHookConcurrency, "post-hook-concurrency", 1, "Run at most this many --post-hook commands at once, the others wait")
+	rootCmd.Flags().StringVar(&idPrefix, "id-prefix", "", "Prepend this to generated upload IDs, to keep instances sharing an uploads dir apart (letters, digits, - and _)")
+	rootCmd.Flags().StringSliceVar(&allowedTypes, "allowed-types", nil, "Only accept uploads with these comma separated extensions or MIME types (e.g. .png,.jpg,application/pdf,image/*), everything when empty")
+	rootCmd.Flags().BoolVar(&preallocate, "preallocate", false, "Reserve disk space for the declared upload length when an upload is created")
 }
 
 // altSvcMiddleware adds Alt-Svc header to advertise HTTP/3 availability
-func altSvcMiddleware(next http.Handler, port int) http.Handler {
+func altSvcMiddleware(next http.Handler, altSvc string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.ProtoMajor < 3 {
 			// Add Alt-Svc header to advertise HTTP/3 on the same port
-			w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=300`, port))
+			w.Header().Set("Alt-Svc", altSvc)
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-// sanitizeFilename removes or replaces unsafe characters in filenames
+// windowsDeviceNames can't be used as file names on Windows, with or without
+// an extension
+var windowsDeviceNames = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[1-9¹²³]|LPT[1-9¹²³])(\..*)?$`)
+
+// sanitizeFilename removes or replaces unsafe characters in filenames. Control
+// and bidirectional formatting characters are dropped, since they can corrupt
+// logs and terminals or disguise an extension, and the name is normalized to
+// NFC so the same name typed on different systems maps to the same file.
 func sanitizeFilename(filename string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(filename))
+	// Names of only dots would otherwise turn into underscores below
+	if strings.Trim(sanitized, " .") == "" {
+		return "unkown-file"
+	}
+
 	// Replace path separators and other potentially dangerous characters
 	unsafe := []string{"/", "\\", "..", ":", "*", "?", "\"", "<", ">", "|"}
-	sanitized := filename
-
 	for _, char := range unsafe {
 		sanitized = strings.ReplaceAll(sanitized, char, "_")
 	}
@@ -67,167 +324,1310 @@ func sanitizeFilename(filename string) string {
 	// Remove leading/trailing spaces and dots
 	sanitized = strings.Trim(sanitized, " .")
 
-	// If filename becomes empty after sanitization, return a default
-	if sanitized == "" {
+	// If filename becomes empty after sanitization or names a device, return a default
+	if sanitized == "" || windowsDeviceNames.MatchString(sanitized) {
 		return "unkown-file"
 	}
 
 	return sanitized
 }
 
-// getUniqueFilename ensures the filename is unique in the target directory
-func getUniqueFilename(dir, filename string) string {
+// renameNoReplace moves oldPath to newPath, failing with fs.ErrExist instead of
+// replacing a file that already exists there. A hard link or, where links
+// aren't supported, an exclusive rename claims the new name atomically, so the
+// file appears under it complete. Only as a last resort the name is reserved
+// with O_EXCL and the rename then replaces that reservation, which briefly
+// leaves an empty file under the new name.
+func renameNoReplace(oldPath, newPath string) error {
+	err := os.Link(oldPath, newPath)
+	if err == nil {
+		return os.Remove(oldPath)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	if err := renameExclusive(oldPath, newPath); !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+
+	reservation, err := os.OpenFile(newPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	reservation.Close()
+	if err := os.Rename(oldPath, newPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	return nil
+}
+
+// publishUnique moves the file at oldPath into dir under the sanitized filename,
+// adding a counter when the name is taken. Names are claimed with renameNoReplace
+// so an existing file is never overwritten, even if it appears concurrently.
+// A directory or symlink of the same name counts as taken as well, since both
+// os.Link and O_EXCL report it as existing. The server's own directories, such as
+// the .convert-* scratch dirs, start with a dot, which sanitizeFilename strips,
+// so uploads can't claim them.
+func publishUnique(oldPath, dir, filename string) (string, error) {
+	defer lockPublishDir(dir)()
+	return claimUniqueName(oldPath, dir, filename)
+}
+
+// claimUniqueName is publishUnique for callers holding the directory's lock
+func claimUniqueName(oldPath, dir, filename string) (string, error) {
 	sanitized := sanitizeFilename(filename)
-	targetPath := filepath.Join(dir, sanitized)
+	for i := 0; ; i++ {
+		candidate := numberedName(sanitized, i)
+		err := renameNoReplace(oldPath, filepath.Join(dir, candidate))
+		if !errors.Is(err, fs.ErrExist) {
+			return candidate, err
+		}
+	}
+}
 
-	// If file doesn't exist, use the sanitized filename
-	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-		return sanitized
+// numberedName returns the i-th name tried for a taken name, the name itself
+// for 0 and then name_1.ext, name_2.ext, ...
+func numberedName(name string, i int) string {
+	if i == 0 {
+		return name
 	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+}
 
-	// File exists, add a counter
-	ext := filepath.Ext(sanitized)
-	base := strings.TrimSuffix(sanitized, ext)
+// quarantineFile moves a file that failed validation out of the way by giving it
+// a .corrupt suffix, so it is kept for inspection but never served as a final upload
+func quarantineFile(path string) {
+	quarantinePath := path + ".corrupt"
+	if err := renameNoReplace(path, quarantinePath); err != nil {
+		slog.Error("Failed to quarantine file",
+			"path", path,
+			"error", err)
+		return
+	}
+	slog.Warn("File quarantined", "path", quarantinePath)
+}
 
-	for i := 1; ; i++ {
-		newFilename := fmt.Sprintf("%s_%d%s", base, i, ext)
-		newPath := filepath.Join(dir, newFilename)
+// verifyChecksum compares the SHA-256 of the upload's file at path with the
+// declared one and quarantines the file on a mismatch. It returns the result
+// for the log and whether the upload may still be published; a file that
+// can't be read is published unchecked.
+func verifyChecksum(ctx context.Context, path, expectedSHA256, uploadID, originalFilename string) (string, bool) {
+	sum, err := fileSHA256(path)
+	switch {
+	case err != nil:
+		slog.Warn("Failed to checksum upload for verification",
+			"upload_id", uploadID,
+			"path", path,
+			"error", err)
+		return "failed", true
+	case sum != expectedSHA256:
+		slog.Error("Stored SHA-256 does not match declared expected_sha256",
+			"upload_id", uploadID,
+			"filename", originalFilename,
+			"path", path,
+			"expected_sha256", expectedSHA256,
+			"stored_sha256", sum)
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, "checksum mismatch")
+		quarantineFile(path)
+		return "mismatch", false
+	}
+	return "ok", true
+}
+
+// terminatableStore is a store whose uploads can be terminated, the local
+// fileStore or the S3 store
+type terminatableStore interface {
+	tusd.DataStore
+	tusd.TerminaterDataStore
+}
+
+// terminateUpload removes an upload's data and info file through the store.
+// An upload that is already gone is not an error.
+func terminateUpload(store terminatableStore, id string) error {
+	ctx := context.Background()
+	upload, err := store.GetUpload(ctx, id)
+	if err == nil {
+		err = store.AsTerminatableUpload(upload).Terminate(ctx)
+	}
+	if errors.Is(err, tusd.ErrNotFound) {
+		return nil
+	}
+	return err
+}
 
-		if _, err := os.Stat(newPath); os.IsNotExist(err) {
-			return newFilename
+// removePartialUploads deletes the parts of a concatenated upload once their data
+// has been copied into the final upload
+func removePartialUploads(store terminatableStore, finalID string, partialIDs []string) {
+	for _, id := range partialIDs {
+		if err := terminateUpload(store, id); err != nil {
+			slog.Warn("Failed to remove partial upload",
+				"upload_id", finalID,
+				"partial_upload_id", id,
+				"error", err)
 		}
 	}
 }
 
-func handleCompletedUploads(handler *tusd.Handler) {
-	go func() {
-		for {
-			event := <-handler.CompleteUploads
+// finalizeOutcome is what finalizing did with a completed upload
+type finalizeOutcome int
+
+const (
+	// uploadPublished is served under its final name
+	uploadPublished finalizeOutcome = iota
+	// uploadKept stays under its upload ID: a partial upload, or one without
+	// a filename or whose name is taken
+	uploadKept
+	// uploadQuarantined failed the size, content type or checksum check
+	uploadQuarantined
+	// uploadRemoved was deleted, being empty with --reject-empty
+	uploadRemoved
+)
+
+// finalizeUpload publishes a completed upload under its sanitized original
+// filename and reports what became of it. The error is only set if publishing
+// failed; uploads deliberately kept under their ID, removed or quarantined
+// aren't failures.
+func finalizeUpload(ctx context.Context, store *fileStore, names *finalNames, receipts *receiptSigner, webhook *webhookNotifier, converter *uploadConverter, hook *postHook, thumbs *thumbnailer, event tusd.HookEvent) (finalizeOutcome, error) {
+	// Partial uploads are only chunks of a later concatenated upload, which
+	// still needs them under their upload ID
+	if event.Upload.IsPartial {
+		slog.Debug("Partial upload finished", "upload_id", event.Upload.ID)
+		return uploadKept, nil
+	}
+
+	// Uploads with a deferred length can only be recognized as empty now
+	if rejectEmpty && event.Upload.Size == 0 {
+		slog.Warn("Removing empty upload",
+			"upload_id", event.Upload.ID,
+			"filename", event.Upload.MetaData["filename"])
+		if err := terminateUpload(store, event.Upload.ID); err != nil {
+			slog.Error("Failed to remove empty upload",
+				"upload_id", event.Upload.ID,
+				"error", err)
+		}
+		return uploadRemoved, nil
+	}
+
+	// For concatenated uploads the metadata lives on the final upload
+	originalFilename := event.Upload.MetaData["filename"]
+	uploadID := event.Upload.ID
+
+	slog.Info("Upload finished",
+		"upload_id", uploadID,
+		"filename", originalFilename)
+
+	if originalFilename == "" {
+		slog.Warn("No filename in metadata, keeping file with upload ID",
+			"upload_id", uploadID)
+		return uploadKept, nil
+	}
+
+	// Released whether or not the upload gets published
+	var reserved reservedName
+	isReserved := false
+	if names != nil {
+		reserved, isReserved = names.take(uploadID)
+	}
+
+	oldPath := filepath.Join(uploadsDir, uploadID)
+
+	// Check if the file with the upload ID exists
+	stat, err := os.Stat(oldPath)
+	if err != nil {
+		slog.Warn("Upload file not found for renaming",
+			"upload_id", uploadID,
+			"filename", originalFilename,
+			"path", oldPath)
+		return uploadKept, err
+	}
+
+	// A size mismatch means the stored data was truncated or the store misbehaved,
+	// so the file must not be published under its real name
+	if verifySize && stat.Size() != event.Upload.Size {
+		slog.Error("Stored size does not match declared Upload-Length",
+			"upload_id", uploadID,
+			"filename", originalFilename,
+			"declared_size", event.Upload.Size,
+			"stored_size", stat.Size())
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, "size mismatch")
+		quarantineFile(oldPath)
+		return uploadQuarantined, nil
+	}
 
-			originalFilename := event.Upload.MetaData["filename"]
-			uploadID := event.Upload.ID
+	// Before publishing, so a disguised file is never served under its name
+	if verifyContentType != "" {
+		claimed, detected, err := contentMismatch(oldPath, originalFilename, event.Upload.MetaData["filetype"], verifyContentType)
+		if err != nil {
+			slog.Warn("Failed to read upload for content type verification",
+				"upload_id", uploadID,
+				"error", err)
+		} else if claimed != "" {
+			slog.Warn("Upload content does not match its declared type",
+				"upload_id", uploadID,
+				"filename", originalFilename,
+				"declared_type", claimed,
+				"detected_type", detected)
+			trace.SpanFromContext(ctx).SetStatus(codes.Error, "content type mismatch")
+			quarantineFile(oldPath)
+			return uploadQuarantined, nil
+		}
+	}
 
-			slog.Info("Upload finished",
+	// Post-processing of the content happens before publishing, so the file never
+	// appears under its final name half processed. Extended attributes move along
+	// with the rename.
+	expectedSHA256 := declaredChecksum(event.Upload.MetaData)
+	checksum := "skipped"
+	// The declared checksum is of the data as uploaded, so with a rewrite
+	// configured it is checked first
+	if expectedSHA256 != "" && (normalizeEOL != "" || stripEXIF) {
+		var publish bool
+		if checksum, publish = verifyChecksum(ctx, oldPath, expectedSHA256, uploadID, originalFilename); !publish {
+			return uploadQuarantined, nil
+		}
+	}
+	rewritten := false
+	if normalizeEOL != "" {
+		changed, err := normalizeLineEndings(oldPath, normalizeEOL)
+		if err != nil {
+			slog.Warn("Failed to normalize line endings, keeping them as uploaded",
 				"upload_id", uploadID,
-				"filename", originalFilename)
+				"error", err)
+		} else if changed {
+			slog.Info("Normalized line endings",
+				"upload_id", uploadID,
+				"eol", normalizeEOL)
+			rewritten = true
+		}
+	}
+	if stripEXIF {
+		changed, err := stripImageMetadata(oldPath)
+		if err != nil {
+			slog.Warn("Failed to strip image metadata, keeping the file as uploaded",
+				"upload_id", uploadID,
+				"error", err)
+		} else if changed {
+			slog.Info("Stripped image metadata", "upload_id", uploadID)
+			rewritten = true
+		}
+	}
+	if rewritten {
+		expectedSHA256 = ""
+	}
 
-			if originalFilename == "" {
-				slog.Warn("No filename in metadata, keeping file with upload ID",
-					"upload_id", uploadID)
-				continue
+	// Routed by the name it is published under. The data is staged in the
+	// route's directory first, a copy when that is on another file system.
+	now := time.Now()
+	if isReserved {
+		now = reserved.at
+	}
+	filename := uploadFilename(event.Upload, now)
+	storageDir := routeDir(uploadRoutes, sanitizeFilename(filename))
+	if storageDir != uploadsDir {
+		staged := filepath.Join(storageDir, ".route-"+uploadID)
+		if err := moveFile(oldPath, staged); err != nil {
+			trace.SpanFromContext(ctx).SetStatus(codes.Error, err.Error())
+			slog.Error("Failed to move upload to its --route-by-ext directory",
+				"upload_id", uploadID,
+				"path", storageDir,
+				"error", err)
+			return uploadKept, err
+		}
+		unstaged := oldPath
+		oldPath = staged
+		// An upload that isn't published stays under its ID in the uploads dir
+		defer func() {
+			if _, err := os.Lstat(staged); err == nil {
+				if err := moveFile(staged, unstaged); err != nil {
+					slog.Error("Failed to move unpublished upload back to the uploads dir",
+						"upload_id", uploadID,
+						"path", staged,
+						"error", err)
+				}
 			}
+		}()
+	}
+
+	if useXattr {
+		storeUploadXattrs(oldPath, originalFilename)
+	}
+
+	subdir, targetDir, err := publishDir(storageDir, now)
+	if err != nil {
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, err.Error())
+		slog.Error("Failed to create directory for uploaded file",
+			"upload_id", uploadID,
+			"path", targetDir,
+			"error", err)
+		return uploadKept, err
+	}
+	var finalFilename string
+	if isReserved {
+		finalFilename, err = publishReserved(oldPath, targetDir, path.Base(reserved.name), filename, event.Upload.MetaData[conflictMetadataKey])
+	} else {
+		finalFilename, err = publishConditional(oldPath, targetDir, filename, event.Upload.MetaData[conflictMetadataKey])
+	}
+	finalFilename = path.Join(subdir, finalFilename)
+	if errors.Is(err, errNameTaken) {
+		slog.Warn("File name is taken, keeping file with upload ID",
+			"upload_id", uploadID,
+			"original_filename", originalFilename,
+			"final_filename", finalFilename,
+			"on_conflict", conflictPolicy)
+		return uploadKept, nil
+	}
+	if err != nil {
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, err.Error())
+		slog.Error("Failed to rename uploaded file",
+			"upload_id", uploadID,
+			"original_filename", originalFilename,
+			"final_filename", finalFilename,
+			"error", err)
+		return uploadKept, err
+	}
+	newPath := filepath.Join(storageDir, filepath.FromSlash(finalFilename))
 
-			oldPath := filepath.Join(uploadsDir, uploadID)
+	// Checked on the published file, so corruption while storing or renaming
+	// is caught as well, unless it was rewritten after the check above
+	if expectedSHA256 != "" {
+		var publish bool
+		if checksum, publish = verifyChecksum(ctx, newPath, expectedSHA256, uploadID, originalFilename); !publish {
+			return uploadQuarantined, nil
+		}
+	}
+	slog.Info("File renamed successfully",
+		"from", uploadID,
+		"original_filename", originalFilename,
+		"final_filename", finalFilename,
+		"checksum", checksum)
 
-			finalFilename := getUniqueFilename(uploadsDir, originalFilename)
-			newPath := filepath.Join(uploadsDir, finalFilename)
+	writeUploadMeta(storageDir, finalFilename, originalFilename, uploadID)
+	published := func() {
+		if receipts != nil {
+			receipts.write(storageDir, finalFilename, originalFilename, uploadID)
+		}
+		if webhook != nil {
+			webhook.notify(storageDir, finalFilename, originalFilename, uploadID)
+		}
+		if thumbs != nil {
+			thumbs.generate(newPath, finalFilename)
+		}
+		if converter != nil {
+			converter.convert(newPath)
+		}
+	}
+	if hook != nil {
+		hook.run(postHookUpload{
+			path:             newPath,
+			filename:         finalFilename,
+			originalFilename: originalFilename,
+			uploadID:         uploadID,
+			size:             event.Upload.Size,
+		}, published)
+	} else {
+		published()
+	}
+
+	if event.Upload.IsFinal {
+		removePartialUploads(store, uploadID, event.Upload.PartialUploads)
+	}
+	return uploadPublished, nil
+}
 
-			// Check if the file with the upload ID exists
-			if _, err := os.Stat(oldPath); err != nil {
-				slog.Warn("Upload file not found for renaming",
-					"upload_id", uploadID,
-					"filename", originalFilename,
-					"path", oldPath)
-				continue
+// handleCompletedUploads finalizes completed tus and sparse uploads with
+// finalize until ctx is done. The returned channel is closed once the upload
+// being finalized at that point, if any, is published.
+func handleCompletedUploads(ctx context.Context, handler *tusd.Handler, sparse <-chan tusd.HookEvent, finalize func(context.Context, tusd.HookEvent) (finalizeOutcome, error), metrics *statsdMetrics, prom *prometheusMetrics, events *uploadEvents) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var event tusd.HookEvent
+			select {
+			case event = <-handler.CompleteUploads:
+			case event = <-sparse:
+			case <-ctx.Done():
+				return
+			}
+			if metrics != nil {
+				metrics.uploadCompleted(event.Upload)
+			}
+			if events != nil {
+				events.completed(event)
 			}
 
-			if err := os.Rename(oldPath, newPath); err != nil {
-				slog.Error("Failed to rename uploaded file",
-					"upload_id", uploadID,
-					"original_filename", originalFilename,
-					"final_filename", finalFilename,
-					"error", err)
-				continue
+			// Continue the trace of the request that completed the upload
+			ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(event.Context))
+			ctx, span := tracer.Start(ctx, "finalize upload", trace.WithAttributes(
+				attribute.String("upload.id", event.Upload.ID),
+				attribute.Int64("upload.size", event.Upload.Size)))
+			outcome, err := finalize(ctx, event)
+			if prom != nil {
+				prom.uploadFinalized(event.Upload, outcome, err)
 			}
-			slog.Info("File renamed successfully",
-				"from", uploadID,
-				"original_filename", originalFilename,
-				"final_filename", finalFilename)
+			span.End()
 		}
 	}()
+	return done
+}
+
+// checkStartup runs the checks of --check that serving would only run once it
+// listens, without binding a port or a socket
+func checkStartup(local bool) error {
+	if local {
+		if err := probeWritable(uploadsDir); err != nil {
+			return fmt.Errorf("uploads directory is not writable: %w", err)
+		}
+	}
+	if unixSocket != "" {
+		if _, err := parseSocketMode(socketMode); err != nil {
+			return fmt.Errorf("invalid --socket-mode: %w", err)
+		}
+	}
+	if len(acmeDomains) == 0 && (certFile != "" || keyFile != "") {
+		if certFile == "" || keyFile == "" {
+			return errors.New("--cert and --key need to be given together, HTTPS stays disabled with only one")
+		}
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return fmt.Errorf("unable to load TLS certificate: %w", err)
+		}
+	}
+	return nil
 }
 
 func runServer(cmd *cobra.Command, args []string) {
-	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+	if err := loadEnvironment(cmd.Flags()); err != nil {
+		slog.Error("invalid environment", "error", err)
+		os.Exit(1)
+	}
+	// Reloading the config file on SIGHUP applies the options that can change
+	// while running
+	var reloader *configReloader
+	if configFile != "" {
+		var err error
+		if reloader, err = newConfigReloader(cmd.Flags(), configFile); err == nil {
+			err = loadConfigFile(cmd.Flags(), configFile)
+		}
+		if err != nil {
+			slog.Error("invalid --config", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// JSON logs, redacting filenames and feeding the log stream for the admin
+	// panel replace the standard log package output with a slog handler. The
+	// stream sits in front of the redaction, since it is only readable with the
+	// admin token.
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		slog.Error("invalid --log-level value, expected debug, info, warn or error", "value", logLevel)
+		os.Exit(1)
+	}
+	var logHandler slog.Handler
+	switch logFormat {
+	case "text":
+		logHandler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	case "json":
+		logHandler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	default:
+		slog.Error("invalid --log-format value, expected text or json", "value", logFormat)
+		os.Exit(1)
+	}
+	if redactFilenames {
+		logHandler = newFilenameRedactor(logHandler)
+	}
+	var logs *logRing
+	if adminToken != "" {
+		logs = newLogRing()
+		logHandler = newRingHandler(logHandler, logs)
+	}
+	if logFormat == "json" || redactFilenames || logs != nil {
+		slog.SetDefault(slog.New(logHandler))
+	} else {
+		slog.SetLogLoggerLevel(level)
+	}
+
+	logEffectiveConfig(cmd.Flags())
+
+	if s3Opts.bucket != "" {
+		if flags := s3LocalOnlyFlags(cmd.Flags()); len(flags) > 0 {
+			slog.Error("these options need local storage and can't be used with --s3-bucket", "flags", strings.Join(flags, ", "))
+			os.Exit(1)
+		}
+	} else if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		// Create uploads directory if it doesn't exist
 		slog.Error("unable to create uploads directory", "error", err)
 		os.Exit(1)
 	}
 
-	store := filestore.New(uploadsDir)
-	locker := filelocker.New(uploadsDir)
+	if otelEndpoint != "" {
+		shutdownTracing, err := setupTracing(context.Background(), otelEndpoint)
+		if err != nil {
+			slog.Error("unable to set up tracing", "error", err)
+			os.Exit(1)
+		}
+		defer shutdownTracing(context.Background())
+	}
+
+	policy, err := parseTLSPolicy(tlsMinVersion, tlsCiphers)
+	if err != nil {
+		slog.Error("invalid TLS policy", "error", err)
+		os.Exit(1)
+	}
+	if err := quicOpts.validate(); err != nil {
+		slog.Error("invalid HTTP/3 configuration", "error", err)
+		os.Exit(1)
+	}
+	if err := validateACME(acmeDomains, certFile, keyFile, ocspStaple); err != nil {
+		slog.Error("invalid ACME configuration", "error", err)
+		os.Exit(1)
+	}
+
+	uiOverrides := []uiOverride{
+		{urlPath: "/favicon.ico", file: faviconFile},
+		{urlPath: "/manifest.json", file: manifestFile},
+	}
+	if err := validateUIOverrides(uiOverrides); err != nil {
+		slog.Error("invalid UI asset override", "error", err)
+		os.Exit(1)
+	}
+	uiFS := webUIFS
+	if uiDir != "" {
+		if uiFS, err = openUIDir(uiDir); err != nil {
+			slog.Error("invalid --ui-dir", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Serving the web UI from disk", "dir", uiDir)
+	}
+
+	maxSize, err = parseByteSize(maxSizeFlag)
+	if err != nil {
+		slog.Error("invalid --max-size", "error", err)
+		os.Exit(1)
+	}
+	minFreeSpace, err := parseByteSize(minFreeSpaceFlag)
+	if err != nil {
+		slog.Error("invalid --min-free-space", "error", err)
+		os.Exit(1)
+	}
+	maxTotalSize, err := parseByteSize(maxTotalSizeFlag)
+	if err != nil {
+		slog.Error("invalid --max-total-size", "error", err)
+		os.Exit(1)
+	}
+	if err := validateQuotaWarnings(quotaWarnAt, maxTotalSize); err != nil {
+		slog.Error("invalid --quota-warn-at", "error", err)
+		os.Exit(1)
+	}
+
+	basePath, err = parseBasePath(baseURL)
+	if err != nil {
+		slog.Error("invalid --base-url", "error", err)
+		os.Exit(1)
+	}
+	switch conflictPolicy {
+	case conflictRename, conflictOverwrite, conflictReject:
+	default:
+		slog.Error("invalid --on-conflict value, expected rename, overwrite or reject", "value", conflictPolicy)
+		os.Exit(1)
+	}
+	if err := validateLayout(uploadLayout); err != nil {
+		slog.Error("invalid --layout", "error", err)
+		os.Exit(1)
+	}
+	if err := validateOIDCFlags(); err != nil {
+		slog.Error("invalid OIDC options", "error", err)
+		os.Exit(1)
+	}
+	if uploadRoutes, err = parseRoutes(routeByExt); err != nil {
+		slog.Error("invalid --route-by-ext", "error", err)
+		os.Exit(1)
+	}
+	if err := validateRouteDirs(uploadRoutes); err != nil {
+		slog.Error("unable to use --route-by-ext directories", "error", err)
+		os.Exit(1)
+	}
+
+	if !validIDPrefix.MatchString(idPrefix) {
+		slog.Error("invalid --id-prefix, expected up to 32 letters, digits, - or _", "value", idPrefix)
+		os.Exit(1)
+	}
+
+	switch verifyContentType {
+	case "", contentCheckLenient, contentCheckStrict:
+	default:
+		slog.Error("invalid --verify-content-type value, expected lenient or strict", "value", verifyContentType)
+		os.Exit(1)
+	}
+
+	if _, ok := lineEndings[normalizeEOL]; normalizeEOL != "" && !ok {
+		slog.Error("invalid --normalize-eol value, expected lf or crlf", "value", normalizeEOL)
+		os.Exit(1)
+	}
 
 	composer := tusd.NewStoreComposer()
-	store.UseIn(composer)
-	locker.UseIn(composer)
+	var store *fileStore
+	var bucket *s3Storage
+	lookup := localLookup(uploadRoutes)
+	if s3Opts.bucket != "" {
+		bucket, err = newS3Storage(context.Background(), s3Opts)
+		if err != nil {
+			slog.Error("unable to set up S3 storage", "error", err)
+			os.Exit(1)
+		}
+		bucket.UseIn(composer)
+		lookup = bucket.lookup
+		slog.Info("Storing uploads in S3", "bucket", s3Opts.bucket, "prefix", bucket.prefix, "endpoint", s3Opts.endpoint)
+	} else {
+		store = newFileStore(uploadsDir, preallocate, writeBufferSize, idPrefix)
+		store.UseIn(composer)
+		filelocker.New(uploadsDir).UseIn(composer)
+	}
+
+	var preCreateHooks []preCreateHook
+	switch invalidMetadata {
+	case "replace", "reject":
+		// Runs first so the other hooks only see valid UTF-8
+		preCreateHooks = append(preCreateHooks, checkMetadataEncoding(invalidMetadata == "reject"))
+	default:
+		slog.Error("invalid --invalid-metadata value, expected replace or reject", "value", invalidMetadata)
+		os.Exit(1)
+	}
+	if len(defaultMetadata) > 0 {
+		defaults, err := parseDefaultMetadata(defaultMetadata)
+		if err != nil {
+			slog.Error("invalid --default-metadata", "error", err)
+			os.Exit(1)
+		}
+		// Runs early so the hooks after it see the complete metadata
+		preCreateHooks = append(preCreateHooks, addDefaultMetadata(defaults))
+	}
+	if htpasswdPath != "" || oidcIssuer != "" {
+		preCreateHooks = append(preCreateHooks, recordUploader)
+	}
+	if rejectEmpty {
+		preCreateHooks = append(preCreateHooks, rejectEmptyUploads)
+	}
+	types := parseAllowedTypes(allowedTypes)
+	var allowed atomic.Pointer[[]string]
+	allowed.Store(&types)
+	if len(types) > 0 || reloader != nil {
+		preCreateHooks = append(preCreateHooks, allowTypes(&allowed))
+	}
+	if reloader != nil {
+		reloader.onReload("allowed-types", func(values []string) error {
+			types := parseAllowedTypes(values)
+			allowed.Store(&types)
+			return nil
+		})
+	}
+	if minFreeSpace > 0 {
+		preCreateHooks = append(preCreateHooks, requireFreeSpace(uploadsDir, minFreeSpace))
+	}
+	switch inflightDuplicates {
+	case "allow":
+	case "reject":
+		preCreateHooks = append(preCreateHooks, newInflightUploads(store).rejectDuplicates)
+	default:
+		slog.Error("invalid --inflight-duplicates value, expected allow or reject", "value", inflightDuplicates)
+		os.Exit(1)
+	}
+
+	// Runs after the metadata hooks, since it reads the final metadata and strips
+	// the key it owns
+	preCreateHooks = append(preCreateHooks, newConditionalUploads(lookup, allowOverwrite).checkConditions)
+	var quota *storageQuota
+	if maxTotalSize > 0 {
+		quota, err = newStorageQuota(storageDirs(uploadRoutes), store, maxTotalSize)
+		if err != nil {
+			slog.Error("unable to count the stored bytes for --max-total-size", "error", err)
+			os.Exit(1)
+		}
+		preCreateHooks = append(preCreateHooks, quota.check)
+	}
+	var slots *uploadSlots
+	switch {
+	case maxConcurrentUploads < 0:
+		slog.Error("invalid --max-concurrent-uploads value, expected at least 0", "value", maxConcurrentUploads)
+		os.Exit(1)
+	case maxConcurrentUploads > 0:
+		slots = newUploadSlots(maxConcurrentUploads)
+		preCreateHooks = append(preCreateHooks, slots.take)
+	}
+	if maxUploadsPerHour > 0 {
+		// Runs last so uploads rejected for other reasons don't use up the window
+		preCreateHooks = append(preCreateHooks, newUploadWindow(maxUploadsPerHour).limitUploads)
+	}
+
+	if rateLimit > 0 && rateBurst < 1 {
+		slog.Error("invalid --rate-burst value, expected at least 1", "value", rateBurst)
+		os.Exit(1)
+	}
+	proxies, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		slog.Error("invalid --trusted-proxies", "error", err)
+		os.Exit(1)
+	}
+	allowedNets, err := parsePrefixes(allowCIDRs)
+	if err != nil {
+		slog.Error("invalid --allow-cidr", "error", err)
+		os.Exit(1)
+	}
+	deniedNets, err := parsePrefixes(denyCIDRs)
+	if err != nil {
+		slog.Error("invalid --deny-cidr", "error", err)
+		os.Exit(1)
+	}
+
+	// Without --cors-origins tusd's defaults apply, as before
+	var cors *tusd.CorsConfig
+	if len(corsOrigins) > 0 {
+		cors = corsConfig(corsOrigins)
+	}
+
+	// /api/events shares the admin token with the other admin endpoints
+	eventsEnabled := adminToken != ""
+	progressInterval := time.Second
+	if uploadInactivityTimeout > 0 {
+		progressInterval = stallCheckInterval(uploadInactivityTimeout)
+	}
+
+	// The response completing an upload names the file it is published as. In
+	// S3 mode there is no download endpoint to point at.
+	var names *finalNames
+	var preFinish func(tusd.HookEvent) (tusd.HTTPResponse, error)
+	if bucket == nil {
+		names = newFinalNames()
+		preFinish = names.reserve
+	}
 
+	preCreate := chainPreCreateHooks(preCreateHooks)
 	handler, err := tusd.NewHandler(tusd.Config{
-		BasePath:              "/files/",
-		StoreComposer:         composer,
-		NotifyCompleteUploads: true,
+		BasePath:                  basePath + "files/",
+		Cors:                      cors,
+		StoreComposer:             composer,
+		MaxSize:                   maxSize,
+		NotifyCompleteUploads:     true,
+		NotifyCreatedUploads:      statsdAddr != "" || eventsEnabled || quota != nil || slots != nil,
+		NotifyTerminatedUploads:   statsdAddr != "" || quota != nil || slots != nil,
+		NotifyUploadProgress:      uploadInactivityTimeout > 0 || eventsEnabled || slots != nil,
+		UploadProgressInterval:    progressInterval,
+		PreUploadCreateCallback:   preCreate,
+		PreFinishResponseCallback: preFinish,
+		Logger:                    xslog.New(expSlogHandler{slog.Default().Handler()}),
 	})
 	if err != nil {
 		slog.Error("unable to create handler", "error", err)
 		os.Exit(1)
 	}
 
-	handleCompletedUploads(handler)
+	var created, terminated, progress, completed []func(tusd.HookEvent)
+	var events *uploadEvents
+	if eventsEnabled {
+		events = newUploadEvents()
+		created = append(created, events.created)
+		progress = append(progress, events.progress)
+	}
+	if quota != nil {
+		created = append(created, quota.created)
+		terminated = append(terminated, quota.terminated)
+		completed = append(completed, quota.completed)
+	}
+	if slots != nil {
+		created = append(created, slots.created)
+		terminated = append(terminated, slots.release)
+		progress = append(progress, slots.progress)
+		completed = append(completed, slots.release)
+	}
+	var janitor *uploadJanitor
+	// A check doesn't remove anything
+	if uploadExpiry > 0 && !checkConfig {
+		janitor = newUploadJanitor(uploadsDir, store, uploadExpiry, uploadExpiryInterval)
+	}
+
+	var metrics *statsdMetrics
+	if statsdAddr != "" {
+		metrics, err = newStatsdMetrics(statsdAddr, statsdPrefix)
+		if err != nil {
+			slog.Error("unable to set up StatsD metrics", "error", err)
+			os.Exit(1)
+		}
+		created = append(created, metrics.uploadCreated)
+		terminated = append(terminated, metrics.uploadTerminated)
+	}
+	dispatchHookEvents(handler.CreatedUploads, created...)
+	dispatchHookEvents(handler.TerminatedUploads, terminated...)
+	// Sparse uploads share the other consumers, they have no request to stop
+	tusProgress := progress
+	var stalls *stallMonitor
+	if uploadInactivityTimeout > 0 {
+		stalls = newStallMonitor(uploadInactivityTimeout)
+		tusProgress = append(slices.Clip(progress), stalls.observe)
+	}
+	dispatchHookEvents(handler.UploadProgress, tusProgress...)
+	var prom *prometheusMetrics
+	if metricsEnabled {
+		prom = newPrometheusMetrics(handler)
+	}
+
+	jobs := newJobRegistry()
+
+	var converter *uploadConverter
+	if len(convertRules) > 0 {
+		rules := make([]conversionRule, len(convertRules))
+		for i, value := range convertRules {
+			if rules[i], err = parseConversionRule(value); err != nil {
+				slog.Error("invalid --convert rule", "error", err)
+				os.Exit(1)
+			}
+		}
+		converter = newUploadConverter(rules, convertTimeout, convertKeepOriginal, jobs)
+	}
+
+	var hook *postHook
+	if postHookCommand != "" {
+		if postHookConcurrency < 1 {
+			slog.Error("invalid --post-hook-concurrency value, expected at least 1", "value", postHookConcurrency)
+			os.Exit(1)
+		}
+		hook = newPostHook(postHookCommand, postHookTimeout, postHookRequired, postHookConcurrency, jobs)
+	}
+
+	var thumbs *thumbnailer
+	if thumbnailSize != 0 {
+		if thumbnailSize < 16 || thumbnailSize > 2048 {
+			slog.Error("invalid --thumbnail-size value, expected between 16 and 2048", "value", thumbnailSize)
+			os.Exit(1)
+		}
+		thumbs = newThumbnailer(uploadsDir, thumbnailSize, jobs)
+	}
+
+	var receipts *receiptSigner
+	if receiptKeyFile != "" {
+		key, err := loadReceiptKey(receiptKeyFile)
+		if err != nil {
+			slog.Error("unable to load receipt key", "error", err)
+			os.Exit(1)
+		}
+		receipts = newReceiptSigner(key)
+	}
+
+	var webhook *webhookNotifier
+	if webhookURL != "" {
+		webhook, err = newWebhookNotifier(webhookURL, webhookSecret, filepath.Join(uploadsDir, webhookQueueDir), webhookRetries)
+		if err != nil {
+			slog.Error("unable to open webhook queue", "error", err)
+			os.Exit(1)
+		}
+		if prom != nil {
+			prom.watchWebhooks(webhook)
+		}
+	}
+	if quota != nil && len(quotaWarnAt) > 0 {
+		var send func(quotaWarningEvent)
+		if webhook != nil {
+			send = func(event quotaWarningEvent) {
+				webhook.send(webhookQuotaEvent, event)
+			}
+		}
+		quota.watchWarnings(quotaWarnAt, send)
+	}
+
+	finalizeCtx, stopFinalizing := context.WithCancel(context.Background())
+	finalize := func(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+		return finalizeUpload(ctx, store, names, receipts, webhook, converter, hook, thumbs, event)
+	}
+	if bucket != nil {
+		finalize = bucket.finalize
+	}
+	if len(completed) > 0 {
+		finalizeUpload := finalize
+		finalize = func(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+			// Before finishing, which doesn't change that the upload is done
+			for _, consume := range completed {
+				consume(event)
+			}
+			return finalizeUpload(ctx, event)
+		}
+	}
+	// Sparse uploads are written to the uploads dir, in S3 mode there is none
+	var sparse *sparseUploads
+	if sparseUploadsEnabled && bucket == nil {
+		sparse = newSparseUploads(store, preCreate, created, progress)
+	}
+	finalized := handleCompletedUploads(finalizeCtx, handler, sparse.completedUploads(), finalize, metrics, prom, events)
+
+	var uploadHandler http.Handler = handler
+	if stalls != nil {
+		uploadHandler = stalls.middleware(uploadHandler)
+	}
+	if janitor != nil {
+		uploadHandler = janitor.expirationMiddleware(uploadHandler)
+	}
+	if chunkAlignBytes > 0 {
+		uploadHandler = newChunkAlignment(store, chunkAlignBytes).middleware(uploadHandler)
+	}
+	if resumeSessionsEnabled {
+		sessions := newResumeSessions(store, resumeSessionTTL)
+		uploadHandler = sessions.middleware(uploadHandler)
+		http.HandleFunc("GET /api/my-uploads", sessions.handleMyUploads)
+	}
+	// Checked on every request, so reloading --config can replace them
+	liveAuthToken, liveAdminToken := newLiveToken(authToken), newLiveToken(adminToken)
+	if reloader != nil {
+		reloader.onReload("auth-token", tokenReloader(liveAuthToken))
+		reloader.onReload("admin-token", tokenReloader(liveAdminToken))
+	}
+	if sparse != nil {
+		uploadHandler = sparse.tusMiddleware(uploadHandler)
+	}
+	// Outermost but for the rate limit, so nothing else looks at a request before
+	// it is authenticated
+	uploadHandler = requireUploadToken(uploadHandler, liveAuthToken)
+	if rateLimit > 0 {
+		// In front of the token check, so guessing tokens is throttled as well
+		uploadHandler = newClientLimiter(rateLimit, rateBurst, proxies).middleware(uploadHandler)
+	}
+
+	http.Handle("/files/", http.StripPrefix("/files/", uploadHandler))
+	http.Handle("/files", http.StripPrefix("/files", uploadHandler))
+
+	if logs != nil {
+		http.HandleFunc("GET /api/logs", logs.handleLogs(liveAdminToken))
+	}
+	if events != nil {
+		http.HandleFunc("GET /api/events", events.handleEvents(liveAdminToken))
+	}
+	if webhook != nil && adminToken != "" {
+		http.HandleFunc("GET /api/webhooks/failed", webhook.handleFailed(liveAdminToken))
+	}
+
+	// The file endpoints read the uploads dir, in S3 mode there is none
+	if bucket == nil {
+		roots, err := openStorageRoots(uploadRoutes)
+		if err != nil {
+			slog.Error("unable to open uploads directory", "error", err)
+			os.Exit(1)
+		}
+		// Thumbnails are kept in the uploads dir, for files in any of the roots
+		uploadsRoot := roots[0].root
+		filesFS := roots.FS()
+		http.HandleFunc("GET /api/download-folder", newFolderDownloads(filesFS).handleDownloadFolder)
+		http.HandleFunc("GET /api/files", newFileList(filesFS, uploadLayout != layoutFlat).handleList)
+		http.HandleFunc("GET /api/files/{name}/info", handleFileInfo(filesFS))
+		if thumbs != nil {
+			http.HandleFunc("GET /api/thumbnail/{name...}", handleThumbnail(uploadsRoot))
+		}
+		http.HandleFunc("GET /api/download/{name...}", handleDownloadFile(filesFS))
+		http.HandleFunc("POST /api/download-zip", handleDownloadZip(filesFS))
+		manifest := newFileManifest(filesFS)
+		http.HandleFunc("GET /api/manifest", manifest.handleManifest)
+		if receipts != nil {
+			http.HandleFunc("GET /api/files/{name}/receipt", handleReceipt(filesFS))
+		}
+
+		renamer := newFileRenamer(uploadsDir, roots)
+		http.Handle("PUT /api/files/{name...}", requireUploadToken(http.HandlerFunc(renamer.handleRename), liveAuthToken))
+
+		if sparse != nil {
+			http.Handle("POST /api/sparse-uploads", requireUploadToken(http.HandlerFunc(sparse.handleCreate), liveAuthToken))
+			http.HandleFunc("GET /api/sparse-uploads/{id}", sparse.handleStatus)
+			http.Handle("PUT /api/sparse-uploads/{id}", requireUploadToken(http.HandlerFunc(sparse.handleWrite), liveAuthToken))
+		}
+
+		if adminToken != "" {
+			patcher := newFilePatcher(roots, receipts, manifest)
+			http.HandleFunc("PATCH /api/files/{name...}", func(w http.ResponseWriter, r *http.Request) {
+				if requireAdmin(w, r, liveAdminToken) {
+					patcher.handlePatch(w, r)
+				}
+			})
+		}
+	}
+
+	if prom != nil {
+		http.Handle("GET /metrics", prom.handler())
+	}
+
+	// Never behind a token, for Kubernetes and load balancer probes
+	readyDir := uploadsDir
+	if bucket != nil {
+		readyDir = ""
+	}
+	http.HandleFunc("GET /healthz", handleHealthz)
+	http.HandleFunc("GET /readyz", handleReadyz(readyDir))
+
+	// Job IDs are only logged, so the jobs are for admins like the logs
+	if adminToken != "" {
+		http.HandleFunc("GET /api/jobs/{id}", jobs.handleGet(liveAdminToken))
+		http.HandleFunc("DELETE /api/jobs/{id}", jobs.handleCancel(liveAdminToken))
+	}
+	http.HandleFunc("/api/", handleUnknownAPI)
+
+	registerUIOverrides(http.DefaultServeMux, uiOverrides)
+	http.Handle("/", http.FileServer(http.FS(uiFS)))
+
+	var rootHandler http.Handler = http.DefaultServeMux
+	if compressResponses {
+		rootHandler = compressMiddleware(rootHandler)
+	}
+	if writableCheckInterval > 0 {
+		rootHandler = newWritabilityMonitor(uploadsDir, writableCheckInterval).middleware(rootHandler)
+	}
+	if len(allowedNets) > 0 || len(deniedNets) > 0 || reloader != nil {
+		filter := newIPFilter(allowedNets, deniedNets, proxies)
+		rootHandler = filter.middleware(rootHandler)
+		if reloader != nil {
+			reloader.onReload("allow-cidr", func(values []string) error {
+				allow, err := parsePrefixes(values)
+				if err == nil {
+					filter.setRules(allow, filter.rules.Load().deny)
+				}
+				return err
+			})
+			reloader.onReload("deny-cidr", func(values []string) error {
+				deny, err := parsePrefixes(values)
+				if err == nil {
+					filter.setRules(filter.rules.Load().allow, deny)
+				}
+				return err
+			})
+		}
+	}
+	// Once every option reloading the config file can change is hooked up
+	if reloader != nil {
+		reloader.watchSignals()
+	}
+	// The token endpoints accept their tokens instead of a login, a request
+	// can't carry both
+	loginTokens := newLoginTokens(liveAuthToken, liveAdminToken)
+	if htpasswdPath != "" {
+		basicAuth, err := newHtpasswdAuth(htpasswdPath, loginTokens)
+		if err != nil {
+			slog.Error("unable to load --htpasswd", "error", err)
+			os.Exit(1)
+		}
+		basicAuth.watchSignals()
+		rootHandler = basicAuth.middleware(rootHandler)
+	}
+	if oidcIssuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		login, err := newOIDCAuth(ctx, oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL, loginTokens)
+		cancel()
+		if err != nil {
+			slog.Error("unable to set up OIDC login", "issuer", oidcIssuer, "error", err)
+			os.Exit(1)
+		}
+		rootHandler = login.middleware(rootHandler)
+	}
+	if hostname != "" {
+		rootHandler = hostMiddleware(rootHandler, strings.TrimSuffix(hostname, "."))
+	}
+	if otelEndpoint != "" {
+		rootHandler = tracingMiddleware(rootHandler)
+	}
+	if basePath != "/" {
+		// Outside of everything matching on paths, so they see the same routes
+		// as without a prefix; the access log records the full request URI
+		rootHandler = basePathMiddleware(rootHandler, basePath)
+	}
+	if accessLogFormat != "" {
+		accessLog, err := newAccessLogger(accessLogFormat, accessLogFile, accessLogExclude)
+		if err != nil {
+			slog.Error("unable to set up access log", "error", err)
+			os.Exit(1)
+		}
+		rootHandler = accessLog.middleware(rootHandler)
+	}
+	if requestLogging {
+		rootHandler = newRequestLogger(accessLogExclude, proxies).middleware(rootHandler)
+	}
 
-	http.Handle("/files/", http.StripPrefix("/files/", handler))
-	http.Handle("/files", http.StripPrefix("/files", handler))
-	http.Handle("/", http.FileServer(http.FS(webUIFS)))
+	if checkConfig {
+		if err := checkStartup(bucket == nil); err != nil {
+			slog.Error("check failed", "error", err)
+			os.Exit(1)
+		}
+		printEffectiveConfig(os.Stdout, cmd.Flags())
+		slog.Info("Configuration is valid")
+		stopFinalizing()
+		return
+	}
 
 	addr := fmt.Sprintf(":%d", port)
 
+	// With a Unix socket the listener is set up right away, so a socket that
+	// can't be claimed stops the start
+	var unixListener net.Listener
+	if unixSocket != "" {
+		mode, err := parseSocketMode(socketMode)
+		if err != nil {
+			slog.Error("invalid --socket-mode", "error", err)
+			os.Exit(1)
+		}
+		if unixListener, err = listenUnix(unixSocket, mode); err != nil {
+			slog.Error("unable to listen on Unix socket", "path", unixSocket, "error", err)
+			os.Exit(1)
+		}
+		addr = "unix:" + unixSocket
+	}
+	if unixListener != nil && http3Enabled && (len(acmeDomains) > 0 || certFile != "" && keyFile != "") {
+		slog.Warn("HTTP/3 can't be served over a Unix socket, disabling it")
+	}
+	serveHTTP3 := http3Enabled && unixListener == nil
+
+	// Orchestrators stop containers with SIGTERM and expect a clean exit
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
 	// Create HTTP server
 	var server *http.Server
+	var h3Server *http3.Server
+	var h3Conns quicConns
+	serveErr := make(chan error, 1)
 
 	// Determine if we should use HTTPS or HTTP
-	if certFile != "" && keyFile != "" {
-		// Always enable HTTP/3 when TLS is configured
-		slog.Info("Starting HTTPS server with HTTP/3 support", "addr", addr)
-		slog.Info("Configuration", "uploads_dir", uploadsDir, "cert_file", certFile, "key_file", keyFile, "http3", true)
-
-		// Create HTTP server with Alt-Svc middleware to advertise HTTP/3
-		server = &http.Server{
-			Addr:    addr,
-			Handler: altSvcMiddleware(http.DefaultServeMux, port),
+	if len(acmeDomains) > 0 || (certFile != "" && keyFile != "") {
+		if serveHTTP3 {
+			slog.Info("Starting HTTPS server with HTTP/3 support", "addr", addr)
+		} else {
+			slog.Info("Starting HTTPS server", "addr", addr)
 		}
 
-		// Start HTTP/3 server
-		h3Server := &http3.Server{
-			Addr:    addr,
-			Handler: http.DefaultServeMux, // HTTP/3 server uses the original mux without Alt-Svc header
+		// Both listeners share the certificate source, so a renewal or a SIGHUP
+		// reload applies to each
+		var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		var nextProtos []string
+		if len(acmeDomains) > 0 {
+			slog.Info("Configuration", "uploads_dir", uploadsDir, "base_path", basePath, "preallocate", preallocate, "max_size", maxSize, "acme_domains", acmeDomains, "acme_cache_dir", acmeCacheDir, "http3", serveHTTP3)
+			getCertificate = newACMEManager(acmeDomains, acmeCacheDir).GetCertificate
+			nextProtos = acmeNextProtos
+		} else {
+			slog.Info("Configuration", "uploads_dir", uploadsDir, "base_path", basePath, "preallocate", preallocate, "max_size", maxSize, "cert_file", certFile, "key_file", keyFile, "http3", serveHTTP3)
+			certs, certErr := newCertReloader(certFile, keyFile)
+			if certErr != nil {
+				slog.Error("unable to load TLS certificate", "error", certErr)
+				os.Exit(1)
+			}
+			if ocspStaple {
+				certs.stapleOCSP()
+			}
+			certs.watchSignals()
+			getCertificate = certs.getCertificate
 		}
+		slog.Info("TLS policy", "min_version", tlsMinVersion, "cipher_suites", policy.cipherNames(), "http3_min_version", "1.3")
 
-		// Start HTTP/3 server in a goroutine
-		go func() {
-			if err := h3Server.ListenAndServeTLS(certFile, keyFile); err != nil {
-				slog.Error("HTTP/3 server failed", "error", err)
+		tlsConfig := policy.config(getCertificate)
+		tlsConfig.NextProtos = nextProtos
+		if !serveHTTP3 {
+			// Without Alt-Svc, so clients never try QUIC
+			server = &http.Server{
+				Addr:      addr,
+				Handler:   rootHandler,
+				TLSConfig: tlsConfig,
 			}
-		}()
+			if unixListener != nil {
+				go func() { serveErr <- server.ServeTLS(unixListener, "", "") }()
+			} else {
+				go func() { serveErr <- server.ListenAndServeTLS("", "") }()
+			}
+		} else {
+			// Create HTTP server with Alt-Svc middleware to advertise HTTP/3
+			server = &http.Server{
+				Addr:      addr,
+				Handler:   altSvcMiddleware(rootHandler, quicOpts.altSvc(port)),
+				TLSConfig: tlsConfig,
+			}
+
+			// Start HTTP/3 server
+			h3Server = &http3.Server{
+				Addr:        addr,
+				Handler:     rootHandler, // HTTP/3 server uses the original mux without Alt-Svc header
+				TLSConfig:   policy.config(getCertificate),
+				QUICConfig:  quicOpts.config(),
+				ConnContext: h3Conns.connContext,
+			}
+
+			// Start HTTP/3 server in a goroutine
+			go func() {
+				if err := h3Server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("HTTP/3 server failed", "error", err)
+				}
+			}()
 
-		// Start HTTP/1.1 and HTTP/2 server (for fallback)
-		err = server.ListenAndServeTLS(certFile, keyFile)
+			// Start HTTP/1.1 and HTTP/2 server (for fallback)
+			go func() { serveErr <- server.ListenAndServeTLS("", "") }()
+		}
 	} else {
 		// Create HTTP server without Alt-Svc middleware
 		server = &http.Server{
 			Addr:    addr,
-			Handler: http.DefaultServeMux,
+			Handler: rootHandler,
 		}
 
 		slog.Info("Starting HTTP server", "addr", addr)
-		slog.Info("Configuration", "uploads_dir", uploadsDir)
+		slog.Info("Configuration", "uploads_dir", uploadsDir, "base_path", basePath, "preallocate", preallocate, "max_size", maxSize)
 		if certFile != "" || keyFile != "" {
 			slog.Warn("Both --cert and --key must be provided for HTTPS")
 		}
-		err = server.ListenAndServe()
+		if unixListener != nil {
+			go func() { serveErr <- server.Serve(unixListener) }()
+		} else {
+			go func() { serveErr <- server.ListenAndServe() }()
+		}
 	}
 
-	if err != nil {
+	select {
+	case err := <-serveErr:
 		slog.Error("unable to listen", "error", err)
 		os.Exit(1)
+	case <-signals.Done():
+	}
+	// A second signal kills the process without waiting
+	stopSignals()
+
+	slog.Info("Shutting down, waiting for running requests", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Both listeners drain at once, sharing the grace period. Interrupted uploads
+	// keep what was written and can be resumed once the server is back.
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Requests still running after the shutdown timeout, closing their connections", "error", err)
+			server.Close()
+		}
+	})
+	if h3Server != nil {
+		wg.Go(func() {
+			// Shutdown sends GOAWAY, clients close their connections once their
+			// requests are done or move to a new one
+			connections := h3Conns.open.Load()
+			if err := h3Server.Shutdown(shutdownCtx); err != nil {
+				remaining := h3Conns.open.Load()
+				slog.Warn("HTTP/3 requests still running after the shutdown timeout, closing their connections",
+					"drained", max(connections-remaining, 0),
+					"closed", remaining,
+					"error", err)
+				h3Server.Close()
+				return
+			}
+			slog.Info("Drained HTTP/3 connections", "count", connections)
+		})
+	}
+	wg.Wait()
+	// Shutdown closed the Unix listener, which removed the socket file
+
+	// Only stopped now, so uploads completed while draining are still published
+	stopFinalizing()
+	<-finalized
+	if webhook != nil {
+		webhook.close()
 	}
+	slog.Info("Server stopped")
 }
 
 func main() {
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	xslog "golang.org/x/exp/slog"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"non-ASCII letters", "café.pdf", "café.pdf"},
+		{"NFC", "cafe\u0301.pdf", "caf\u00e9.pdf"},
+		{"NUL", "re\x00port.pdf", "report.pdf"},
+		{"newline", "report\n.pdf", "report.pdf"},
+		{"carriage return", "report\r\n.pdf", "report.pdf"},
+		{"DEL", "report\x7f.pdf", "report.pdf"},
+		{"C1 control", "report\u0085.pdf", "report.pdf"},
+		{"right-to-left override", "invoice\u202efdp.exe", "invoicefdp.exe"},
+		{"bidi isolate", "\u2066report\u2069.pdf", "report.pdf"},
+		{"path separators", "a/b\\c.txt", "a_b_c.txt"},
+		{"traversal", "../../etc/passwd", "____etc_passwd"},
+		{"reserved characters", `a:b*c?d"e<f>g|h`, "a_b_c_d_e_f_g_h"},
+		{"leading and trailing dots and spaces", " .report.pdf. ", "report.pdf"},
+		{"empty", "", "unkown-file"},
+		{"only dots", "...", "unkown-file"},
+		{"only dots and spaces", ". . .", "unkown-file"},
+		{"only control characters", "\x00\n\t", "unkown-file"},
+		{"device name", "CON", "unkown-file"},
+		{"device name lower case", "nul", "unkown-file"},
+		{"device name with extension", "PRN.txt", "unkown-file"},
+		{"numbered device name", "COM1", "unkown-file"},
+		{"device name as part", "CONTRACT.pdf", "CONTRACT.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// finalizeTestUpload finalizes an upload of data named filename, declaring
+// expectedSHA256, and returns the outcome, what was published under that name
+// and what was quarantined
+func finalizeTestUpload(t *testing.T, filename string, data []byte, expectedSHA256 string) (outcome finalizeOutcome, published, quarantined []byte) {
+	t.Helper()
+	defer func(saved string) { uploadsDir = saved }(uploadsDir)
+	uploadsDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(uploadsDir, "upload-id"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	event := tusd.HookEvent{Upload: tusd.FileInfo{
+		ID:       "upload-id",
+		Size:     int64(len(data)),
+		MetaData: tusd.MetaData{"filename": filename, checksumMetadataKey: expectedSHA256},
+	}}
+	store := newFileStore(uploadsDir, false, 0, "")
+	outcome, err := finalizeUpload(context.Background(), store, nil, nil, nil, nil, nil, nil, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, _ = os.ReadFile(filepath.Join(uploadsDir, filename))
+	quarantined, _ = os.ReadFile(filepath.Join(uploadsDir, "upload-id.corrupt"))
+	return outcome, published, quarantined
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFinalizeChecksumBeforeNormalizingLineEndings(t *testing.T) {
+	defer func(saved string) { normalizeEOL = saved }(normalizeEOL)
+	normalizeEOL = "lf"
+	data := []byte("one\r\ntwo\r\n")
+
+	// Declared in upper case with spaces, as clients may send it
+	outcome, published, quarantined := finalizeTestUpload(t, "notes.txt", data, " "+strings.ToUpper(sha256Hex(data))+" ")
+	if outcome != uploadPublished || string(published) != "one\ntwo\n" || quarantined != nil {
+		t.Errorf("matching checksum published %q and quarantined %q, want the normalized file published", published, quarantined)
+	}
+
+	outcome, published, quarantined = finalizeTestUpload(t, "notes.txt", data, sha256Hex([]byte("one\ntwo\n")))
+	if outcome != uploadQuarantined || published != nil || string(quarantined) != string(data) {
+		t.Errorf("checksum of the normalized data published %q and quarantined %q, want the upload quarantined as sent", published, quarantined)
+	}
+}
+
+// pngChunk encodes a PNG chunk, with a CRC that --strip-exif doesn't check
+func pngChunk(chunkType, data string) string {
+	length := len(data)
+	return string([]byte{byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}) + chunkType + data + "\x00\x00\x00\x00"
+}
+
+func TestFinalizeChecksumBeforeStrippingMetadata(t *testing.T) {
+	defer func(saved bool) { stripEXIF = saved }(stripEXIF)
+	stripEXIF = true
+	image := string(pngSignature) + pngChunk("IHDR", "header") + pngChunk("IDAT", "pixels")
+	data := []byte(image + pngChunk("tEXt", "Author\x00someone") + pngChunk("IEND", ""))
+	stripped := image + pngChunk("IEND", "")
+
+	outcome, published, quarantined := finalizeTestUpload(t, "photo.png", data, sha256Hex(data))
+	if outcome != uploadPublished || string(published) != stripped || quarantined != nil {
+		t.Errorf("matching checksum published %q and quarantined %q, want the stripped image published", published, quarantined)
+	}
+
+	outcome, published, quarantined = finalizeTestUpload(t, "photo.png", data, sha256Hex([]byte(stripped)))
+	if outcome != uploadQuarantined || published != nil || string(quarantined) != string(data) {
+		t.Errorf("checksum of the stripped image published %q and quarantined %q, want the upload quarantined as sent", published, quarantined)
+	}
+}
+
+func TestFinalizeVerifySize(t *testing.T) {
+	defer func(saved string, savedVerify bool) { uploadsDir, verifySize = saved, savedVerify }(uploadsDir, verifySize)
+	tests := []struct {
+		name         string
+		verify       bool
+		declaredSize int64
+		want         finalizeOutcome
+	}{
+		{"matching size", true, 10, uploadPublished},
+		{"truncated", true, 12, uploadQuarantined},
+		{"longer than declared", true, 8, uploadQuarantined},
+		{"mismatch without --verify-size", false, 12, uploadPublished},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifySize = tt.verify
+			uploadsDir = t.TempDir()
+			if err := os.WriteFile(filepath.Join(uploadsDir, "upload-id"), []byte("0123456789"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			event := tusd.HookEvent{Upload: tusd.FileInfo{
+				ID:       "upload-id",
+				Size:     tt.declaredSize,
+				MetaData: tusd.MetaData{"filename": "report.txt"},
+			}}
+			outcome, err := finalizeUpload(context.Background(), newFileStore(uploadsDir, false, 0, ""), nil, nil, nil, nil, nil, nil, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outcome != tt.want {
+				t.Errorf("finalizeUpload with Upload-Length %d of 10 stored bytes = %v, want %v", tt.declaredSize, outcome, tt.want)
+			}
+			_, errPublished := os.Stat(filepath.Join(uploadsDir, "report.txt"))
+			_, errQuarantined := os.Stat(filepath.Join(uploadsDir, "upload-id.corrupt"))
+			if (errPublished == nil) != (tt.want == uploadPublished) || (errQuarantined == nil) != (tt.want == uploadQuarantined) {
+				t.Errorf("published: %v, quarantined: %v, want the file %v", errPublished, errQuarantined, tt.want)
+			}
+		})
+	}
+}
+
+func TestFinalizeConcatenatedUpload(t *testing.T) {
+	defer func(saved string) { uploadsDir = saved }(uploadsDir)
+	uploadsDir = t.TempDir()
+	composer := tusd.NewStoreComposer()
+	store := newFileStore(uploadsDir, false, 0, "")
+	store.UseIn(composer)
+	handler, err := tusd.NewHandler(tusd.Config{
+		BasePath:              "/files/",
+		StoreComposer:         composer,
+		NotifyCompleteUploads: true,
+		Logger:                xslog.New(xslog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finalized := make(chan tusd.FileInfo)
+	finalize := func(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+		outcome, err := finalizeUpload(ctx, store, nil, nil, nil, nil, nil, nil, event)
+		finalized <- event.Upload
+		return outcome, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleCompletedUploads(ctx, handler, nil, finalize, nil, nil, nil)
+	uploads := http.StripPrefix("/files/", handler)
+
+	create := func(concat, filename, body string) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/files/", strings.NewReader(body))
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		r.Header.Set("Upload-Concat", concat)
+		r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+		if body != "" {
+			r.Header.Set("Upload-Length", strconv.Itoa(len(body)))
+			r.Header.Set("Content-Type", "application/offset+octet-stream")
+		}
+		w := httptest.NewRecorder()
+		uploads.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("POST /files/ with Upload-Concat %s = %d: %s", concat, w.Code, w.Body)
+		}
+		return w.Header().Get("Location")
+	}
+	var parts []string
+	for _, body := range []string{"hello ", "world"} {
+		parts = append(parts, create("partial", "part.txt", body))
+		if upload := <-finalized; !upload.IsPartial {
+			t.Fatalf("part finished as %+v, want a partial upload", upload)
+		}
+	}
+	create("final;"+strings.Join(parts, " "), "greeting.txt", "")
+	if upload := <-finalized; !upload.IsFinal {
+		t.Fatalf("concatenation finished as %+v, want the final upload", upload)
+	}
+
+	// Named from the final upload, with the parts gone
+	if data, err := os.ReadFile(filepath.Join(uploadsDir, "greeting.txt")); err != nil || string(data) != "hello world" {
+		t.Errorf("greeting.txt holds %q (%v), want the concatenated parts", data, err)
+	}
+	for _, part := range parts {
+		id := part[strings.LastIndex(part, "/")+1:]
+		for _, name := range []string{id, id + ".info"} {
+			if _, err := os.Stat(filepath.Join(uploadsDir, name)); !os.IsNotExist(err) {
+				t.Errorf("part %s left in the uploads dir (%v)", name, err)
+			}
+		}
+	}
+}
+
+func TestFinalizeEmptyUpload(t *testing.T) {
+	defer func(saved string, savedReject bool) { uploadsDir, rejectEmpty = saved, savedReject }(uploadsDir, rejectEmpty)
+	for _, reject := range []bool{false, true} {
+		rejectEmpty = reject
+		uploadsDir = t.TempDir()
+		store := newFileStore(uploadsDir, false, 0, "")
+		// With a deferred length, the pre-create hook couldn't tell it was empty
+		upload, err := store.NewUpload(context.Background(), tusd.FileInfo{
+			SizeIsDeferred: true,
+			MetaData:       tusd.MetaData{"filename": "empty.txt"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := upload.GetInfo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		info.SizeIsDeferred = false
+
+		outcome, err := finalizeUpload(context.Background(), store, nil, nil, nil, nil, nil, nil, tusd.HookEvent{Upload: info})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, errPublished := os.Stat(filepath.Join(uploadsDir, "empty.txt"))
+		_, errStored := os.Stat(filepath.Join(uploadsDir, info.ID))
+		if reject {
+			if outcome != uploadRemoved || !os.IsNotExist(errPublished) || !os.IsNotExist(errStored) {
+				t.Errorf("with --reject-empty: outcome %v, published: %v, stored: %v, want the upload removed", outcome, errPublished, errStored)
+			}
+		} else if outcome != uploadPublished || errPublished != nil {
+			t.Errorf("without --reject-empty: outcome %v, published: %v, want the empty file published", outcome, errPublished)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultManifestLimit = 1000
+	maxManifestLimit     = 10000
+)
+
+// manifestEntry describes one finished upload in /api/manifest
+type manifestEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// manifestPage is one page of the manifest. Next is the value to pass as
+// ?after= for the following page and is empty on the last one.
+type manifestPage struct {
+	Files []manifestEntry `json:"files"`
+	Next  string          `json:"next,omitempty"`
+}
+
+// fileManifest lists the finished uploads with their checksums so mirrors can
+// fetch only what changed. Checksums are cached until a file's size or
+// modification time changes.
+type fileManifest struct {
+	fsys fs.FS
+
+	mu        sync.Mutex
+	checksums map[string]cachedChecksum
+}
+
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+func newFileManifest(fsys fs.FS) *fileManifest {
+	return &fileManifest{
+		fsys:      fsys,
+		checksums: make(map[string]cachedChecksum),
+	}
+}
+
+func (m *fileManifest) checksum(name string, info fs.FileInfo) (string, error) {
+	m.mu.Lock()
+	cached, ok := m.checksums[name]
+	m.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	f, err := m.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	m.mu.Lock()
+	m.checksums[name] = cachedChecksum{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	m.mu.Unlock()
+	return sum, nil
+}
+
+// forget drops the cached checksum of a file changed in place, whose size and
+// modification time may not tell
+func (m *fileManifest) forget(name string) {
+	m.mu.Lock()
+	delete(m.checksums, name)
+	m.mu.Unlock()
+}
+
+// page collects up to limit files sorted by name, starting after the given name.
+// Checksums are only computed for the files on the page.
+func (m *fileManifest) page(after string, limit int) (manifestPage, error) {
+	var names []string
+	err := fs.WalkDir(m.fsys, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() && !isUploadBookkeeping(m.fsys, p) {
+			names = append(names, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return manifestPage{}, err
+	}
+	// WalkDir's order differs from plain string order across directories
+	slices.Sort(names)
+
+	start, _ := slices.BinarySearch(names, after)
+	if start < len(names) && names[start] == after {
+		start++
+	}
+	names = names[start:]
+	page := manifestPage{Files: []manifestEntry{}}
+	if len(names) > limit {
+		names = names[:limit]
+		page.Next = names[limit-1]
+	}
+
+	for _, name := range names {
+		info, err := fs.Stat(m.fsys, name)
+		if err != nil {
+			return manifestPage{}, err
+		}
+		sum, err := m.checksum(name, info)
+		if err != nil {
+			return manifestPage{}, err
+		}
+		page.Files = append(page.Files, manifestEntry{
+			Name:    name,
+			Size:    info.Size(),
+			SHA256:  sum,
+			ModTime: info.ModTime().UTC(),
+		})
+	}
+	return page, nil
+}
+
+// handleManifest serves GET /api/manifest?after=...&limit=... The ETag is derived
+// from the page content so mirrors polling an unchanged store get a 304.
+func (m *fileManifest) handleManifest(w http.ResponseWriter, r *http.Request) {
+	limit := defaultManifestLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxManifestLimit {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxManifestLimit))
+			return
+		}
+		limit = n
+	}
+
+	page, err := m.page(r.URL.Query().Get("after"), limit)
+	if err != nil {
+		slog.Error("Failed to build manifest", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to build manifest")
+		return
+	}
+
+	body, err := json.Marshal(page)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to build manifest")
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, json.RawMessage(body))
+}
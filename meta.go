@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// metaSuffix marks the sidecar recording what a finished upload was called
+// before sanitizeFilename, the filename template or a collision changed its name
+const metaSuffix = ".meta.json"
+
+// uploadMeta is the content of a metaSuffix sidecar
+type uploadMeta struct {
+	OriginalFilename string    `json:"original_filename"`
+	UploadID         string    `json:"upload_id"`
+	CompletedAt      time.Time `json:"completed_at"`
+	// PatchedAt is set once PATCH /api/files changed the content
+	PatchedAt time.Time `json:"patched_at,omitzero"`
+}
+
+// writeUploadMeta stores the sidecar for dir/filename if it was published under
+// another name than the client sent. Otherwise a sidecar left by a file that
+// had the name before is removed, so it can't describe the wrong upload.
+func writeUploadMeta(dir, filename, originalFilename, uploadID string) {
+	sidecar := filepath.Join(dir, filepath.FromSlash(filename)) + metaSuffix
+	// With --layout date filename includes the date subdirectory
+	if path.Base(filename) == originalFilename {
+		if err := os.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to remove stale filename sidecar",
+				"path", sidecar,
+				"error", err)
+		}
+		return
+	}
+
+	data, err := json.MarshalIndent(uploadMeta{
+		OriginalFilename: originalFilename,
+		UploadID:         uploadID,
+		CompletedAt:      time.Now().UTC().Truncate(time.Second),
+	}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(sidecar, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		slog.Warn("Failed to write filename sidecar",
+			"path", sidecar,
+			"error", err)
+	}
+}
+
+// markUploadPatched records in the sidecar of the finished upload at path, if
+// it has one, that its content changed after it was published
+func markUploadPatched(path string) {
+	sidecar := path + metaSuffix
+	err := func() error {
+		data, err := os.ReadFile(sidecar)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var meta uploadMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		meta.PatchedAt = time.Now().UTC().Truncate(time.Second)
+		if data, err = json.MarshalIndent(meta, "", "  "); err != nil {
+			return err
+		}
+		return os.WriteFile(sidecar, append(data, '\n'), 0644)
+	}()
+	if err != nil {
+		slog.Warn("Failed to update filename sidecar after patch",
+			"path", sidecar,
+			"error", err)
+	}
+}
+
+// readOriginalFilename returns the name the client uploaded a finished upload
+// under, which is its stored name without the directory unless a sidecar says
+// otherwise
+func readOriginalFilename(fsys fs.FS, name string) string {
+	if original := readSidecarFilename(fsys, name); original != "" {
+		return original
+	}
+	return path.Base(name)
+}
+
+// readSidecarFilename returns the original filename in a finished upload's
+// sidecar, or "" when it has none
+func readSidecarFilename(fsys fs.FS, name string) string {
+	data, err := fs.ReadFile(fsys, name+metaSuffix)
+	if err != nil {
+		return ""
+	}
+	var meta uploadMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return ""
+	}
+	return meta.OriginalFilename
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// hostMiddleware only lets requests for the configured hostname through and
+// answers everything else with 421 Misdirected Request. For HTTP/3 requests
+// r.Host carries the :authority pseudo-header.
+func hostMiddleware(next http.Handler, hostname string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(strings.TrimSuffix(host, "."), hostname) {
+			http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseBasePath turns --base-url into the path prefix everything is served
+// under, starting and ending with a slash. A full URL contributes its path.
+func parseBasePath(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q must not have a query or fragment", value)
+	}
+	p := path.Clean("/" + u.Path)
+	if p == "/" {
+		return p, nil
+	}
+	return p + "/", nil
+}
+
+// basePathMiddleware serves next below base, stripping the prefix so the routes
+// stay the same. The bare prefix redirects to the UI, whose relative links only
+// resolve below the trailing slash.
+func basePathMiddleware(next http.Handler, base string) http.Handler {
+	prefix := strings.TrimSuffix(base, "/")
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, base, http.StatusMovedPermanently)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
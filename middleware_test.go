@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostMiddleware(t *testing.T) {
+	handler := hostMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "files.example.com")
+	tests := []struct {
+		host     string
+		wantCode int
+	}{
+		{"files.example.com", http.StatusNoContent},
+		{"files.example.com:8080", http.StatusNoContent},
+		{"FILES.Example.com", http.StatusNoContent},
+		{"files.example.com.", http.StatusNoContent},
+		{"files.example.com.:443", http.StatusNoContent},
+		{"other.example.com", http.StatusMisdirectedRequest},
+		{"example.com", http.StatusMisdirectedRequest},
+		{"files.example.com.evil.test", http.StatusMisdirectedRequest},
+		{"127.0.0.1:8080", http.StatusMisdirectedRequest},
+		{"", http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/files/", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("Host %q: status %d, want %d", tt.host, w.Code, tt.wantCode)
+			}
+		})
+	}
+}
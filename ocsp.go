@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspRefreshInterval is how often the stapled OCSP response is renewed. Responders
+// typically issue responses valid for several days, so this stays well ahead of expiry.
+const ocspRefreshInterval = time.Hour
+
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchOCSPStaple asks the certificate's OCSP responder for the status of the leaf
+// certificate, which must be followed by its issuer in the chain
+func fetchOCSPStaple(cert *tls.Certificate) ([]byte, *ocsp.Response, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("certificate chain doesn't include the issuer")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("certificate doesn't name an OCSP responder")
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocspClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder answered %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("OCSP responder reports certificate status %d", parsed.Status)
+	}
+	return raw, parsed, nil
+}
+
+// refreshStaple fetches a fresh OCSP response for the current certificate. When the
+// responder fails, an existing staple is kept until it expires and after that the
+// certificate is served without one.
+func (r *certReloader) refreshStaple() {
+	r.mu.RLock()
+	cert, expires := r.cert, r.stapleExpires
+	r.mu.RUnlock()
+
+	raw, parsed, err := fetchOCSPStaple(cert)
+	if err != nil {
+		slog.Warn("Failed to fetch OCSP response",
+			"cert_file", r.certFile,
+			"error", err)
+		if cert.OCSPStaple != nil && time.Now().After(expires) {
+			r.replaceStaple(cert, nil, time.Time{})
+		}
+		return
+	}
+	r.replaceStaple(cert, raw, parsed.NextUpdate)
+	slog.Info("Stapled OCSP response",
+		"cert_file", r.certFile,
+		"next_update", parsed.NextUpdate)
+}
+
+// replaceStaple swaps in a copy of cert carrying the staple, unless the certificate
+// was reloaded in the meantime
+func (r *certReloader) replaceStaple(cert *tls.Certificate, staple []byte, expires time.Time) {
+	stapled := *cert
+	stapled.OCSPStaple = staple
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != cert {
+		return
+	}
+	r.cert = &stapled
+	r.stapleExpires = expires
+}
+
+// stapleOCSP keeps an OCSP response stapled to the served certificate
+func (r *certReloader) stapleOCSP() {
+	r.ocspStaple = true
+	r.refreshStaple()
+	go func() {
+		for range time.Tick(ocspRefreshInterval) {
+			r.refreshStaple()
+		}
+	}()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcSessionTTL is how long a login lasts before the browser is sent to
+	// the identity provider again
+	oidcSessionTTL = 8 * time.Hour
+
+	// oidcLoginTTL bounds the time between leaving for the identity provider
+	// and coming back
+	oidcLoginTTL = 10 * time.Minute
+
+	// oidcExchangeTimeout bounds the request redeeming the authorization code
+	oidcExchangeTimeout = 10 * time.Second
+)
+
+const (
+	loginCookieName     = "simple_upload_login"
+	oidcStateCookieName = "simple_upload_oidc"
+)
+
+// Paths of the login flow, below the base path
+const (
+	oidcCallbackPath = "/auth/callback"
+	oidcLogoutPath   = "/auth/logout"
+)
+
+// oidcSession is the content of the login cookie
+type oidcSession struct {
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcLogin is the content of the state cookie, set while the browser is at
+// the identity provider
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+	Expires  int64  `json:"exp"`
+}
+
+// oidcAuth lets in browsers logged in through an OpenID Connect provider with
+// the authorization code flow and PKCE. The login is kept in a signed cookie
+// holding the subject of the ID token. Its key is made at startup, so a
+// restart logs everyone out, which the provider's own session usually hides.
+type oidcAuth struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// tokens pass without a login on their routes, see passesWithoutLogin
+	tokens    []tokenRoutes
+	cookieKey []byte
+}
+
+// validateOIDCFlags checks the --oidc-* options go together
+func validateOIDCFlags() error {
+	if oidcIssuer == "" {
+		if oidcClientID != "" || oidcClientSecret != "" || oidcRedirectURL != "" {
+			return errors.New("--oidc-client-id, --oidc-client-secret and --oidc-redirect-url need --oidc-issuer")
+		}
+		return nil
+	}
+	if oidcClientID == "" {
+		return errors.New("--oidc-issuer needs --oidc-client-id")
+	}
+	if htpasswdPath != "" {
+		return errors.New("--oidc-issuer and --htpasswd can't be combined")
+	}
+	if oidcRedirectURL != "" {
+		u, err := url.Parse(oidcRedirectURL)
+		if err != nil || !u.IsAbs() || !strings.HasSuffix(u.Path, oidcCallbackPath) {
+			return fmt.Errorf("--oidc-redirect-url must be an absolute URL ending in %s", oidcCallbackPath)
+		}
+	}
+	return nil
+}
+
+// newOIDCAuth discovers the issuer's endpoints. With an empty redirectURL the
+// callback URL is derived from each request's host.
+func newOIDCAuth(ctx context.Context, issuer, clientID, clientSecret, redirectURL string, tokens []tokenRoutes) (*oidcAuth, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &oidcAuth{
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier:  provider.Verifier(&oidc.Config{ClientID: clientID}),
+		tokens:    tokens,
+		cookieKey: key,
+	}, nil
+}
+
+// middleware serves the callback and logout paths and lets requests through
+// that are logged in or pass without a login. Browsers navigating to a page
+// are sent to the identity provider, everything else gets 401.
+func (a *oidcAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case oidcCallbackPath:
+			a.handleCallback(w, r)
+			return
+		case oidcLogoutPath:
+			a.clearCookie(w, r, loginCookieName)
+			http.Redirect(w, r, basePath, http.StatusFound)
+			return
+		}
+		if passesWithoutLogin(r, a.tokens) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var session oidcSession
+		if cookie, err := r.Cookie(loginCookieName); err == nil && a.openCookie(loginCookieName, cookie.Value, &session) &&
+			session.Subject != "" && time.Now().Unix() < session.Expires {
+			next.ServeHTTP(w, withLoginUser(r, session.Subject))
+			return
+		}
+
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			a.startLogin(w, r)
+			return
+		}
+		writeJSONError(w, http.StatusUnauthorized, "login required")
+	})
+}
+
+// startLogin sends the browser to the identity provider, remembering in the
+// state cookie where it was going
+func (a *oidcAuth) startLogin(w http.ResponseWriter, r *http.Request) {
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: oauth2.GenerateVerifier(),
+		ReturnTo: basePath + strings.TrimPrefix(r.URL.Path, "/"),
+		Expires:  time.Now().Add(oidcLoginTTL).Unix(),
+	}
+	if r.URL.RawQuery != "" {
+		login.ReturnTo += "?" + r.URL.RawQuery
+	}
+	a.setCookie(w, r, oidcStateCookieName, a.sealCookie(oidcStateCookieName, login), oidcLoginTTL)
+
+	config := a.config(r)
+	http.Redirect(w, r, config.AuthCodeURL(login.State, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier)), http.StatusFound)
+}
+
+// handleCallback redeems the authorization code the identity provider sent
+// the browser back with, verifies the ID token and logs the browser in
+func (a *oidcAuth) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || !a.openCookie(oidcStateCookieName, cookie.Value, &login) || time.Now().Unix() >= login.Expires {
+		writeJSONError(w, http.StatusBadRequest, "login expired, please try again")
+		return
+	}
+	a.clearCookie(w, r, oidcStateCookieName)
+	if r.URL.Query().Get("state") != login.State {
+		writeJSONError(w, http.StatusBadRequest, "login state mismatch")
+		return
+	}
+	if reason := r.URL.Query().Get("error"); reason != "" {
+		slog.Warn("Identity provider refused login",
+			"error", reason,
+			"description", r.URL.Query().Get("error_description"))
+		writeJSONError(w, http.StatusForbidden, "login refused by the identity provider")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), oidcExchangeTimeout)
+	defer cancel()
+	config := a.config(r)
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		slog.Warn("Failed to redeem OIDC authorization code", "error", err)
+		writeJSONError(w, http.StatusBadGateway, "login failed")
+		return
+	}
+	idToken, err := a.verifyIDToken(ctx, token, login.Nonce)
+	if err != nil {
+		slog.Warn("Rejected OIDC ID token", "error", err)
+		writeJSONError(w, http.StatusForbidden, "login failed")
+		return
+	}
+
+	session := oidcSession{Subject: idToken.Subject, Expires: time.Now().Add(oidcSessionTTL).Unix()}
+	a.setCookie(w, r, loginCookieName, a.sealCookie(loginCookieName, session), oidcSessionTTL)
+	slog.Info("User logged in", "subject", idToken.Subject)
+
+	returnTo := login.ReturnTo
+	// Only back to this server
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		returnTo = basePath
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+func (a *oidcAuth) verifyIDToken(ctx context.Context, token *oauth2.Token, nonce string) (*oidc.IDToken, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+	idToken, err := a.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(idToken.Nonce), []byte(nonce)) {
+		return nil, errors.New("nonce mismatch")
+	}
+	if idToken.Subject == "" {
+		return nil, errors.New("no subject")
+	}
+	return idToken, nil
+}
+
+// config returns the OAuth2 configuration for the request, with the callback
+// on the request's host unless --oidc-redirect-url is set
+func (a *oidcAuth) config(r *http.Request) oauth2.Config {
+	config := a.oauth
+	if config.RedirectURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		config.RedirectURL = fmt.Sprintf("%s://%s%s%s", scheme, r.Host, strings.TrimSuffix(basePath, "/"), oidcCallbackPath)
+	}
+	return config
+}
+
+// sealCookie encodes v as JSON with an HMAC of it and the cookie's name, so
+// the state cookie anyone gets can't be passed off as a login
+func (a *oidcAuth) sealCookie(name string, v any) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(a.cookieMAC(name, data))
+}
+
+func (a *oidcAuth) cookieMAC(name string, data []byte) []byte {
+	mac := hmac.New(sha256.New, a.cookieKey)
+	mac.Write([]byte(name + "\x00"))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// openCookie decodes a value of sealCookie for the cookie name into v,
+// reporting whether its HMAC is valid
+func (a *oidcAuth) openCookie(name, value string, v any) bool {
+	encoded, sum, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	data, err1 := base64.RawURLEncoding.DecodeString(encoded)
+	got, err2 := base64.RawURLEncoding.DecodeString(sum)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	if !hmac.Equal(got, a.cookieMAC(name, data)) {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func (a *oidcAuth) setCookie(w http.ResponseWriter, r *http.Request, name, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     basePath,
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(a.oauth.RedirectURL, "https://"),
+		// Lax, so the cookies come along when the identity provider sends the
+		// browser back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *oidcAuth) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	a.setCookie(w, r, name, "", -time.Second)
+}
+
+// randomToken returns 32 random bytes, base64 encoded for URLs
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
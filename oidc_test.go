@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestOIDCAuth() *oidcAuth {
+	return &oidcAuth{
+		tokens:    newLoginTokens(newLiveToken("upload-secret"), newLiveToken("admin-secret")),
+		cookieKey: []byte("0123456789abcdef0123456789abcdef"),
+	}
+}
+
+// serveOIDC runs the request through the middleware, returning the status and
+// the user the next handler saw
+func serveOIDC(a *oidcAuth, r *http.Request) (int, string) {
+	var user string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = loginUser(r)
+		w.WriteHeader(http.StatusOK)
+	})
+	w := httptest.NewRecorder()
+	a.middleware(next).ServeHTTP(w, r)
+	return w.Code, user
+}
+
+func TestOIDCUploadTokenCantListFiles(t *testing.T) {
+	a := newTestOIDCAuth()
+	r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+	r.Header.Set("Authorization", "Bearer upload-secret")
+	if status, _ := serveOIDC(a, r); status != http.StatusUnauthorized {
+		t.Errorf("GET /api/files with the upload token = %d, want 401", status)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/files/", nil)
+	r.Header.Set("Authorization", "Bearer upload-secret")
+	if status, _ := serveOIDC(a, r); status != http.StatusOK {
+		t.Errorf("POST /files/ with the upload token = %d, want 200", status)
+	}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	a := newTestOIDCAuth()
+	login := a.sealCookie(loginCookieName, oidcSession{Subject: "user-42", Expires: time.Now().Add(time.Hour).Unix()})
+	r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+	r.AddCookie(&http.Cookie{Name: loginCookieName, Value: login})
+	if status, user := serveOIDC(a, r); status != http.StatusOK || user != "user-42" {
+		t.Errorf("logged in request = %d as %q, want 200 as user-42", status, user)
+	}
+
+	expired := a.sealCookie(loginCookieName, oidcSession{Subject: "user-42", Expires: time.Now().Add(-time.Second).Unix()})
+	r = httptest.NewRequest(http.MethodGet, "/api/files", nil)
+	r.AddCookie(&http.Cookie{Name: loginCookieName, Value: expired})
+	if status, _ := serveOIDC(a, r); status != http.StatusUnauthorized {
+		t.Errorf("expired login = %d, want 401", status)
+	}
+
+	// A state cookie is sealed for its own name and isn't a login
+	state := a.sealCookie(oidcStateCookieName, oidcLogin{State: "x", Expires: time.Now().Add(time.Hour).Unix()})
+	r = httptest.NewRequest(http.MethodGet, "/api/files", nil)
+	r.AddCookie(&http.Cookie{Name: loginCookieName, Value: state})
+	if status, _ := serveOIDC(a, r); status != http.StatusUnauthorized {
+		t.Errorf("state cookie as login = %d, want 401", status)
+	}
+}
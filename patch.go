@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// filePatcher overwrites byte ranges of finished uploads in place, e.g. to fix
+// a corrupt segment without uploading the whole file again. What is recorded
+// about the content is updated along with it: the checksum attribute, the
+// receipt, the manifest's checksum and the filename sidecar.
+type filePatcher struct {
+	roots    storageRoots
+	receipts *receiptSigner
+	manifest *fileManifest
+
+	// locks serializes patches to the same file
+	locks sync.Map
+}
+
+func newFilePatcher(roots storageRoots, receipts *receiptSigner, manifest *fileManifest) *filePatcher {
+	return &filePatcher{roots: roots, receipts: receipts, manifest: manifest}
+}
+
+func (p *filePatcher) lock(name string) func() {
+	mu, _ := p.locks.LoadOrStore(name, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// handlePatch serves PATCH /api/files/{name...} with a Content-Range header
+// naming the bytes in the body. The range must lie within the file, whose total
+// size has to match; files can't grow this way.
+func (p *filePatcher) handlePatch(w http.ResponseWriter, r *http.Request) {
+	name := cleanFolderPath(r.PathValue("name"))
+	root, ok := p.roots.locate(name)
+	if name == "." || !ok || isUploadBookkeeping(root.root.FS(), name) {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	first, last, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Content-Range must be bytes first-last/size")
+		return
+	}
+
+	defer p.lock(name)()
+
+	f, err := root.root.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	if total != info.Size() || first < 0 || last < first || last >= info.Size() {
+		writeJSONError(w, http.StatusRequestedRangeNotSatisfiable, "range is outside the file")
+		return
+	}
+
+	length := last - first + 1
+	n, err := io.Copy(io.NewOffsetWriter(f, first), io.LimitReader(r.Body, length))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		slog.Error("Failed to patch file",
+			"name", name,
+			"first", first,
+			"last", last,
+			"error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to write range")
+		return
+	}
+	if n != length {
+		slog.Warn("File patch body shorter than Content-Range",
+			"name", name,
+			"first", first,
+			"written", n)
+		writeJSONError(w, http.StatusBadRequest, "body is shorter than Content-Range")
+		return
+	}
+
+	slog.Info("File patched",
+		"name", name,
+		"first", first,
+		"last", last)
+
+	filePath := filepath.Join(root.dir, filepath.FromSlash(name))
+	if useXattr {
+		if err := updateChecksumXattr(filePath); err != nil {
+			slog.Warn("Failed to update checksum attribute after patch",
+				"name", name,
+				"error", err)
+		}
+	}
+	p.receipts.rewrite(filePath)
+	markUploadPatched(filePath)
+	if p.manifest != nil {
+		p.manifest.forget(name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
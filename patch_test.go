@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPatcher serves PATCH /api/files for a single storage dir holding
+// report.txt, published under another name than uploaded and with a receipt
+func newTestPatcher(t *testing.T, receipts *receiptSigner) (dir string, manifest *fileManifest, mux *http.ServeMux) {
+	t.Helper()
+	dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeUploadMeta(dir, "report.txt", "report?.txt", "upload-id")
+	newReceiptSigner([]byte("key")).write(dir, "report.txt", "report?.txt", "upload-id")
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	manifest = newFileManifest(root.FS())
+	patcher := newFilePatcher(storageRoots{{dir: dir, root: root}}, receipts, manifest)
+	mux = http.NewServeMux()
+	mux.HandleFunc("PATCH /api/files/{name...}", patcher.handlePatch)
+	return dir, manifest, mux
+}
+
+func patchFile(mux http.Handler, contentRange, body string) int {
+	r := httptest.NewRequest(http.MethodPatch, "/api/files/report.txt", strings.NewReader(body))
+	r.Header.Set("Content-Range", contentRange)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+func manifestSHA256(t *testing.T, manifest *fileManifest) string {
+	t.Helper()
+	page, err := manifest.page("", 10)
+	if err != nil || len(page.Files) != 1 {
+		t.Fatalf("manifest has %v (%v), want report.txt", page.Files, err)
+	}
+	return page.Files[0].SHA256
+}
+
+func TestPatchFileUpdatesRecords(t *testing.T) {
+	key := []byte("key")
+	dir, manifest, mux := newTestPatcher(t, newReceiptSigner(key))
+	path := filepath.Join(dir, "report.txt")
+	before := manifestSHA256(t, manifest)
+
+	if code := patchFile(mux, "bytes 2-4/10", "abc"); code != http.StatusNoContent {
+		t.Fatalf("PATCH: status %d, want 204", code)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "01abc56789" {
+		t.Errorf("patched file holds %q", data)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path + receiptSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := verifyReceipt(key, data)
+	if err != nil {
+		t.Fatalf("rewritten receipt: %v", err)
+	}
+	if receipt.SHA256 != sum || receipt.Size != 10 || receipt.PatchedAt.IsZero() || receipt.UploadID != "upload-id" {
+		t.Errorf("rewritten receipt is %+v, want the patched content's checksum", receipt)
+	}
+
+	var meta uploadMeta
+	data, _ = os.ReadFile(path + metaSuffix)
+	if err := json.Unmarshal(data, &meta); err != nil || meta.PatchedAt.IsZero() || meta.OriginalFilename != "report?.txt" {
+		t.Errorf("sidecar after patch is %+v (%v), want it marked patched", meta, err)
+	}
+
+	if got := manifestSHA256(t, manifest); got == before || got != sum {
+		t.Errorf("manifest lists sha256 %s after the patch, want %s", got, sum)
+	}
+}
+
+func TestPatchFileWithoutReceiptKeyRemovesReceipt(t *testing.T) {
+	dir, _, mux := newTestPatcher(t, nil)
+	if code := patchFile(mux, "bytes 0-0/10", "x"); code != http.StatusNoContent {
+		t.Fatalf("PATCH: status %d, want 204", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "report.txt"+receiptSuffix)); !os.IsNotExist(err) {
+		t.Errorf("receipt of the old content is still there (%v)", err)
+	}
+}
+
+func TestPatchFileRanges(t *testing.T) {
+	tests := []struct {
+		name, contentRange, body string
+		wantCode                 int
+		want                     string
+	}{
+		{"first byte", "bytes 0-0/10", "x", http.StatusNoContent, "x123456789"},
+		{"last byte", "bytes 9-9/10", "x", http.StatusNoContent, "012345678x"},
+		{"whole file", "bytes 0-9/10", "abcdefghij", http.StatusNoContent, "abcdefghij"},
+		{"past the end", "bytes 8-10/10", "xyz", http.StatusRequestedRangeNotSatisfiable, "0123456789"},
+		{"beyond the file", "bytes 10-11/12", "xy", http.StatusRequestedRangeNotSatisfiable, "0123456789"},
+		{"other size", "bytes 0-1/20", "xy", http.StatusRequestedRangeNotSatisfiable, "0123456789"},
+		{"negative start", "bytes -1-1/10", "xyz", http.StatusRequestedRangeNotSatisfiable, "0123456789"},
+		{"reversed", "bytes 5-2/10", "x", http.StatusRequestedRangeNotSatisfiable, "0123456789"},
+		{"malformed", "2-4", "abc", http.StatusBadRequest, "0123456789"},
+		{"short body", "bytes 2-4/10", "a", http.StatusBadRequest, "01a3456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, _, mux := newTestPatcher(t, nil)
+			if code := patchFile(mux, tt.contentRange, tt.body); code != tt.wantCode {
+				t.Errorf("PATCH %s: status %d, want %d", tt.contentRange, code, tt.wantCode)
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, "report.txt")); string(data) != tt.want {
+				t.Errorf("file holds %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPostHookOutput is how much of a hook's output is kept for the log
+const maxPostHookOutput = 16 << 10
+
+// postHook runs an external command, e.g. a virus scanner or an image
+// optimizer, on every published upload. Hooks run as background jobs, at most
+// concurrency at a time; the others wait for a slot.
+type postHook struct {
+	command  string
+	timeout  time.Duration
+	required bool
+	slots    chan struct{}
+	jobs     *jobRegistry
+}
+
+func newPostHook(command string, timeout time.Duration, required bool, concurrency int, jobs *jobRegistry) *postHook {
+	return &postHook{
+		command:  command,
+		timeout:  timeout,
+		required: required,
+		slots:    make(chan struct{}, concurrency),
+		jobs:     jobs,
+	}
+}
+
+// postHookUpload describes the published upload to the hook
+type postHookUpload struct {
+	path             string
+	filename         string
+	originalFilename string
+	uploadID         string
+	size             int64
+}
+
+// run starts the hook for the upload and calls then once it succeeded, so the
+// steps after publishing see the file as the hook left it. A failing hook only
+// holds them back with --post-hook-required, which quarantines the file.
+func (h *postHook) run(upload postHookUpload, then func()) {
+	j := h.jobs.start("post-hook", func(ctx context.Context, j *job) error {
+		select {
+		case h.slots <- struct{}{}:
+			defer func() { <-h.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		j.setProgress(0, "running "+h.command)
+
+		err := h.exec(ctx, upload)
+		if err != nil && h.required {
+			quarantineFile(upload.path)
+			os.Remove(upload.path + metaSuffix)
+			return err
+		}
+		then()
+		return err
+	})
+	slog.Debug("Running post hook",
+		"upload_id", upload.uploadID,
+		"path", upload.path,
+		"job_id", j.id)
+}
+
+func (h *postHook) exec(ctx context.Context, upload postHookUpload) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.command, upload.path)
+	cmd.Env = append(os.Environ(),
+		"SU_UPLOAD_ID="+upload.uploadID,
+		"SU_FILENAME="+upload.filename,
+		"SU_ORIGINAL_FILENAME="+upload.originalFilename,
+		"SU_SIZE="+strconv.FormatInt(upload.size, 10),
+	)
+	output := &headBuffer{limit: maxPostHookOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	started := time.Now()
+	err := cmd.Run()
+	if err != nil {
+		slog.Error("Post hook failed",
+			"upload_id", upload.uploadID,
+			"path", upload.path,
+			"command", h.command,
+			"output", strings.TrimSpace(output.String()),
+			"required", h.required,
+			"error", err)
+		return fmt.Errorf("%s: %w", h.command, err)
+	}
+	slog.Info("Post hook finished",
+		"upload_id", upload.uploadID,
+		"path", upload.path,
+		"output", strings.TrimSpace(output.String()),
+		"duration", time.Since(started))
+	return nil
+}
+
+// headBuffer keeps the first limit bytes written to it and discards the rest
+type headBuffer struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (b *headBuffer) String() string {
+	return b.buf.String()
+}
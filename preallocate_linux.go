@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNoSpace is the error reported when the filesystem is out of space
+var errNoSpace = unix.ENOSPC
+
+// preallocateFile reserves size bytes of disk space for the file at path.
+// FALLOC_FL_KEEP_SIZE keeps the apparent file size unchanged, which matters
+// because the filestore derives the upload offset from the file size.
+func preallocateFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for {
+		err = unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errNoSpace is the error reported when the filesystem is out of space
+var errNoSpace = syscall.ENOSPC
+
+// preallocateFile is not available outside Linux, callers fall back to
+// allocating blocks as data arrives
+func preallocateFile(path string, size int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/prometheuscollector"
+)
+
+// prometheusMetrics serves /metrics: tusd's own request and upload counters,
+// plus what happens to uploads after tusd considers them finished
+type prometheusMetrics struct {
+	registry       *prometheus.Registry
+	completed      prometheus.Counter
+	bytesStored    prometheus.Counter
+	quarantined    prometheus.Counter
+	rejected       prometheus.Counter
+	renameFailures prometheus.Counter
+}
+
+func newPrometheusMetrics(handler *tusd.Handler) *prometheusMetrics {
+	m := &prometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		completed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "simple_upload_uploads_completed_total",
+			Help: "Number of completed uploads published under their final name, not counting the parts of concatenated uploads.",
+		}),
+		bytesStored: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "simple_upload_bytes_stored_total",
+			Help: "Total size of the published uploads in bytes.",
+		}),
+		quarantined: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "simple_upload_uploads_quarantined_total",
+			Help: "Number of completed uploads quarantined for failing the size, content type or checksum check.",
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "simple_upload_uploads_rejected_total",
+			Help: "Number of completed uploads not published: removed as empty, or kept under their upload ID without a filename or because the name is taken.",
+		}),
+		renameFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "simple_upload_rename_failures_total",
+			Help: "Number of completed uploads that could not be published under their final name.",
+		}),
+	}
+
+	// tusd's counters only ever grow, so the difference is what was created
+	// since the start and has neither finished nor been terminated yet
+	tusdMetrics := handler.Metrics
+	inProgress := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "simple_upload_uploads_in_progress",
+		Help: "Number of uploads created since the server started that have neither finished nor been terminated.",
+	}, func() float64 {
+		created := atomic.LoadUint64(tusdMetrics.UploadsCreated)
+		done := atomic.LoadUint64(tusdMetrics.UploadsFinished) + atomic.LoadUint64(tusdMetrics.UploadsTerminated)
+		// Finished uploads can be terminated as well
+		return max(0, float64(created)-float64(done))
+	})
+
+	m.registry.MustRegister(
+		prometheuscollector.New(tusdMetrics),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.completed,
+		m.bytesStored,
+		m.quarantined,
+		m.rejected,
+		m.renameFailures,
+		inProgress,
+	)
+	return m
+}
+
+// uploadFinalized counts an upload once finalizeUpload returned outcome and
+// publishErr
+func (m *prometheusMetrics) uploadFinalized(info tusd.FileInfo, outcome finalizeOutcome, publishErr error) {
+	if info.IsPartial {
+		return
+	}
+	switch {
+	case publishErr != nil:
+		m.renameFailures.Inc()
+	case outcome == uploadPublished:
+		m.completed.Inc()
+		m.bytesStored.Add(float64(info.Size))
+	case outcome == uploadQuarantined:
+		m.quarantined.Inc()
+	default:
+		m.rejected.Inc()
+	}
+}
+
+// watchWebhooks adds the depth of the webhook queue
+func (m *prometheusMetrics) watchWebhooks(n *webhookNotifier) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "simple_upload_webhooks_pending",
+			Help: "Number of webhooks waiting to be delivered.",
+		}, func() float64 {
+			pending, _ := n.depth()
+			return float64(pending)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "simple_upload_webhooks_failed",
+			Help: "Number of webhooks that failed all attempts, listed by /api/webhooks/failed.",
+		}, func() float64 {
+			_, failed := n.depth()
+			return float64(failed)
+		}),
+	)
+}
+
+func (m *prometheusMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
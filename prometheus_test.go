@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/filestore"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	xslog "golang.org/x/exp/slog"
+)
+
+// scrapeMetrics returns the /metrics text of the handler
+func scrapeMetrics(t *testing.T, h http.Handler) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+// waitForMetric scrapes until the metrics contain line, failing after a second
+func waitForMetric(t *testing.T, h http.Handler, line string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		metrics := scrapeMetrics(t, h)
+		if strings.Contains(metrics, "\n"+line+"\n") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics lack %q:\n%s", line, metrics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// uploadFile creates an upload carrying its whole body
+func uploadFile(t *testing.T, h http.Handler, body string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/files/", strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", "1.0.0")
+	r.Header.Set("Upload-Length", "5")
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Metadata", "filename cmVwb3J0LnR4dA==")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		body, _ := io.ReadAll(w.Body)
+		t.Fatalf("POST /files/ = %d: %s", w.Code, body)
+	}
+}
+
+func TestPrometheusMetricsCountUploads(t *testing.T) {
+	composer := tusd.NewStoreComposer()
+	filestore.New(t.TempDir()).UseIn(composer)
+	handler, err := tusd.NewHandler(tusd.Config{
+		BasePath:              "/files/",
+		StoreComposer:         composer,
+		NotifyCompleteUploads: true,
+		Logger:                xslog.New(xslog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prom := newPrometheusMetrics(handler)
+
+	outcomes := make(chan finalizeOutcome, 1)
+	finalize := func(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+		outcome := <-outcomes
+		if outcome == -1 {
+			return uploadKept, errors.New("disk full")
+		}
+		return outcome, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleCompletedUploads(ctx, handler, nil, finalize, nil, prom, nil)
+
+	uploads := http.StripPrefix("/files/", handler)
+	metrics := prom.handler()
+	waitForMetric(t, metrics, "simple_upload_uploads_completed_total 0")
+
+	outcomes <- uploadPublished
+	uploadFile(t, uploads, "hello")
+	waitForMetric(t, metrics, "simple_upload_uploads_completed_total 1")
+	waitForMetric(t, metrics, "simple_upload_bytes_stored_total 5")
+	waitForMetric(t, metrics, "simple_upload_uploads_in_progress 0")
+
+	outcomes <- -1
+	uploadFile(t, uploads, "world")
+	waitForMetric(t, metrics, "simple_upload_rename_failures_total 1")
+
+	// Only published uploads count as completed, with their bytes
+	outcomes <- uploadQuarantined
+	uploadFile(t, uploads, "wrong")
+	waitForMetric(t, metrics, "simple_upload_uploads_quarantined_total 1")
+	for _, outcome := range []finalizeOutcome{uploadKept, uploadRemoved} {
+		outcomes <- outcome
+		uploadFile(t, uploads, "taken")
+	}
+	waitForMetric(t, metrics, "simple_upload_uploads_rejected_total 2")
+	waitForMetric(t, metrics, "simple_upload_uploads_completed_total 1")
+	waitForMetric(t, metrics, "simple_upload_bytes_stored_total 5")
+	if metrics := scrapeMetrics(t, metrics); !strings.Contains(metrics, "tusd_uploads_finished ") {
+		t.Errorf("tusd's metrics are missing:\n%s", metrics)
+	}
+}
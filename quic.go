@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicOptions tune the HTTP/3 listener for the network it runs in, e.g. a
+// longer idle timeout on high-latency links where large uploads stall briefly
+type quicOptions struct {
+	idleTimeout  time.Duration
+	maxStreams   int64
+	altSvcMaxAge time.Duration
+}
+
+func (o quicOptions) validate() error {
+	if o.idleTimeout < time.Second || o.idleTimeout > time.Hour {
+		return fmt.Errorf("--quic-idle-timeout must be between 1s and 1h, got %s", o.idleTimeout)
+	}
+	if o.maxStreams < 1 || o.maxStreams > 10000 {
+		return fmt.Errorf("--quic-max-streams must be between 1 and 10000, got %d", o.maxStreams)
+	}
+	if o.altSvcMaxAge < time.Second || o.altSvcMaxAge > 30*24*time.Hour {
+		return fmt.Errorf("--alt-svc-max-age must be between 1s and 720h, got %s", o.altSvcMaxAge)
+	}
+	return nil
+}
+
+func (o quicOptions) config() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     o.idleTimeout,
+		MaxIncomingStreams: o.maxStreams,
+	}
+}
+
+// altSvc is the Alt-Svc value advertising HTTP/3 on port, cached by clients
+// for the max age
+func (o quicOptions) altSvc(port int) string {
+	return fmt.Sprintf(`h3=":%d"; ma=%d`, port, int(o.altSvcMaxAge.Seconds()))
+}
+
+// quicConns counts the open HTTP/3 connections, so the shutdown can log how
+// many it drained
+type quicConns struct {
+	open atomic.Int64
+}
+
+// connContext is the http3.Server's ConnContext, counting the connection until
+// it is closed
+func (c *quicConns) connContext(ctx context.Context, conn *quic.Conn) context.Context {
+	c.open.Add(1)
+	context.AfterFunc(conn.Context(), func() { c.open.Add(-1) })
+	return ctx
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	// quotaRescanInterval is how often the quota's total is recounted from the
+	// uploads dir, picking up files removed or changed outside the server
+	quotaRescanInterval = 10 * time.Minute
+
+	// quotaReservationGrace is how long a reservation waits for tusd to create
+	// the upload, after which a later pre-create hook or the store refused it
+	quotaReservationGrace = time.Minute
+
+	// quotaWarningHysteresis is how many percentage points the stored bytes
+	// have to fall below a --quota-warn-at threshold before it warns again
+	quotaWarningHysteresis = 5
+)
+
+var errQuotaExceeded = tusd.NewError("ERR_QUOTA_EXCEEDED", "the server's storage quota is used up", http.StatusInsufficientStorage)
+
+// storageQuota caps the bytes stored in the uploads dir and the --route-by-ext
+// directories. The total is what was on disk at the last scan and the uploads
+// finished since, plus the declared bytes unfinished uploads haven't sent yet,
+// reserved when they are created so uploads running at once can't overrun the
+// quota together.
+type storageQuota struct {
+	// dirs are the storage directories, the uploads dir first
+	dirs  []string
+	store *fileStore
+	limit int64
+
+	mu       sync.Mutex
+	stored   int64
+	reserved map[string]quotaReservation
+	warnings *quotaWarnings
+}
+
+type quotaReservation struct {
+	// bytes is the declared length minus written, zero for deferred lengths
+	bytes int64
+	// written is what the upload had on disk at the last scan, and so is in
+	// stored already
+	written int64
+	created bool
+	at      time.Time
+}
+
+func newStorageQuota(dirs []string, store *fileStore, limit int64) (*storageQuota, error) {
+	q := &storageQuota{dirs: dirs, store: store, limit: limit}
+	if err := q.scan(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(quotaRescanInterval) {
+			if err := q.scan(); err != nil {
+				slog.Warn("Failed to recount stored bytes for --max-total-size", "error", err)
+			}
+		}
+	}()
+	return q, nil
+}
+
+// scan recounts the bytes of every file in the storage directories and the
+// bytes the unfinished uploads still have to send
+func (q *storageQuota) scan() error {
+	started := time.Now()
+	var stored int64
+	for _, dir := range q.dirs {
+		err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if p != dir && os.IsNotExist(err) {
+					// Removed since its directory was read
+					return nil
+				}
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				stored += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Unfinished uploads are in the uploads dir
+	reserved := make(map[string]quotaReservation)
+	infos, _ := filepath.Glob(filepath.Join(q.dirs[0], "*.info"))
+	for _, infoPath := range infos {
+		id := strings.TrimSuffix(filepath.Base(infoPath), ".info")
+		upload, err := q.store.GetUpload(context.Background(), id)
+		if err != nil {
+			continue
+		}
+		info, err := upload.GetInfo(context.Background())
+		// A sparse upload can have its full size before every range arrived
+		if err != nil || info.Storage[sparseRangesKey] == "" && !info.SizeIsDeferred && info.Offset >= info.Size {
+			continue
+		}
+		r := quotaReservation{written: info.Offset, created: true, at: started}
+		if !info.SizeIsDeferred {
+			r.bytes = info.Size - info.Offset
+		}
+		reserved[id] = r
+	}
+
+	defer q.checkWarnings()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Uploads created during the scan may have been missed by it
+	for id, r := range q.reserved {
+		if _, ok := reserved[id]; !ok && r.at.After(started) {
+			reserved[id] = r
+		}
+	}
+	q.stored = stored
+	q.reserved = reserved
+	slog.Debug("Counted stored bytes for --max-total-size",
+		"stored", stored,
+		"unfinished_uploads", len(reserved),
+		"max_total_size", q.limit)
+	return nil
+}
+
+// check is the pre-create hook rejecting uploads that don't fit into the
+// quota with 507. It reserves the declared length under the upload's ID,
+// which it assigns for that if no earlier hook did.
+func (q *storageQuota) check(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	// A concatenated upload takes the place of its partial uploads, which are
+	// counted already
+	if hook.Upload.IsFinal {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+	}
+	var changes tusd.FileInfoChanges
+	id := hook.Upload.ID
+	if id == "" {
+		id = q.store.newUploadID()
+		changes.ID = id
+	}
+	var size int64
+	if !hook.Upload.SizeIsDeferred {
+		size = hook.Upload.Size
+	}
+
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	total := q.stored
+	for rid, r := range q.reserved {
+		if !r.created && now.Sub(r.at) > quotaReservationGrace {
+			delete(q.reserved, rid)
+			continue
+		}
+		total += r.bytes
+	}
+	if size > q.limit-total {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, errQuotaExceeded
+	}
+	q.reserved[id] = quotaReservation{bytes: size, at: now}
+	return tusd.HTTPResponse{}, changes, nil
+}
+
+// created confirms the reservation, tusd stored the upload
+func (q *storageQuota) created(event tusd.HookEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if r, ok := q.reserved[event.Upload.ID]; ok {
+		r.created = true
+		q.reserved[event.Upload.ID] = r
+	}
+}
+
+// completed turns the reservation into stored bytes. The file stays in one of
+// the storage directories whether it was published, kept under its ID or
+// quarantined.
+func (q *storageQuota) completed(event tusd.HookEvent) {
+	defer q.checkWarnings()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r := q.reserved[event.Upload.ID]
+	delete(q.reserved, event.Upload.ID)
+	if !event.Upload.IsFinal {
+		q.stored += event.Upload.Size - r.written
+	}
+}
+
+// terminated releases the bytes of an upload removed before it finished. Files
+// removed by --upload-expiry or outside the server are released by the next
+// scan.
+func (q *storageQuota) terminated(event tusd.HookEvent) {
+	defer q.checkWarnings()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stored -= q.reserved[event.Upload.ID].written
+	delete(q.reserved, event.Upload.ID)
+}
+
+// watchWarnings warns when the stored bytes cross the thresholds, percentages
+// of the quota, passing the warnings to send if not nil
+func (q *storageQuota) watchWarnings(thresholds []int, send func(quotaWarningEvent)) {
+	q.mu.Lock()
+	q.warnings = newQuotaWarnings(thresholds, q.limit, send)
+	q.mu.Unlock()
+	q.checkWarnings()
+}
+
+// checkWarnings passes the stored bytes on to the warnings, outside q.mu
+func (q *storageQuota) checkWarnings() {
+	q.mu.Lock()
+	stored, warnings := q.stored, q.warnings
+	q.mu.Unlock()
+	if warnings != nil {
+		warnings.observe(stored)
+	}
+}
+
+// validateQuotaWarnings checks the --quota-warn-at percentages
+func validateQuotaWarnings(thresholds []int, limit int64) error {
+	if len(thresholds) == 0 {
+		return nil
+	}
+	if limit <= 0 {
+		return errors.New("needs --max-total-size")
+	}
+	for _, t := range thresholds {
+		if t < 1 || t > 100 {
+			return fmt.Errorf("%d is not a percentage between 1 and 100", t)
+		}
+	}
+	return nil
+}
+
+// quotaWarningEvent is the webhook body of a crossed --quota-warn-at threshold
+type quotaWarningEvent struct {
+	ThresholdPercent int       `json:"threshold_percent"`
+	Stored           int64     `json:"stored"`
+	MaxTotalSize     int64     `json:"max_total_size"`
+	At               time.Time `json:"at"`
+}
+
+// quotaWarnings warns once when the stored bytes rise above a threshold. Only
+// once they fell quotaWarningHysteresis points below it, crossing it warns
+// again, so usage hovering around a threshold doesn't warn with every upload.
+// Crossing several thresholds at once warns about the highest.
+type quotaWarnings struct {
+	// thresholds are ascending percentages of limit
+	thresholds []int
+	limit      int64
+	send       func(quotaWarningEvent)
+
+	mu sync.Mutex
+	// level is how many of the thresholds were warned about
+	level int
+}
+
+func newQuotaWarnings(thresholds []int, limit int64, send func(quotaWarningEvent)) *quotaWarnings {
+	thresholds = slices.Clone(thresholds)
+	slices.Sort(thresholds)
+	return &quotaWarnings{thresholds: slices.Compact(thresholds), limit: limit, send: send}
+}
+
+func (w *quotaWarnings) observe(stored int64) {
+	percent := float64(stored) * 100 / float64(w.limit)
+
+	w.mu.Lock()
+	level := w.level
+	for level < len(w.thresholds) && percent >= float64(w.thresholds[level]) {
+		level++
+	}
+	for level > 0 && percent < float64(w.thresholds[level-1]-quotaWarningHysteresis) {
+		level--
+	}
+	raised := level > w.level
+	w.level = level
+	w.mu.Unlock()
+	if !raised {
+		return
+	}
+
+	event := quotaWarningEvent{
+		ThresholdPercent: w.thresholds[level-1],
+		Stored:           stored,
+		MaxTotalSize:     w.limit,
+		At:               time.Now().UTC().Truncate(time.Second),
+	}
+	slog.Warn("Stored bytes crossed a --quota-warn-at threshold",
+		"threshold_percent", event.ThresholdPercent,
+		"stored", stored,
+		"max_total_size", w.limit)
+	if w.send != nil {
+		w.send(event)
+	}
+}
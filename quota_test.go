@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestQuotaWarningsHysteresis(t *testing.T) {
+	var sent []int
+	w := newQuotaWarnings([]int{90, 80}, 1000, func(event quotaWarningEvent) {
+		sent = append(sent, event.ThresholdPercent)
+	})
+
+	steps := []struct {
+		stored int64
+		want   []int
+	}{
+		{500, nil},
+		{810, []int{80}},
+		// Above a threshold already warned about
+		{850, nil},
+		// Within the hysteresis below it
+		{790, nil},
+		{760, nil},
+		{820, nil},
+		{900, []int{90}},
+		{950, nil},
+		// 84% re-arms 90 but not 80
+		{840, nil},
+		{910, []int{90}},
+		{810, nil},
+		// Below both and their hysteresis, re-arming them
+		{700, nil},
+		{800, []int{80}},
+		{600, nil},
+		// Crossing both at once warns about the higher
+		{1000, []int{90}},
+	}
+	for i, step := range steps {
+		sent = nil
+		w.observe(step.stored)
+		if !slices.Equal(sent, step.want) {
+			t.Errorf("step %d: %d of 1000 stored warned %v, want %v", i, step.stored, sent, step.want)
+		}
+	}
+}
+
+func TestStorageQuotaWarnsOnCompletedUploads(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "existing.bin"), make([]byte, 500), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := newStorageQuota([]string{dir}, newFileStore(dir, false, 0, ""), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []quotaWarningEvent
+	q.watchWarnings([]int{80}, func(event quotaWarningEvent) {
+		sent = append(sent, event)
+	})
+	if len(sent) != 0 {
+		t.Fatalf("warned at 50%%: %+v", sent)
+	}
+
+	complete := func(id string, size int64) {
+		upload := tusd.HookEvent{Upload: tusd.FileInfo{ID: id, Size: size}}
+		if _, _, err := q.check(upload); err != nil {
+			t.Fatalf("check %s: %v", id, err)
+		}
+		q.created(upload)
+		q.completed(upload)
+	}
+	complete("a", 200)
+	if len(sent) != 0 {
+		t.Fatalf("warned at 70%%: %+v", sent)
+	}
+	complete("b", 150)
+	if len(sent) != 1 || sent[0].ThresholdPercent != 80 || sent[0].Stored != 850 || sent[0].MaxTotalSize != 1000 {
+		t.Fatalf("warnings at 85%% = %+v, want one for 80%%", sent)
+	}
+	complete("c", 50)
+	if len(sent) != 1 {
+		t.Errorf("warned again at 90%%: %+v", sent)
+	}
+
+	// Rescanning finds the file removed outside the server, and the completed
+	// uploads of this test were never written
+	if err := os.Remove(filepath.Join(dir, "existing.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.scan(); err != nil {
+		t.Fatal(err)
+	}
+	complete("d", 850)
+	if len(sent) != 2 {
+		t.Errorf("no warning after falling to 0%% and rising to 85%% again: %+v", sent)
+	}
+}
+
+func TestStorageQuotaReservesSparseUploads(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileStore(dir, false, 0, "")
+	q, err := newStorageQuota([]string{dir}, store, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSparseUploads(store, chainPreCreateHooks([]preCreateHook{q.check}), []func(tusd.HookEvent){q.created}, nil)
+	mux := sparseMux(s)
+
+	code, created := createSparseUpload(t, mux, `{"filename": "a.bin", "size": 6000}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create: status %d", code)
+	}
+	if code, _ := createSparseUpload(t, mux, `{"filename": "b.bin", "size": 5000}`); code != http.StatusInsufficientStorage {
+		t.Errorf("create beyond the reserved quota: status %d, want 507", code)
+	}
+
+	// The last byte gives the data file its full size, the rescan still has
+	// to count the rest as reserved rather than stored
+	if code := writeSparseRange(mux, created.ID, 5999, "x", 6000); code != http.StatusOK {
+		t.Fatalf("write: status %d", code)
+	}
+	if err := q.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := createSparseUpload(t, mux, `{"filename": "b.bin", "size": 5000}`); code != http.StatusInsufficientStorage {
+		t.Errorf("create beyond the quota after a rescan: status %d, want 507", code)
+	}
+	q.completed(completeSparseUpload(t, s, mux, created.ID, 0, strings.Repeat("x", 5999), 6000))
+	if code, _ := createSparseUpload(t, mux, `{"filename": "c.bin", "size": 3000}`); code != http.StatusCreated {
+		t.Errorf("create within the quota after completing: status %d, want 201 with %d stored", code, q.stored)
+	}
+}
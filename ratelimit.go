@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"golang.org/x/time/rate"
+)
+
+// uploadWindow caps how many uploads the whole server accepts per rolling hour,
+// protecting downstream processing regardless of who uploads
+type uploadWindow struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	created []time.Time
+}
+
+func newUploadWindow(limit int) *uploadWindow {
+	return &uploadWindow{limit: limit, window: time.Hour}
+}
+
+// limitUploads is a pre-create hook counting new uploads. The final upload of a
+// concatenation carries no data of its own and isn't counted.
+func (u *uploadWindow) limitUploads(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+	if hook.Upload.IsFinal {
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	expired := 0
+	for expired < len(u.created) && now.Sub(u.created[expired]) >= u.window {
+		expired++
+	}
+	u.created = u.created[expired:]
+
+	headers := tusd.HTTPHeader{"X-RateLimit-Limit": strconv.Itoa(u.limit)}
+	if len(u.created) >= u.limit {
+		retry := u.window - now.Sub(u.created[0])
+		err := tusd.NewError("ERR_UPLOAD_LIMIT_REACHED", "the server accepts no more uploads this hour", http.StatusTooManyRequests)
+		headers["X-RateLimit-Remaining"] = "0"
+		headers["Retry-After"] = strconv.Itoa(int(math.Ceil(retry.Seconds())))
+		err.HTTPResponse = err.HTTPResponse.MergeWith(tusd.HTTPResponse{Header: headers})
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, err
+	}
+
+	u.created = append(u.created, now)
+	headers["X-RateLimit-Remaining"] = strconv.Itoa(u.limit - len(u.created))
+	return tusd.HTTPResponse{Header: headers}, tusd.FileInfoChanges{}, nil
+}
+
+// clientLimiter throttles upload creation per client IP with a token bucket,
+// so a single client can't flood the uploads dir with new uploads. Only the
+// creation POST is counted, chunks of running uploads are never held up.
+type clientLimiter struct {
+	limit   rate.Limit
+	burst   int
+	proxies []netip.Prefix
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*clientBucket
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiter(limit float64, burst int, proxies []netip.Prefix) *clientLimiter {
+	l := &clientLimiter{
+		limit:   rate.Limit(limit),
+		burst:   burst,
+		proxies: proxies,
+		clients: make(map[netip.Addr]*clientBucket),
+	}
+	// A bucket that had time to fill up again is the same as a new one
+	idle := max(time.Minute, time.Duration(float64(burst)/limit*float64(time.Second)))
+	go func() {
+		for now := range time.Tick(idle) {
+			l.mu.Lock()
+			for addr, bucket := range l.clients {
+				if now.Sub(bucket.lastSeen) >= idle {
+					delete(l.clients, addr)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// parsePrefixes parses lists of networks such as --trusted-proxies, accepting
+// plain addresses as single host prefixes
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR range", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client. Behind one of the trusted
+// proxies that is the last X-Forwarded-For entry not added by a trusted proxy,
+// since clients can put anything in front.
+func clientAddr(r *http.Request, proxies []netip.Prefix) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(remoteHost(r))
+	if err != nil {
+		// With --unix-socket the peer is a reverse proxy on the same host, as
+		// trusted as one in --trusted-proxies
+		if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); !ok {
+			return netip.Addr{}, false
+		}
+	} else if addr = addr.Unmap(); !prefixesContain(proxies, addr) {
+		return addr, true
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !prefixesContain(proxies, addr) {
+			break
+		}
+	}
+	return addr, addr.IsValid()
+}
+
+// allow takes a token from the client's bucket, or returns how long until the
+// next one is available
+func (l *clientLimiter) allow(addr netip.Addr, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.clients[addr]
+	if !ok {
+		bucket = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[addr] = bucket
+	}
+	bucket.lastSeen = now
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func (l *clientLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addr, ok := clientAddr(r, l.proxies)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed, delay := l.allow(addr, time.Now()); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "too many uploads created, try again later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestUploadWindow(t *testing.T) {
+	u := newUploadWindow(2)
+	create := func() (tusd.HTTPResponse, error) {
+		resp, _, err := u.limitUploads(tusd.HookEvent{})
+		return resp, err
+	}
+
+	for _, remaining := range []string{"1", "0"} {
+		resp, err := create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header["X-RateLimit-Limit"] != "2" || resp.Header["X-RateLimit-Remaining"] != remaining {
+			t.Errorf("accepted upload has headers %v, want %s remaining of 2", resp.Header, remaining)
+		}
+	}
+
+	// At the threshold uploads are refused until the oldest one ages out
+	_, err := create()
+	var tusErr tusd.Error
+	if !errors.As(err, &tusErr) || tusErr.HTTPResponse.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("upload over the limit: %v, want 429", err)
+	}
+	if retry, _ := strconv.Atoi(tusErr.HTTPResponse.Header["Retry-After"]); retry < 3599 || retry > 3600 || tusErr.HTTPResponse.Header["X-RateLimit-Remaining"] != "0" {
+		t.Errorf("refusal has headers %v, want Retry-After of an hour", tusErr.HTTPResponse.Header)
+	}
+
+	// The final upload of a concatenation carries no data of its own
+	if _, _, err := u.limitUploads(tusd.HookEvent{Upload: tusd.FileInfo{IsFinal: true}}); err != nil {
+		t.Errorf("final upload at the limit: %v, want it accepted", err)
+	}
+
+	// Once the oldest upload is an hour old its slot is free again, and only it
+	u.mu.Lock()
+	u.created[0] = time.Now().Add(-time.Hour)
+	u.created[1] = time.Now().Add(-59 * time.Minute)
+	u.mu.Unlock()
+	if resp, err := create(); err != nil || resp.Header["X-RateLimit-Remaining"] != "0" {
+		t.Fatalf("upload after the window moved on: %v, %v, want it accepted", resp.Header, err)
+	}
+	_, err = create()
+	if !errors.As(err, &tusErr) {
+		t.Fatalf("second upload after the window moved on: %v, want it refused", err)
+	}
+	if retry, _ := strconv.Atoi(tusErr.HTTPResponse.Header["Retry-After"]); retry < 59 || retry > 60 {
+		t.Errorf("Retry-After is %s, want the minute until the next upload ages out", tusErr.HTTPResponse.Header["Retry-After"])
+	}
+}
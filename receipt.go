@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// receiptSuffix marks the signed receipt stored next to a finished upload
+const receiptSuffix = ".receipt"
+
+// uploadReceipt attests that the server received a file with the given content.
+// Signature is the hex HMAC-SHA256 of the receipt's JSON encoding without it.
+type uploadReceipt struct {
+	Filename         string    `json:"filename"`
+	OriginalFilename string    `json:"original_filename"`
+	UploadID         string    `json:"upload_id"`
+	Size             int64     `json:"size"`
+	SHA256           string    `json:"sha256"`
+	CompletedAt      time.Time `json:"completed_at"`
+	// PatchedAt is set once PATCH /api/files changed the content
+	PatchedAt time.Time `json:"patched_at,omitzero"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// receiptSigner writes signed receipts for finished uploads
+type receiptSigner struct {
+	key []byte
+}
+
+// loadReceiptKey reads an HMAC key from a file, ignoring surrounding whitespace
+func loadReceiptKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+func newReceiptSigner(key []byte) *receiptSigner {
+	return &receiptSigner{key: key}
+}
+
+func signReceipt(key []byte, receipt uploadReceipt) (string, error) {
+	receipt.Signature = ""
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyReceipt parses a receipt and checks its signature against key
+func verifyReceipt(key, data []byte) (uploadReceipt, error) {
+	var receipt uploadReceipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return uploadReceipt{}, fmt.Errorf("invalid receipt: %w", err)
+	}
+	expected, err := signReceipt(key, receipt)
+	if err != nil {
+		return uploadReceipt{}, err
+	}
+	if !hmac.Equal([]byte(receipt.Signature), []byte(expected)) {
+		return uploadReceipt{}, errors.New("receipt signature does not match")
+	}
+	return receipt, nil
+}
+
+// write stores a signed receipt for the finished upload dir/filename
+func (s *receiptSigner) write(dir, filename, originalFilename, uploadID string) {
+	path := filepath.Join(dir, filename)
+	err := func() error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		receipt := uploadReceipt{
+			Filename:         filename,
+			OriginalFilename: originalFilename,
+			UploadID:         uploadID,
+			Size:             info.Size(),
+			SHA256:           sum,
+			CompletedAt:      time.Now().UTC().Truncate(time.Second),
+		}
+		if receipt.Signature, err = signReceipt(s.key, receipt); err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(receipt, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path+receiptSuffix, append(data, '\n'), 0644)
+	}()
+	if err != nil {
+		slog.Warn("Failed to write upload receipt",
+			"path", path,
+			"error", err)
+	}
+}
+
+// rewrite re-signs the receipt of a finished upload at path for the content it
+// has after a patch. Without a signer a receipt left from before is removed, as
+// nothing can vouch for the new content.
+func (s *receiptSigner) rewrite(path string) {
+	receiptPath := path + receiptSuffix
+	err := func() error {
+		data, err := os.ReadFile(receiptPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return os.Remove(receiptPath)
+		}
+		var receipt uploadReceipt
+		if err := json.Unmarshal(data, &receipt); err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if receipt.SHA256, err = fileSHA256(path); err != nil {
+			return err
+		}
+		receipt.Size = info.Size()
+		receipt.PatchedAt = time.Now().UTC().Truncate(time.Second)
+		if receipt.Signature, err = signReceipt(s.key, receipt); err != nil {
+			return err
+		}
+		if data, err = json.MarshalIndent(receipt, "", "  "); err != nil {
+			return err
+		}
+		return os.WriteFile(receiptPath, append(data, '\n'), 0644)
+	}()
+	if err != nil {
+		slog.Warn("Failed to rewrite upload receipt after patch",
+			"path", path,
+			"error", err)
+	}
+}
+
+// handleReceipt serves GET /api/files/{name}/receipt
+func handleReceipt(fsys fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		data, err := fs.ReadFile(fsys, name+receiptSuffix)
+		if err != nil || isUploadBookkeeping(fsys, name) {
+			writeJSONError(w, http.StatusNotFound, "receipt not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, json.RawMessage(data))
+	}
+}
+
+var verifyReceiptKeyFile string
+
+var verifyReceiptCmd = &cobra.Command{
+	Use:   "verify-receipt RECEIPT [FILE]",
+	Short: "Check the signature of an upload receipt, and optionally that FILE matches it",
+	Args:  cobra.RangeArgs(1, 2),
+	// main prints the error, usage would only bury it
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := loadReceiptKey(verifyReceiptKeyFile)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		receipt, err := verifyReceipt(key, data)
+		if err != nil {
+			return err
+		}
+		if len(args) == 2 {
+			info, err := os.Stat(args[1])
+			if err != nil {
+				return err
+			}
+			sum, err := fileSHA256(args[1])
+			if err != nil {
+				return err
+			}
+			if info.Size() != receipt.Size || sum != receipt.SHA256 {
+				return fmt.Errorf("%s does not match the receipt", args[1])
+			}
+		}
+		fmt.Printf("Receipt valid: %s, %d bytes, sha256 %s, completed %s\n",
+			receipt.Filename, receipt.Size, receipt.SHA256, receipt.CompletedAt.Format(time.RFC3339))
+		return nil
+	},
+}
+
+func init() {
+	verifyReceiptCmd.Flags().StringVar(&verifyReceiptKeyFile, "receipt-key-file", "", "File holding the key the receipt was signed with")
+	verifyReceiptCmd.MarkFlagRequired("receipt-key-file")
+	rootCmd.AddCommand(verifyReceiptCmd)
+}
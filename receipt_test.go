@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestFinalizeWritesReceipt(t *testing.T) {
+	defer func(saved string) { uploadsDir = saved }(uploadsDir)
+	uploadsDir = t.TempDir()
+	data := []byte("quarterly numbers")
+	if err := os.WriteFile(filepath.Join(uploadsDir, "upload-id"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("receipt-key")
+	event := tusd.HookEvent{Upload: tusd.FileInfo{
+		ID:       "upload-id",
+		Size:     int64(len(data)),
+		MetaData: tusd.MetaData{"filename": "report?.txt"},
+	}}
+	before := time.Now().UTC().Truncate(time.Second)
+	outcome, err := finalizeUpload(context.Background(), newFileStore(uploadsDir, false, 0, ""), nil, newReceiptSigner(key), nil, nil, nil, nil, event)
+	if err != nil || outcome != uploadPublished {
+		t.Fatalf("finalizeUpload = %v, %v", outcome, err)
+	}
+
+	filename := sanitizeFilename("report?.txt")
+	encoded, err := os.ReadFile(filepath.Join(uploadsDir, filename+receiptSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := verifyReceipt(key, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uploadReceipt{
+		Filename:         filename,
+		OriginalFilename: "report?.txt",
+		UploadID:         "upload-id",
+		Size:             int64(len(data)),
+		SHA256:           sha256Hex(data),
+		CompletedAt:      receipt.CompletedAt,
+		Signature:        receipt.Signature,
+	}
+	if receipt != want || receipt.CompletedAt.Before(before) || receipt.CompletedAt.After(time.Now()) {
+		t.Errorf("receipt is %+v, want %+v completed now", receipt, want)
+	}
+
+	// Anything changed in the receipt breaks its signature
+	if _, err := verifyReceipt([]byte("other-key"), encoded); err == nil {
+		t.Error("receipt verified with another key")
+	}
+	tampered := bytes.Replace(encoded, []byte(`"size": 17`), []byte(`"size": 18`), 1)
+	if bytes.Equal(tampered, encoded) {
+		t.Fatalf("receipt lacks the size:\n%s", encoded)
+	}
+	if _, err := verifyReceipt(key, tampered); err == nil {
+		t.Error("receipt with a changed size verified")
+	}
+
+	root, err := os.OpenRoot(uploadsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files/{name}/receipt", handleReceipt(root.FS()))
+	for name, wantCode := range map[string]int{filename: http.StatusOK, "missing.txt": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/files/"+name+"/receipt", nil))
+		if w.Code != wantCode {
+			t.Errorf("GET receipt of %s: status %d, want %d", name, w.Code, wantCode)
+		}
+		if wantCode == http.StatusOK {
+			if _, err := verifyReceipt(key, w.Body.Bytes()); err != nil {
+				t.Errorf("served receipt: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// filenameLogKeys are the log attributes that carry upload filenames or paths
+// containing them
+var filenameLogKeys = map[string]bool{
+	"filename":          true,
+	"original_filename": true,
+	"final_filename":    true,
+	"converted":         true,
+	"name":              true,
+	"new_name":          true,
+	"path":              true,
+	"new_path":          true,
+}
+
+// redactFilename replaces a filename with a short hash, so log lines about the
+// same file can still be correlated without revealing its name. Directories of
+// a path are kept, they are chosen by the operator rather than the uploader.
+func redactFilename(name string) string {
+	if name == "" {
+		return name
+	}
+	dir, base := filepath.Split(name)
+	sum := sha256.Sum256([]byte(base))
+	return dir + "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// filenameRedactor is a slog.Handler which hashes filenames before passing
+// records on to next
+type filenameRedactor struct {
+	next slog.Handler
+}
+
+func newFilenameRedactor(next slog.Handler) *filenameRedactor {
+	return &filenameRedactor{next: next}
+}
+
+func (h *filenameRedactor) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *filenameRedactor) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactFilenameAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *filenameRedactor) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redactFilenameAttr(attr)
+	}
+	return &filenameRedactor{h.next.WithAttrs(redacted)}
+}
+
+func (h *filenameRedactor) WithGroup(name string) slog.Handler {
+	return &filenameRedactor{h.next.WithGroup(name)}
+}
+
+func redactFilenameAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		group := value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, a := range group {
+			redacted[i] = redactFilenameAttr(a)
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redacted...)}
+	}
+	if filenameLogKeys[attr.Key] && value.Kind() == slog.KindString {
+		return slog.String(attr.Key, redactFilename(value.String()))
+	}
+	return attr
+}
+
+// filePathPrefixes are the API paths, below --base-url, which a file's name
+// follows
+var filePathPrefixes = []string{"api/files/", "api/download/", "api/thumbnail/"}
+
+// fileSubresources may follow the name in a file's API path
+var fileSubresources = []string{"/receipt", "/info"}
+
+// redactRequestURI hashes the filenames in a request URI for the access log:
+// the name in the filePathPrefixes paths and the query parameters naming files
+func redactRequestURI(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return uri
+	}
+	for _, prefix := range filePathPrefixes {
+		rest, ok := strings.CutPrefix(u.Path, basePath+prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		var subresource string
+		for _, suffix := range fileSubresources {
+			if name, ok := strings.CutSuffix(rest, suffix); ok && name != "" {
+				rest, subresource = name, suffix
+				break
+			}
+		}
+		u.Path = basePath + prefix + redactFilename(rest) + subresource
+		u.RawPath = ""
+		break
+	}
+	query := u.Query()
+	for _, key := range []string{"path", "after"} {
+		if v := query.Get(key); v != "" {
+			query.Set(key, redactFilename(v))
+		}
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = query.Encode()
+	}
+	return u.RequestURI()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactRequestURI(t *testing.T) {
+	defer func(saved string) { basePath = saved }(basePath)
+
+	report := redactFilename("report.pdf")
+	tests := []struct {
+		base, uri, want string
+	}{
+		{"/", "/api/files/report.pdf", "/api/files/" + report},
+		{"/", "/api/files/report.pdf/receipt", "/api/files/" + report + "/receipt"},
+		{"/", "/api/files/report.pdf/info", "/api/files/" + report + "/info"},
+		{"/", "/api/files/2024/report.pdf", "/api/files/2024/" + report},
+		{"/", "/api/files/my%20report.pdf", "/api/files/" + redactFilename("my report.pdf")},
+		{"/", "/api/files", "/api/files"},
+		{"/", "/api/files?after=report.pdf", "/api/files?after=" + strings.ReplaceAll(report, ":", "%3A")},
+		{"/", "/api/download-folder?path=2024%2Freport.pdf", "/api/download-folder?path=2024%2F" + strings.ReplaceAll(report, ":", "%3A")},
+		{"/", "/api/download/report.pdf", "/api/download/" + report},
+		{"/", "/api/download/2024/05/report.pdf", "/api/download/2024/05/" + report},
+		{"/", "/api/download-zip", "/api/download-zip"},
+		{"/", "/api/thumbnail/report.pdf", "/api/thumbnail/" + report},
+		{"/app/", "/app/api/thumbnail/2024/report.pdf", "/app/api/thumbnail/2024/" + report},
+		{"/", "/files/abc123", "/files/abc123"},
+		{"/", "/healthz", "/healthz"},
+		{"/app/", "/app/api/files/report.pdf/info", "/app/api/files/" + report + "/info"},
+		{"/app/", "/api/files/report.pdf", "/api/files/report.pdf"},
+	}
+	for _, tt := range tests {
+		basePath = tt.base
+		if got := redactRequestURI(tt.uri); got != tt.want {
+			t.Errorf("redactRequestURI(%q) with base %s = %q, want %q", tt.uri, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestFilenameRedactor(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newFilenameRedactor(slog.NewJSONHandler(&buf, nil)))
+	logger.With("name", "secret.pdf").Info("Upload completed",
+		"final_filename", "2024/secret.pdf",
+		"new_name", "2024/secret.pdf",
+		"upload_id", "abc123",
+		slog.Group("upload", "filename", "secret.pdf"))
+
+	out := buf.String()
+	if strings.Contains(out, "secret.pdf") {
+		t.Errorf("filename not redacted: %s", out)
+	}
+	for _, want := range []string{redactFilename("secret.pdf"), "2024/" + redactFilename("secret.pdf"), `"upload_id":"abc123"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log line lacks %s: %s", want, out)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/pflag"
+)
+
+// errRestartRequired is returned by an option's reload function when its new
+// value can't take effect while the server runs
+var errRestartRequired = errors.New("needs a restart")
+
+// configReloader re-reads --config on SIGHUP and compares it with the previous
+// load. Changed options with a reload function take effect right away, the
+// others need a restart and are only logged.
+type configReloader struct {
+	path  string
+	flags *pflag.FlagSet
+	// fixed are the flags given on the command line or through the
+	// environment, which the file doesn't override
+	fixed  map[string]bool
+	values map[string][]string
+	reload map[string]func(values []string) error
+}
+
+// newConfigReloader reads the config file for later comparison. It is created
+// before the file is loaded into the flags, to tell which were given otherwise.
+func newConfigReloader(flags *pflag.FlagSet, path string) (*configReloader, error) {
+	c := &configReloader{
+		path:   path,
+		flags:  flags,
+		fixed:  map[string]bool{},
+		reload: map[string]func([]string) error{},
+	}
+	flags.Visit(func(flag *pflag.Flag) {
+		c.fixed[flag.Name] = true
+	})
+	var err error
+	if c.values, err = c.read(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// onReload sets the function applying a new value of the option, called with
+// nothing when it is removed from the file
+func (c *configReloader) onReload(name string, reload func(values []string) error) {
+	c.reload[name] = reload
+}
+
+// read loads the config file into copies of the flags that record the values
+func (c *configReloader) read() (map[string][]string, error) {
+	values := map[string][]string{}
+	file := pflag.NewFlagSet(c.path, pflag.ContinueOnError)
+	c.flags.VisitAll(func(flag *pflag.Flag) {
+		recorded := &recordedValue{name: flag.Name, typ: flag.Value.Type(), values: values}
+		var value pflag.Value = recorded
+		if _, ok := flag.Value.(pflag.SliceValue); ok {
+			value = recordedSlice{recorded}
+		}
+		file.Var(value, flag.Name, flag.Usage)
+		file.Lookup(flag.Name).Changed = c.fixed[flag.Name]
+	})
+	if err := loadConfigFile(file, c.path); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// apply re-reads the file and applies the changed options, returning those
+// taking effect and those needing a restart. An invalid value is reported and
+// the option keeps its current value, to be tried again on the next reload.
+func (c *configReloader) apply() (applied, ignored []string, err error) {
+	values, err := c.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	names := append(slices.Collect(maps.Keys(c.values)), slices.Collect(maps.Keys(values))...)
+	slices.Sort(names)
+	names = slices.Compact(names)
+	var errs []error
+	for _, name := range names {
+		if slices.Equal(c.values[name], values[name]) {
+			continue
+		}
+		reload, ok := c.reload[name]
+		if !ok {
+			ignored = append(ignored, name)
+			continue
+		}
+		switch err := reload(values[name]); {
+		case errors.Is(err, errRestartRequired):
+			ignored = append(ignored, name)
+		case err != nil:
+			errs = append(errs, fmt.Errorf("invalid value for %s: %w", name, err))
+			if old, ok := c.values[name]; ok {
+				values[name] = old
+			} else {
+				delete(values, name)
+			}
+		default:
+			applied = append(applied, name)
+		}
+	}
+	c.values = values
+	return applied, ignored, errors.Join(errs...)
+}
+
+// watchSignals reloads the file on every SIGHUP. A file that fails to load is
+// logged and every option keeps its current value.
+func (c *configReloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			applied, ignored, err := c.apply()
+			if len(ignored) > 0 {
+				slog.Warn("Options changed in the config file need a restart, ignoring them",
+					"path", c.path,
+					"options", strings.Join(ignored, ","))
+			}
+			if err != nil {
+				slog.Error("Failed to reload config file, keeping the current values",
+					"path", c.path,
+					"error", err)
+			}
+			if len(applied) > 0 {
+				slog.Info("Reloaded config file", "path", c.path, "options", strings.Join(applied, ","))
+			}
+		}
+	}()
+}
+
+// tokenReloader replaces a token with the one from the config file. Setting or
+// clearing it changes which endpoints exist, so that needs a restart.
+func tokenReloader(token *liveToken) func([]string) error {
+	return func(values []string) error {
+		var value string
+		if len(values) > 0 {
+			value = values[0]
+		}
+		if (value == "") != (token.get() == "") {
+			return errRestartRequired
+		}
+		token.set(value)
+		return nil
+	}
+}
+
+// recordedValue stands in for a flag when reading the config file, keeping
+// the value it is set to
+type recordedValue struct {
+	name   string
+	typ    string
+	values map[string][]string
+}
+
+func (v *recordedValue) String() string {
+	return strings.Join(v.values[v.name], ",")
+}
+
+func (v *recordedValue) Set(value string) error {
+	v.values[v.name] = []string{value}
+	return nil
+}
+
+func (v *recordedValue) Type() string {
+	return v.typ
+}
+
+// recordedSlice stands in for a repeatable flag, which the config file sets as
+// a list
+type recordedSlice struct {
+	*recordedValue
+}
+
+func (v recordedSlice) Append(value string) error {
+	v.values[v.name] = append(v.values[v.name], value)
+	return nil
+}
+
+func (v recordedSlice) Replace(values []string) error {
+	v.values[v.name] = values
+	return nil
+}
+
+func (v recordedSlice) GetSlice() []string {
+	return v.values[v.name]
+}
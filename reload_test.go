@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/pflag"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func writeTestConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestReloader sets up flags like runServer does, with the command line
+// arguments, and loads the config file into them
+func newTestReloader(t *testing.T, path string, args ...string) (*configReloader, *pflag.FlagSet) {
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringSlice("allowed-types", nil, "")
+	flags.StringSlice("allow-cidr", nil, "")
+	flags.Int("port", 80, "")
+	flags.String("auth-token", "", "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := newConfigReloader(flags, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(flags, path); err != nil {
+		t.Fatal(err)
+	}
+	return reloader, flags
+}
+
+func TestConfigReloadAllowedTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, "allowed_types: [.png]\nport: 8080\nauth_token: from-file\n")
+	reloader, flags := newTestReloader(t, path, "--auth-token=from-flag")
+
+	configured, _ := flags.GetStringSlice("allowed-types")
+	types := parseAllowedTypes(configured)
+	var allowed atomic.Pointer[[]string]
+	allowed.Store(&types)
+	hook := allowTypes(&allowed)
+	reloader.onReload("allowed-types", func(values []string) error {
+		types := parseAllowedTypes(values)
+		allowed.Store(&types)
+		return nil
+	})
+	token := newLiveToken("from-flag")
+	reloader.onReload("auth-token", tokenReloader(token))
+
+	accepts := func(filename string) bool {
+		_, _, err := hook(tusd.HookEvent{Upload: tusd.FileInfo{MetaData: tusd.MetaData{"filename": filename}}})
+		return err == nil
+	}
+	if !accepts("a.png") || accepts("a.pdf") {
+		t.Fatal("hook doesn't follow the allowed types loaded at startup")
+	}
+
+	writeTestConfig(t, path, "allowed_types: [.pdf, .PNG]\nport: 9090\nauth_token: changed\n")
+	applied, ignored, err := reloader.apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(applied, []string{"allowed-types"}) {
+		t.Errorf("applied %v, want [allowed-types]", applied)
+	}
+	// The command line takes precedence, so the token in the file doesn't count
+	if !slices.Equal(ignored, []string{"port"}) {
+		t.Errorf("ignored %v, want [port]", ignored)
+	}
+	if !accepts("a.pdf") || !accepts("b.png") || accepts("c.jpg") {
+		t.Error("hook doesn't follow the reloaded allowed types")
+	}
+	if got := token.get(); got != "from-flag" {
+		t.Errorf("token is %q after reload, want the one from the command line", got)
+	}
+
+	// Nothing changed since the last reload
+	if applied, ignored, err := reloader.apply(); err != nil || applied != nil || ignored != nil {
+		t.Errorf("second reload applied %v, ignored %v, error %v, want nothing", applied, ignored, err)
+	}
+
+	// Removing the option allows everything again, like an empty list at startup
+	writeTestConfig(t, path, "port: 9090\n")
+	if _, _, err := reloader.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if !accepts("c.jpg") {
+		t.Error("hook still restricts types after they were removed from the config file")
+	}
+
+	// A file that doesn't load changes nothing
+	writeTestConfig(t, path, "allowed_types: [.png]\nunknown_option: 1\n")
+	if _, _, err := reloader.apply(); err == nil {
+		t.Error("reloading a config file with an unknown option succeeded")
+	}
+	if !accepts("c.jpg") {
+		t.Error("a config file that failed to load changed the allowed types")
+	}
+}
+
+func TestConfigReloadKeepsInvalidValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, "allow_cidr: [10.0.0.0/8]\n")
+	reloader, _ := newTestReloader(t, path)
+
+	filter := newIPFilter([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, nil, nil)
+	reloader.onReload("allow-cidr", func(values []string) error {
+		allow, err := parsePrefixes(values)
+		if err == nil {
+			filter.setRules(allow, nil)
+		}
+		return err
+	})
+	client := netip.MustParseAddr("192.168.1.5")
+
+	writeTestConfig(t, path, "allow_cidr: [192.168.0.0/16, not-a-network]\n")
+	if _, _, err := reloader.apply(); err == nil {
+		t.Fatal("reloading an invalid network succeeded")
+	}
+	if filter.rules.Load().allowed(client) {
+		t.Error("an invalid reload replaced the allowed networks")
+	}
+
+	// Fixing the file applies the networks
+	writeTestConfig(t, path, "allow_cidr: [192.168.0.0/16]\n")
+	applied, _, err := reloader.apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(applied, []string{"allow-cidr"}) || !filter.rules.Load().allowed(client) {
+		t.Errorf("applied %v, the fixed networks didn't take effect", applied)
+	}
+}
+
+func TestTokenReloader(t *testing.T) {
+	token := newLiveToken("old")
+	reload := tokenReloader(token)
+	if err := reload([]string{"new"}); err != nil || token.get() != "new" {
+		t.Errorf("replacing the token: error %v, token %q", err, token.get())
+	}
+	if err := reload(nil); err != errRestartRequired || token.get() != "new" {
+		t.Errorf("clearing the token: error %v, token %q, want it kept until a restart", err, token.get())
+	}
+
+	unset := newLiveToken("")
+	if err := tokenReloader(unset)([]string{"new"}); err != errRestartRequired || unset.get() != "" {
+		t.Errorf("setting a token: error %v, token %q, want it kept until a restart", err, unset.get())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxRenameRequestSize bounds the JSON body of PUT /api/files/{name...}
+const maxRenameRequestSize = 64 << 10
+
+// fileRenamer renames finished uploads within their directory, along with the
+// sidecars kept next to them and the thumbnail kept in the uploads dir
+type fileRenamer struct {
+	dir   string
+	roots storageRoots
+}
+
+func newFileRenamer(dir string, roots storageRoots) *fileRenamer {
+	return &fileRenamer{dir: dir, roots: roots}
+}
+
+// handleRename serves PUT /api/files/{name...} with a JSON body giving the new
+// name. It is sanitized like an uploaded filename and gets a counter if it is
+// taken, so the response names the file's final path.
+func (f *fileRenamer) handleRename(w http.ResponseWriter, r *http.Request) {
+	name := cleanFolderPath(r.PathValue("name"))
+	root, ok := f.roots.locate(name)
+	if name == "." || !ok || isUploadBookkeeping(root.root.FS(), name) {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRenameRequestSize)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	// Files stay in their directory, a name with a path is refused rather than
+	// sanitized into something the client didn't ask for
+	if strings.TrimSpace(req.Name) == "" || strings.ContainsAny(req.Name, `/\`) || strings.Trim(req.Name, " .") == "" {
+		writeJSONError(w, http.StatusBadRequest, "name must be a filename without a directory")
+		return
+	}
+	newName := sanitizeFilename(req.Name)
+	if isBookkeepingName(newName) {
+		writeJSONError(w, http.StatusBadRequest, "name ends in a suffix reserved for the server's own files")
+		return
+	}
+
+	subdir := path.Dir(name)
+	targetDir := filepath.Join(root.dir, filepath.FromSlash(subdir))
+	defer lockPublishDir(targetDir)()
+
+	// Through the root, so a symlink can't lead the rename out of the storage directory
+	info, err := root.root.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	if newName == path.Base(name) {
+		writeJSON(w, http.StatusOK, map[string]string{"name": name})
+		return
+	}
+
+	oldPath := filepath.Join(root.dir, filepath.FromSlash(name))
+	finalName, err := claimUniqueName(oldPath, targetDir, newName)
+	if err != nil {
+		slog.Error("Failed to rename file",
+			"name", name,
+			"new_name", newName,
+			"error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to rename file")
+		return
+	}
+	finalName = path.Join(subdir, finalName)
+	f.moveSidecars(root.dir, name, finalName)
+
+	slog.Info("File renamed",
+		"name", name,
+		"new_name", finalName)
+	writeJSON(w, http.StatusOK, map[string]string{"name": finalName})
+}
+
+// moveSidecars moves what belongs to the file in dir that was renamed from
+// oldName to newName. The filename sidecar keeps recording the name the client
+// uploaded, which for a file without one was its name before the rename.
+func (f *fileRenamer) moveSidecars(dir, oldName, newName string) {
+	oldPath := filepath.Join(dir, filepath.FromSlash(oldName))
+	newPath := filepath.Join(dir, filepath.FromSlash(newName))
+
+	var meta uploadMeta
+	data, err := os.ReadFile(oldPath + metaSuffix)
+	if err == nil {
+		err = json.Unmarshal(data, &meta)
+	}
+	if err != nil || meta.OriginalFilename == "" {
+		meta.OriginalFilename = path.Base(oldName)
+	}
+	os.Remove(oldPath + metaSuffix)
+	writeUploadMeta(dir, newName, meta.OriginalFilename, meta.UploadID)
+
+	moves := [][2]string{
+		{oldPath + receiptSuffix, newPath + receiptSuffix},
+		{thumbnailPath(f.dir, oldName), thumbnailPath(f.dir, newName)},
+	}
+	for _, move := range moves {
+		// A sidecar left by a file that had the new name before doesn't belong
+		// to this one
+		if err := os.Remove(move[1]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to remove stale sidecar", "path", move[1], "error", err)
+		}
+		if err := os.Rename(move[0], move[1]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to move sidecar of renamed file",
+				"path", move[0],
+				"new_path", move[1],
+				"error", err)
+		}
+	}
+}
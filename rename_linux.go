@@ -0,0 +1,20 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameExclusive atomically renames oldPath to newPath unless newPath exists,
+// which is reported as fs.ErrExist. Filesystems without RENAME_NOREPLACE report
+// errors.ErrUnsupported.
+func renameExclusive(oldPath, newPath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		return errors.ErrUnsupported
+	}
+	return err
+}
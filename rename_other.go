@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// renameExclusive is only implemented on Linux
+func renameExclusive(oldPath, newPath string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// stressWriters and stressFiles are how many goroutines publish how many
+// files each under the same name
+const (
+	stressWriters = 16
+	stressFiles   = 20
+)
+
+// writeSources creates a file with distinct content for each writer and file
+// in dir
+func writeSources(t *testing.T, dir string) [][]string {
+	t.Helper()
+	sources := make([][]string, stressWriters)
+	for w := range sources {
+		for i := range stressFiles {
+			path := filepath.Join(dir, fmt.Sprintf("upload-%d-%d", w, i))
+			if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			sources[w] = append(sources[w], path)
+		}
+	}
+	return sources
+}
+
+func TestRenameNoReplaceRace(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "report.pdf")
+	if err := os.WriteFile(target, []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sources := writeSources(t, t.TempDir())
+
+	var wg sync.WaitGroup
+	for _, paths := range sources {
+		wg.Go(func() {
+			for _, path := range paths {
+				if err := renameNoReplace(path, target); !errors.Is(err, fs.ErrExist) {
+					t.Errorf("renameNoReplace(%s) over an existing file = %v, want fs.ErrExist", path, err)
+				}
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("source lost: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if data, _ := os.ReadFile(target); string(data) != "existing" {
+		t.Errorf("existing file overwritten with %q", data)
+	}
+}
+
+func TestRenameNoReplaceSingleWinner(t *testing.T) {
+	for round := range 50 {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "report.pdf")
+		sources := writeSources(t, t.TempDir())
+
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			winners []string
+		)
+		for _, paths := range sources {
+			wg.Go(func() {
+				err := renameNoReplace(paths[0], target)
+				switch {
+				case err == nil:
+					mu.Lock()
+					winners = append(winners, paths[0])
+					mu.Unlock()
+				case !errors.Is(err, fs.ErrExist):
+					t.Errorf("renameNoReplace: %v", err)
+				}
+			})
+		}
+		wg.Wait()
+
+		if len(winners) != 1 {
+			t.Fatalf("round %d: %d renames claimed the name, want 1", round, len(winners))
+		}
+		if data, _ := os.ReadFile(target); string(data) != winners[0] {
+			t.Fatalf("round %d: %s holds %q, want the content of %s", round, target, data, winners[0])
+		}
+	}
+}
+
+func TestPublishConditionalStress(t *testing.T) {
+	defer func(saved string) { conflictPolicy = saved }(conflictPolicy)
+	conflictPolicy = conflictRename
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.pdf"), []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sources := writeSources(t, t.TempDir())
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		published = make(map[string]string)
+	)
+	for _, paths := range sources {
+		wg.Go(func() {
+			for i, path := range paths {
+				// Every other upload asks to fail on a taken name, which with
+				// the default conflict policy gives it a counter as well
+				onConflict := ""
+				if i%2 == 1 {
+					onConflict = onConflictFail
+				}
+				name, err := publishConditional(path, dir, "report.pdf", onConflict)
+				if err != nil {
+					t.Errorf("publishConditional(%s): %v", path, err)
+					return
+				}
+				mu.Lock()
+				if other, ok := published[name]; ok {
+					t.Errorf("%s and %s both published as %s", other, path, name)
+				}
+				published[name] = path
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "report.pdf")); string(data) != "existing" {
+		t.Errorf("existing file overwritten with %q", data)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := stressWriters*stressFiles + 1; len(entries) != want {
+		t.Errorf("%d files published, want %d", len(entries), want)
+	}
+	for name, source := range published {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != source {
+			t.Errorf("%s holds %q, want the content of %s", name, data, source)
+		}
+	}
+}
+
+func TestPublishOntoDirectory(t *testing.T) {
+	defer func(saved string) { conflictPolicy = saved }(conflictPolicy)
+
+	tests := []struct {
+		name            string
+		dirs            []string
+		filename        string
+		onConflict      string
+		policy          string
+		wantName        string
+		wantErr         error
+		wantFailure     bool
+		wantUnpublished bool
+	}{
+		// The leading dot is stripped, so .thumbs can't name the directory
+		{name: "server directory", dirs: []string{".thumbs"}, filename: ".thumbs", policy: conflictRename, wantName: "thumbs"},
+		{name: "counter", dirs: []string{".thumbs", "thumbs"}, filename: "thumbs", policy: conflictRename, wantName: "thumbs_1"},
+		{name: "fail with rename policy", dirs: []string{".thumbs", "thumbs"}, filename: "thumbs", onConflict: onConflictFail, policy: conflictRename, wantName: "thumbs_1"},
+		{name: "fail with reject policy", dirs: []string{".thumbs", "thumbs"}, filename: "thumbs", onConflict: onConflictFail, policy: conflictReject, wantErr: errNameTaken, wantUnpublished: true},
+		{name: "replace", dirs: []string{".thumbs", "thumbs"}, filename: "thumbs", onConflict: onConflictReplace, policy: conflictRename, wantFailure: true, wantUnpublished: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflictPolicy = tt.policy
+			dir := t.TempDir()
+			for _, sub := range tt.dirs {
+				if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, sub, "a.jpg"), []byte("thumbnail"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			source := filepath.Join(t.TempDir(), "upload-id")
+			if err := os.WriteFile(source, []byte("upload"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			name, err := publishConditional(source, dir, tt.filename, tt.onConflict)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("publishConditional = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantFailure:
+				if err == nil {
+					t.Errorf("publishConditional replaced a directory as %s", name)
+				}
+			case err != nil:
+				t.Fatalf("publishConditional: %v", err)
+			case name != tt.wantName:
+				t.Errorf("published as %s, want %s", name, tt.wantName)
+			default:
+				if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != "upload" {
+					t.Errorf("%s holds %q, want the upload", name, data)
+				}
+			}
+			if _, err := os.Stat(source); (err == nil) != tt.wantUnpublished {
+				t.Errorf("upload left under its ID: %v, want %v", err == nil, tt.wantUnpublished)
+			}
+			for _, sub := range tt.dirs {
+				if data, _ := os.ReadFile(filepath.Join(dir, sub, "a.jpg")); string(data) != "thumbnail" {
+					t.Errorf("directory %s lost its contents", sub)
+				}
+			}
+		})
+	}
+}
+
+func TestListAndDownloadDuringPublish(t *testing.T) {
+	defer func(saved string) { conflictPolicy = saved }(conflictPolicy)
+	conflictPolicy = conflictRename
+
+	dir := t.TempDir()
+	sources := writeSources(t, t.TempDir())
+	contents := make(map[string]bool)
+	for _, paths := range sources {
+		for _, path := range paths {
+			contents[path] = true
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files", newFileList(root.FS(), false).handleList)
+	mux.HandleFunc("GET /api/download/{name...}", handleDownloadFile(root.FS()))
+
+	var publishers sync.WaitGroup
+	for w, paths := range sources {
+		publishers.Go(func() {
+			for i, path := range paths {
+				var err error
+				// Half announce their name before publishing, like with
+				// Upload-Final-Name
+				if w%2 == 0 {
+					_, err = publishConditional(path, dir, "report.pdf", "")
+				} else {
+					_, err = publishReserved(path, dir, fmt.Sprintf("reserved-%d-%d.pdf", w, i), "report.pdf", "")
+				}
+				if err != nil {
+					t.Errorf("publishing %s: %v", path, err)
+				}
+			}
+		})
+	}
+	published := make(chan struct{})
+	go func() {
+		publishers.Wait()
+		close(published)
+	}()
+
+	// A file that is listed is complete, never a partial copy or placeholder
+	check := func() int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/files?limit=1000", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list: status %d", rec.Code)
+		}
+		var page fileListPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range page.Items {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/download/"+file.Name, nil))
+			if rec.Code != http.StatusOK || !contents[rec.Body.String()] {
+				t.Errorf("listed %s (%d bytes) downloads with status %d and %q", file.Name, file.Size, rec.Code, rec.Body)
+			}
+			if int64(rec.Body.Len()) != file.Size {
+				t.Errorf("listed %s with %d bytes, download has %d", file.Name, file.Size, rec.Body.Len())
+			}
+		}
+		return page.Total
+	}
+	for {
+		select {
+		case <-published:
+			if total := check(); total != stressWriters*stressFiles {
+				t.Errorf("%d files listed once all were published, want %d", total, stressWriters*stressFiles)
+			}
+			return
+		default:
+			check()
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// uploadRoute sends finished uploads with one of the extensions to another
+// directory than the uploads dir, e.g. media to a large disk
+type uploadRoute struct {
+	exts []string
+	dir  string
+}
+
+// parseRoutes parses --route-by-ext, e.g. "mp4,mov=/mnt/media;pdf=/mnt/docs".
+// Extensions are matched without case and may be given with or without the dot.
+func parseRoutes(value string) ([]uploadRoute, error) {
+	var routes []uploadRoute
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		exts, dir, ok := strings.Cut(entry, "=")
+		dir = strings.TrimSpace(dir)
+		if !ok || dir == "" {
+			return nil, fmt.Errorf("expected ext,ext=dir, got %q", entry)
+		}
+		route := uploadRoute{dir: filepath.Clean(dir)}
+		for _, ext := range strings.Split(exts, ",") {
+			ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if ext == "" || strings.ContainsAny(ext, `./\`) {
+				return nil, fmt.Errorf("invalid extension %q in %q", ext, entry)
+			}
+			if seen[ext] {
+				return nil, fmt.Errorf("extension %q is routed twice", ext)
+			}
+			seen[ext] = true
+			route.exts = append(route.exts, "."+ext)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// routeDir returns the directory a finished upload published as filename goes
+// to, the uploads dir unless a route matches its extension
+func routeDir(routes []uploadRoute, filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, route := range routes {
+		if slices.Contains(route.exts, ext) {
+			return route.dir
+		}
+	}
+	return uploadsDir
+}
+
+// validateRouteDirs makes sure the route directories exist and are writable,
+// and that no two of them, the uploads dir included, contain each other, which
+// would list their files twice
+func validateRouteDirs(routes []uploadRoute) error {
+	dirs := storageDirs(routes)
+	for i, a := range dirs {
+		for _, b := range dirs[i+1:] {
+			if isWithin(a, b) || isWithin(b, a) {
+				return fmt.Errorf("%s and %s must not contain each other", a, b)
+			}
+		}
+	}
+	for _, dir := range dirs[1:] {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := probeWritable(dir); err != nil {
+			return fmt.Errorf("%s is not writable: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// isWithin reports whether dir is parent or inside it
+func isWithin(dir, parent string) bool {
+	absDir, err1 := filepath.Abs(dir)
+	absParent, err2 := filepath.Abs(parent)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absParent, absDir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// storageRoot is a directory finished uploads are published to
+type storageRoot struct {
+	dir  string
+	root *os.Root
+}
+
+// storageRoots are the uploads dir, first, and the route directories. The file
+// endpoints see them as one tree.
+type storageRoots []storageRoot
+
+// storageDirs returns the uploads dir and every distinct route directory
+func storageDirs(routes []uploadRoute) []string {
+	dirs := []string{uploadsDir}
+	for _, route := range routes {
+		if !slices.Contains(dirs, route.dir) {
+			dirs = append(dirs, route.dir)
+		}
+	}
+	return dirs
+}
+
+// openStorageRoots opens the storageDirs
+func openStorageRoots(routes []uploadRoute) (storageRoots, error) {
+	dirs := storageDirs(routes)
+	roots := make(storageRoots, 0, len(dirs))
+	for _, dir := range dirs {
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, storageRoot{dir: dir, root: root})
+	}
+	return roots, nil
+}
+
+// FS returns the roots' files as one file system. A name in more than one root
+// is served from the first.
+func (r storageRoots) FS() fs.FS {
+	if len(r) == 1 {
+		return r[0].root.FS()
+	}
+	union := make(unionFS, len(r))
+	for i, root := range r {
+		union[i] = root.root.FS()
+	}
+	return union
+}
+
+// locate returns the root holding name
+func (r storageRoots) locate(name string) (storageRoot, bool) {
+	for _, root := range r {
+		if _, err := root.root.Lstat(name); err == nil {
+			return root, true
+		}
+	}
+	return storageRoot{}, false
+}
+
+// unionFS overlays file systems, merging their directories
+type unionFS []fs.FS
+
+func (u unionFS) Open(name string) (fs.File, error) {
+	var firstErr error
+	for _, fsys := range u {
+		f, err := fsys.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if firstErr == nil || errors.Is(firstErr, fs.ErrNotExist) {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (u unionFS) Stat(name string) (fs.FileInfo, error) {
+	var firstErr error
+	for _, fsys := range u {
+		info, err := fs.Stat(fsys, name)
+		if err == nil {
+			return info, nil
+		}
+		if firstErr == nil || errors.Is(firstErr, fs.ErrNotExist) {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// ReadDir lists the directory in every file system that has it, sorted by name
+func (u unionFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	found := false
+	var firstErr error
+	for _, fsys := range u {
+		list, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		found = true
+		for _, entry := range list {
+			if !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if !found {
+		return nil, firstErr
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// moveFile moves src to dst, copying when they are on different file systems.
+// The copy is written under a staging name in dst's directory first, so dst
+// never holds part of the file.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), ".route-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/spf13/pflag"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/memorylocker"
+	"github.com/tus/tusd/v2/pkg/s3store"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxCopyObjectSize is the largest object a single CopyObject can copy,
+	// larger ones are copied in parts
+	maxCopyObjectSize = 5 << 30
+	copyPartSize      = 1 << 30
+)
+
+// localOnlyFlags are the flags of features working on the uploads dir, which
+// can't be combined with --s3-bucket
+var localOnlyFlags = []string{
+	"uploads-dir", "preallocate", "write-buffer-size", "id-prefix", "verify-size", "use-xattr",
+	"normalize-eol", "convert", "receipt-key-file", "webhook-url", "sparse-uploads",
+	"resume-sessions", "chunk-alignment", "inflight-duplicates", "writable-check-interval",
+	"upload-expiry", "layout", "post-hook", "min-free-space", "thumbnail-size",
+	"max-total-size", "verify-content-type", "route-by-ext", "strip-exif", "webhook-retries",
+	"quota-warn-at",
+}
+
+// s3LocalOnlyFlags returns the local-only flags set on the command line
+func s3LocalOnlyFlags(flags *pflag.FlagSet) []string {
+	var set []string
+	for _, name := range localOnlyFlags {
+		if flags.Changed(name) {
+			set = append(set, "--"+name)
+		}
+	}
+	return set
+}
+
+// s3Options configures the bucket uploads are stored in. Without explicit keys
+// the AWS SDK's default credential chain applies (environment, shared config,
+// instance roles).
+type s3Options struct {
+	bucket    string
+	prefix    string
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// s3Storage keeps uploads in a bucket through tusd's s3store instead of the
+// uploads dir. A finished upload is copied to its final name below the same
+// prefix and the upload's own objects are removed, the equivalent of the rename
+// on disk.
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	store  s3store.S3Store
+}
+
+func newS3Storage(ctx context.Context, opts s3Options) (*s3Storage, error) {
+	var loadOptions []func(*config.LoadOptions) error
+	if opts.region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(opts.region))
+	}
+	if opts.accessKey != "" {
+		loadOptions = append(loadOptions, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(opts.accessKey, opts.secretKey, "")))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.endpoint != "" {
+			// S3 compatible services rarely support virtual hosted buckets
+			o.BaseEndpoint = aws.String(opts.endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	store := s3store.New(opts.bucket, client)
+	store.ObjectPrefix = strings.Trim(opts.prefix, "/")
+	return &s3Storage{
+		client: client,
+		bucket: opts.bucket,
+		prefix: store.ObjectPrefix,
+		store:  store,
+	}, nil
+}
+
+// UseIn registers the store and an in-memory locker, so requests for the same
+// upload must reach the same instance
+func (s *s3Storage) UseIn(composer *tusd.StoreComposer) {
+	s.store.UseIn(composer)
+	memorylocker.New().UseIn(composer)
+}
+
+// key returns the object key of a finished upload
+func (s *s3Storage) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+// copySource encodes bucket/key for CopySource, keeping the slashes
+func copySource(bucket, key string) string {
+	return escapePath(bucket + "/" + key)
+}
+
+// lookup is the nameLookup of conditional uploads. Objects are always regular.
+func (s *s3Storage) lookup(name string) (exists, regular bool) {
+	exists, err := s.exists(context.Background(), s.key(name))
+	if err != nil {
+		slog.Warn("Failed to look up object", "key", s.key(name), "error", err)
+	}
+	return exists, exists
+}
+
+func (s *s3Storage) exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// publish copies the object at src to the final name of the upload and returns
+// that name. S3 has no exclusive copy, so two uploads finishing with the same
+// name at the same moment can still overwrite each other.
+func (s *s3Storage) publish(ctx context.Context, src string, size int64, filename, onConflict string) (string, error) {
+	sanitized := sanitizeFilename(filename)
+	if onConflict == "" && conflictPolicy == conflictOverwrite {
+		onConflict = onConflictReplace
+	}
+	if onConflict == onConflictReplace {
+		return sanitized, s.copy(ctx, src, s.key(sanitized), size)
+	}
+	if conflictPolicy == conflictReject {
+		taken, err := s.exists(ctx, s.key(sanitized))
+		if err != nil {
+			return sanitized, err
+		}
+		if taken {
+			return sanitized, errNameTaken
+		}
+		return sanitized, s.copy(ctx, src, s.key(sanitized), size)
+	}
+
+	ext := path.Ext(sanitized)
+	base := strings.TrimSuffix(sanitized, ext)
+	candidate := sanitized
+	for i := 1; ; i++ {
+		taken, err := s.exists(ctx, s.key(candidate))
+		if err != nil {
+			return candidate, err
+		}
+		if !taken {
+			return candidate, s.copy(ctx, src, s.key(candidate), size)
+		}
+		candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+func (s *s3Storage) copy(ctx context.Context, src, dst string, size int64) error {
+	if size <= maxCopyObjectSize {
+		_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(dst),
+			CopySource: aws.String(copySource(s.bucket, src)),
+		})
+		return err
+	}
+
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(src),
+	})
+	if err != nil {
+		return err
+	}
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(dst),
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	var parts []types.CompletedPart
+	for offset := int64(0); offset < size; offset += copyPartSize {
+		number := int32(len(parts) + 1)
+		part, err := s.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dst),
+			UploadId:        created.UploadId,
+			PartNumber:      aws.Int32(number),
+			CopySource:      aws.String(copySource(s.bucket, src)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, min(offset+copyPartSize, size)-1)),
+		})
+		if err != nil {
+			s.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      aws.String(dst),
+				UploadId: created.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int32(number)})
+	}
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(dst),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// finalize is finalizeUpload for uploads stored in S3
+func (s *s3Storage) finalize(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+	if event.Upload.IsPartial {
+		slog.Debug("Partial upload finished", "upload_id", event.Upload.ID)
+		return uploadKept, nil
+	}
+
+	uploadID := event.Upload.ID
+	if rejectEmpty && event.Upload.Size == 0 {
+		slog.Warn("Removing empty upload",
+			"upload_id", uploadID,
+			"filename", event.Upload.MetaData["filename"])
+		if err := terminateUpload(s.store, uploadID); err != nil {
+			slog.Error("Failed to remove empty upload",
+				"upload_id", uploadID,
+				"error", err)
+		}
+		return uploadRemoved, nil
+	}
+
+	originalFilename := event.Upload.MetaData["filename"]
+	slog.Info("Upload finished",
+		"upload_id", uploadID,
+		"filename", originalFilename)
+	if originalFilename == "" {
+		slog.Warn("No filename in metadata, keeping object with upload ID",
+			"upload_id", uploadID)
+		return uploadKept, nil
+	}
+
+	src := event.Upload.Storage["Key"]
+	finalFilename, err := s.publish(ctx, src, event.Upload.Size, uploadFilename(event.Upload, time.Now()), event.Upload.MetaData[conflictMetadataKey])
+	if errors.Is(err, errNameTaken) {
+		slog.Warn("Object name is taken, keeping object with upload ID",
+			"upload_id", uploadID,
+			"original_filename", originalFilename,
+			"final_filename", finalFilename)
+		return uploadKept, nil
+	}
+	if err != nil {
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, err.Error())
+		slog.Error("Failed to copy uploaded object",
+			"upload_id", uploadID,
+			"original_filename", originalFilename,
+			"final_filename", finalFilename,
+			"error", err)
+		return uploadKept, err
+	}
+	slog.Info("Object copied successfully",
+		"from", src,
+		"original_filename", originalFilename,
+		"final_filename", finalFilename)
+
+	// Removes the source object along with the upload's .info and .part objects
+	if err := terminateUpload(s.store, uploadID); err != nil {
+		slog.Warn("Failed to remove upload objects after copying",
+			"upload_id", uploadID,
+			"error", err)
+	}
+	if event.Upload.IsFinal {
+		removePartialUploads(s.store, uploadID, event.Upload.PartialUploads)
+	}
+	return uploadPublished, nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tus/tusd/v2/pkg/filelocker"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	xslog "golang.org/x/exp/slog"
+)
+
+var (
+	selftestDir      string
+	selftestSize     int64
+	selftestURL      string
+	selftestToken    string
+	selftestDownload bool
+)
+
+// selftestPublishTimeout is how long a running server gets to publish the
+// test upload, which may include its post-processing
+const selftestPublishTimeout = 30 * time.Second
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Upload a generated file and verify the stored result",
+	Long: `Starts a server on a random local port backed by a temporary directory, uploads a
+generated file in two requests with a resume check in between, and verifies that
+the completed file was renamed and matches the uploaded checksum. Exits non-zero
+on the first failing step.
+
+With --url the upload goes to a running server instead, e.g. through its reverse
+proxy, and the file is downloaded back through /api/download and compared. The
+test file stays on that server.`,
+	Args: cobra.NoArgs,
+	// main prints the error, usage would only bury it
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if selftestURL != "" {
+			return runRemoteSelftest(selftestURL, selftestToken, selftestSize, selftestDownload)
+		}
+		return runSelftest(selftestDir, selftestSize)
+	},
+}
+
+func init() {
+	selftestCmd.Flags().StringVar(&selftestDir, "dir", "", "Run the store in a temporary directory below this one, e.g. the production uploads dir's filesystem (system temp dir when empty)")
+	selftestCmd.Flags().Int64Var(&selftestSize, "size", 4<<20, "Size in bytes of the generated test file")
+	selftestCmd.Flags().StringVar(&selftestURL, "url", "", "Test the running server at this URL, including its base path, instead of an ephemeral one")
+	selftestCmd.Flags().StringVar(&selftestToken, "token", "", "Bearer token for a server started with --auth-token")
+	selftestCmd.Flags().BoolVar(&selftestDownload, "download", true, "With --url, download the published file back and verify it; without only the upload is checked, e.g. for S3 mode")
+	rootCmd.AddCommand(selftestCmd)
+}
+
+func runSelftest(parent string, size int64) error {
+	if err := checkSelftestSize(size); err != nil {
+		return err
+	}
+
+	// Only problems are interesting here, tusd's request logs would drown the
+	// step results
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	dir, err := os.MkdirTemp(parent, "simple-upload-selftest-")
+	if err != nil {
+		return fmt.Errorf("creating store directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	// finalizeUpload publishes into the global uploads directory
+	uploadsDir = dir
+
+	store := newFileStore(dir, false, 0, "")
+	composer := tusd.NewStoreComposer()
+	store.UseIn(composer)
+	filelocker.New(dir).UseIn(composer)
+
+	handler, err := tusd.NewHandler(tusd.Config{
+		BasePath:              "/files/",
+		StoreComposer:         composer,
+		NotifyCompleteUploads: true,
+		Logger:                xslog.New(expSlogHandler{slog.Default().Handler()}),
+	})
+	if err != nil {
+		return fmt.Errorf("creating handler: %w", err)
+	}
+	// Finalizing stops before the store directory is removed
+	finalizeCtx, stopFinalizing := context.WithCancel(context.Background())
+	finalized := handleCompletedUploads(finalizeCtx, handler, nil, func(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+		return finalizeUpload(ctx, store, nil, nil, nil, nil, nil, nil, event)
+	}, nil, nil, nil)
+	defer func() {
+		stopFinalizing()
+		<-finalized
+	}()
+
+	server := httptest.NewServer(http.StripPrefix("/files/", handler))
+	defer server.Close()
+
+	data, want, filename := selftestFile(size)
+	fmt.Printf("Store: %s\n", dir)
+	fmt.Printf("Server: %s\n", server.URL)
+	fmt.Printf("Test file: %s, %d bytes, sha256 %s\n", filename, size, want)
+
+	t := selftestClient{url: server.URL + "/files/"}
+	steps := append(t.uploadSteps(data, filename), []selftestStep{
+		{"finalize to original filename", func() error {
+			return waitForFile(filepath.Join(dir, filename), size, 10*time.Second)
+		}},
+		{"verify checksum", func() error {
+			got, err := fileSHA256(filepath.Join(dir, filename))
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("stored file has sha256 %s, uploaded %s", got, want)
+			}
+			return nil
+		}},
+	}...)
+	return runSelftestSteps(steps)
+}
+
+// runRemoteSelftest uploads the test file to the server at base, and unless
+// download is off waits until it is published and compares it
+func runRemoteSelftest(base, token string, size int64, download bool) error {
+	if err := checkSelftestSize(size); err != nil {
+		return err
+	}
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(base, "/") + "/")
+	if err != nil {
+		return fmt.Errorf("invalid --url: %w", err)
+	}
+
+	data, want, filename := selftestFile(size)
+	fmt.Printf("Server: %s\n", baseURL)
+	fmt.Printf("Test file: %s, %d bytes, sha256 %s\n", filename, size, want)
+
+	t := selftestClient{url: baseURL.JoinPath("files").String() + "/", token: token}
+	steps := t.uploadSteps(data, filename)
+	if download {
+		var fileURL string
+		steps = append(steps, []selftestStep{
+			{"publish under announced name", func() error {
+				// Servers before X-Download-URL publish under the plain filename
+				announced := t.downloadURL
+				if announced == "" {
+					announced = "api/download/" + url.PathEscape(filename)
+				}
+				ref, err := url.Parse(announced)
+				if err != nil {
+					return fmt.Errorf("invalid X-Download-URL %q: %w", announced, err)
+				}
+				fileURL = baseURL.ResolveReference(ref).String()
+				return t.waitForDownload(fileURL, size, selftestPublishTimeout)
+			}},
+			{"download and verify checksum", func() error {
+				got, err := t.downloadSHA256(fileURL)
+				if err != nil {
+					return err
+				}
+				if got != want {
+					return fmt.Errorf("downloaded file has sha256 %s, uploaded %s", got, want)
+				}
+				return nil
+			}},
+		}...)
+	}
+	return runSelftestSteps(steps)
+}
+
+func checkSelftestSize(size int64) error {
+	if size < 2 {
+		return errors.New("--size must be at least 2 bytes to test resuming")
+	}
+	return nil
+}
+
+// selftestFile generates the random test file, returning it with its
+// SHA-256 and a filename unlikely to be taken
+func selftestFile(size int64) (data []byte, sha string, filename string) {
+	data = make([]byte, size)
+	rand.Read(data)
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:]), "selftest-" + newRandomID()[:8] + ".bin"
+}
+
+type selftestStep struct {
+	name string
+	run  func() error
+}
+
+// runSelftestSteps runs steps in order, printing each result, and stops at
+// the first failure
+func runSelftestSteps(steps []selftestStep) error {
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", step.name, err)
+			return fmt.Errorf("selftest failed at %q", step.name)
+		}
+		fmt.Printf("PASS %s\n", step.name)
+	}
+	fmt.Println("Selftest passed")
+	return nil
+}
+
+// selftestClient speaks just enough tus to drive one upload
+type selftestClient struct {
+	url   string
+	token string
+
+	uploadURL string
+	// downloadURL is the X-Download-URL of the response completing the upload
+	downloadURL string
+}
+
+// uploadSteps upload data in two requests, checking the offset in between
+func (c *selftestClient) uploadSteps(data []byte, filename string) []selftestStep {
+	size := int64(len(data))
+	return []selftestStep{
+		{"create upload", func() error { return c.create(size, filename) }},
+		{"upload first half", func() error { return c.patch(0, data[:size/2]) }},
+		{"resume at reported offset", func() error { return c.checkOffset(size / 2) }},
+		{"upload remainder", func() error { return c.patch(size/2, data[size/2:]) }},
+	}
+}
+
+func (c *selftestClient) do(method, target string, headers map[string]string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (c *selftestClient) create(size int64, filename string) error {
+	resp, err := c.do(http.MethodPost, c.url, map[string]string{
+		"Upload-Length":   strconv.FormatInt(size, 10),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("POST answered %s, expected 201 Created", resp.Status)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("no usable Location header: %w", err)
+	}
+	c.uploadURL = location.String()
+	return nil
+}
+
+func (c *selftestClient) patch(offset int64, chunk []byte) error {
+	resp, err := c.do(http.MethodPatch, c.uploadURL, map[string]string{
+		"Upload-Offset": strconv.FormatInt(offset, 10),
+		"Content-Type":  "application/offset+octet-stream",
+	}, chunk)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("PATCH answered %s, expected 204 No Content", resp.Status)
+	}
+	if got, want := resp.Header.Get("Upload-Offset"), strconv.FormatInt(offset+int64(len(chunk)), 10); got != want {
+		return fmt.Errorf("PATCH left Upload-Offset at %s, expected %s", got, want)
+	}
+	if announced := resp.Header.Get(downloadURLHeader); announced != "" {
+		c.downloadURL = announced
+	}
+	return nil
+}
+
+func (c *selftestClient) checkOffset(want int64) error {
+	resp, err := c.do(http.MethodHead, c.uploadURL, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HEAD answered %s, expected 200 OK", resp.Status)
+	}
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.FormatInt(want, 10) {
+		return fmt.Errorf("HEAD reported Upload-Offset %s, expected %d", got, want)
+	}
+	return nil
+}
+
+// waitForFile polls until the completion handler has published the upload
+func waitForFile(path string, size int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := os.Stat(path)
+		if err == nil && info.Size() == size {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("not published within %s: %w", timeout, err)
+			}
+			return fmt.Errorf("published with %d bytes, expected %d", info.Size(), size)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitForDownload polls until the download endpoint serves the file with its
+// full size
+func (c *selftestClient) waitForDownload(fileURL string, size int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := c.do(http.MethodHead, fileURL, nil, nil)
+		if err == nil && resp.StatusCode == http.StatusOK && resp.ContentLength == size {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			switch {
+			case err != nil:
+				return fmt.Errorf("not published within %s: %w", timeout, err)
+			case resp.StatusCode != http.StatusOK:
+				return fmt.Errorf("HEAD %s still answers %s after %s", fileURL, resp.Status, timeout)
+			}
+			return fmt.Errorf("published with %d bytes, expected %d", resp.ContentLength, size)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// downloadSHA256 downloads the file and returns its SHA-256
+func (c *selftestClient) downloadSHA256(fileURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET answered %s, expected 200 OK", resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	xslog "golang.org/x/exp/slog"
+)
+
+func TestSelftestRoundTrip(t *testing.T) {
+	defer func(saved string) { uploadsDir = saved }(uploadsDir)
+	defer slog.SetDefault(slog.Default())
+	parent := t.TempDir()
+	if err := runSelftest(parent, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	// The temporary store is gone afterwards
+	if entries, err := os.ReadDir(parent); err != nil || len(entries) != 0 {
+		t.Errorf("selftest left %v (%v) behind", entries, err)
+	}
+
+	if err := runSelftest(parent, 1); err == nil {
+		t.Error("selftest of a 1 byte file succeeded, want it refused as not resumable")
+	}
+}
+
+// newSelftestServer serves tus uploads, finalized into the uploads dir, and
+// downloads with download, for requests carrying the bearer token
+func newSelftestServer(t *testing.T, download http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	store := newFileStore(uploadsDir, false, 0, "")
+	composer := tusd.NewStoreComposer()
+	store.UseIn(composer)
+	handler, err := tusd.NewHandler(tusd.Config{
+		BasePath:              "/files/",
+		StoreComposer:         composer,
+		NotifyCompleteUploads: true,
+		Logger:                xslog.New(xslog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := handleCompletedUploads(ctx, handler, nil, func(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+		return finalizeUpload(ctx, store, nil, nil, nil, nil, nil, nil, event)
+	}, nil, nil, nil)
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/files/", http.StripPrefix("/files/", handler))
+	if download != nil {
+		mux.HandleFunc("GET /api/download/{name...}", download)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasBearerToken(r, "upload-secret") {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRemoteSelftest(t *testing.T) {
+	defer func(saved string) { uploadsDir = saved }(uploadsDir)
+	const size = 64 << 10
+	tests := []struct {
+		name     string
+		token    string
+		download bool
+		// corrupt serves other bytes than were uploaded
+		corrupt bool
+		wantErr string
+	}{
+		{"round-trip", "upload-secret", true, false, ""},
+		{"upload only", "upload-secret", false, false, ""},
+		{"wrong token", "other", true, false, "create upload"},
+		{"corrupted download", "upload-secret", true, true, "download and verify checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploadsDir = t.TempDir()
+			root, err := os.OpenRoot(uploadsDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+			download := handleDownloadFile(root.FS())
+			if tt.corrupt {
+				download = func(w http.ResponseWriter, r *http.Request) {
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(make([]byte, size)))
+				}
+			}
+			if !tt.download {
+				download = nil
+			}
+			server := newSelftestServer(t, download)
+
+			err = runRemoteSelftest(server.URL, tt.token, size, tt.download)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("selftest = %v, want it failed at %q", err, tt.wantErr)
+			}
+		})
+	}
+}
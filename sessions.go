@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const resumeCookieName = "simple_upload_session"
+
+// resumeSessions remembers which uploads an anonymous browser created, keyed by
+// a random session cookie, so the UI can offer to resume them after a refresh
+type resumeSessions struct {
+	store *fileStore
+	ttl   time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*resumeSession
+}
+
+type resumeSession struct {
+	expires time.Time
+	uploads []string
+}
+
+// resumableUpload is an in-progress upload as returned by /api/my-uploads
+type resumableUpload struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+}
+
+func newResumeSessions(store *fileStore, ttl time.Duration) *resumeSessions {
+	s := &resumeSessions{
+		store:    store,
+		ttl:      ttl,
+		sessions: make(map[string]*resumeSession),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.expire(time.Now())
+		}
+	}()
+	return s
+}
+
+func (s *resumeSessions) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// lookup returns the live session referenced by the request's cookie, if any
+func (s *resumeSessions) lookup(r *http.Request) (string, *resumeSession) {
+	cookie, err := r.Cookie(resumeCookieName)
+	if err != nil {
+		return "", nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[cookie.Value]
+	if !ok || time.Now().After(session.expires) {
+		return "", nil
+	}
+	return cookie.Value, session
+}
+
+// middleware wraps the tusd handler and records every upload created by a
+// browser session. A session and its cookie are created on the first upload.
+func (s *resumeSessions) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, _ := s.lookup(r)
+		if id == "" {
+			id = newRandomID()
+			expires := time.Now().Add(s.ttl)
+			s.mu.Lock()
+			s.sessions[id] = &resumeSession{expires: expires}
+			s.mu.Unlock()
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     resumeCookieName,
+				Value:    id,
+				Path:     basePath,
+				Expires:  expires,
+				MaxAge:   int(s.ttl.Seconds()),
+				Secure:   r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		location := w.Header().Get("Location")
+		if rec.statusCode() != http.StatusCreated || location == "" {
+			return
+		}
+
+		s.mu.Lock()
+		if session, ok := s.sessions[id]; ok {
+			session.uploads = append(session.uploads, path.Base(location))
+		}
+		s.mu.Unlock()
+	})
+}
+
+// handleMyUploads lists the session's uploads that can still be resumed.
+// Finished or removed uploads are dropped from the session on the way.
+func (s *resumeSessions) handleMyUploads(w http.ResponseWriter, r *http.Request) {
+	_, session := s.lookup(r)
+	if session == nil {
+		writeJSON(w, http.StatusOK, []resumableUpload{})
+		return
+	}
+
+	s.mu.Lock()
+	ids := append([]string(nil), session.uploads...)
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	uploads := []resumableUpload{}
+	done := make(map[string]bool)
+	for _, id := range ids {
+		upload, err := s.store.GetUpload(ctx, id)
+		if err != nil {
+			// Completed uploads no longer have data under their upload ID
+			done[id] = errors.Is(err, tusd.ErrNotFound)
+			continue
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil {
+			slog.Warn("Failed to read upload info", "upload_id", id, "error", err)
+			continue
+		}
+		if !info.SizeIsDeferred && info.Offset >= info.Size {
+			done[id] = true
+			continue
+		}
+
+		uploads = append(uploads, resumableUpload{
+			ID:       id,
+			URL:      basePath + "files/" + id,
+			Filename: info.MetaData["filename"],
+			Size:     info.Size,
+			Offset:   info.Offset,
+		})
+	}
+
+	s.mu.Lock()
+	live := session.uploads[:0]
+	for _, id := range session.uploads {
+		if !done[id] {
+			live = append(live, id)
+		}
+	}
+	session.uploads = live
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, uploads)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteUnits are the suffixes accepted by parseByteSize. They are binary, so
+// 1MB is 1024*1024 bytes, matching what file managers usually show.
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longest first, so "MB" isn't taken for a "B" suffix
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseByteSize parses sizes like "500MB", "1.5GiB" or "1048576". An empty
+// string or "0" means no limit.
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if number, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s = strings.TrimSpace(number)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) || n*float64(multiplier) > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500MB or 2GB", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
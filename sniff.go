@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Strictness of --verify-content-type
+const (
+	// contentCheckLenient only objects to executables and to one kind of media
+	// posing as another, where sniffing is reliable
+	contentCheckLenient = "lenient"
+	// contentCheckStrict objects to every difference in kind, including binary
+	// data in a text file and formats the sniffer doesn't know
+	contentCheckStrict = "strict"
+)
+
+// executableType is what sniffContentType reports for native executables,
+// which http.DetectContentType doesn't recognize
+const executableType = "application/x-executable"
+
+// sniffContentType detects the media type of a file's first 512 bytes
+func sniffContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")),
+		bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}),
+		bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}),
+		isPortableExecutable(head):
+		return executableType
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return mediaType
+}
+
+// isPortableExecutable recognizes Windows executables by their DOS header,
+// and by the PE signature it points at when that is within head
+func isPortableExecutable(head []byte) bool {
+	if len(head) < 64 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+	offset := int64(binary.LittleEndian.Uint32(head[0x3c:]))
+	if offset+4 > int64(len(head)) {
+		return true
+	}
+	return bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// contentKind groups media types into what matters for a mismatch: image,
+// audio, video, text or executable. Everything else is empty.
+func contentKind(mediaType string) string {
+	switch mediaType {
+	case executableType, "application/x-msdownload", "application/vnd.microsoft.portable-executable",
+		"application/x-mach-binary", "application/x-elf", "application/x-sharedlib":
+		return "executable"
+	case "image/svg+xml", "application/json", "application/xml", "application/javascript":
+		// Sniffed as text, SVG is XML
+		return "text"
+	}
+	kind, _, _ := strings.Cut(mediaType, "/")
+	switch kind {
+	case "image", "audio", "video", "text":
+		return kind
+	}
+	return ""
+}
+
+func isMediaKind(kind string) bool {
+	return kind == "image" || kind == "audio" || kind == "video"
+}
+
+// contentMismatch sniffs the file at p and compares it with the types the
+// client declared, by the filename's extension and the filetype metadata. It
+// returns the declared type the content contradicts and the detected one, or
+// an empty claimed type when they agree or the declared types are unknown.
+func contentMismatch(p, filename, filetype, strictness string) (claimed, detected string, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", "", err
+	}
+	detected = sniffContentType(head[:n])
+	detectedKind := contentKind(detected)
+
+	byExtension, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))))
+	byMetadata, _, _ := mime.ParseMediaType(filetype)
+	for _, claim := range []string{byExtension, byMetadata} {
+		kind := contentKind(claim)
+		if kind == "" || kind == detectedKind {
+			continue
+		}
+		if strictness == contentCheckStrict || detectedKind == "executable" || isMediaKind(kind) && isMediaKind(detectedKind) {
+			return claim, detected, nil
+		}
+	}
+	return "", detected, nil
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+const (
+	// sparseSuffix marks the data files of sparse uploads still being filled
+	sparseSuffix = ".sparse"
+
+	// sparseRangesKey holds the received ranges in the storage details of a
+	// sparse upload's tusd .info file, so it survives a restart. It is removed
+	// once the upload is complete.
+	sparseRangesKey = "SparseRanges"
+
+	// sparseCreateLimit bounds the JSON body creating a sparse upload
+	sparseCreateLimit = 64 << 10
+)
+
+// errSparseUpload answers tus requests for an upload written through
+// /api/sparse-uploads, whose offset doesn't say which bytes arrived
+var errSparseUpload = tusd.NewError("ERR_SPARSE_UPLOAD", "this upload is written through /api/sparse-uploads", http.StatusConflict)
+
+// sparseUploads implements a non-standard upload mode in which clients write
+// ranges at arbitrary offsets, e.g. several segments in parallel, instead of
+// tus' strictly sequential PATCHes. The uploads are created in tusd's store
+// after passing the pre-create hooks, so the limits of tus uploads apply, and
+// are published through the completed uploads like those.
+type sparseUploads struct {
+	store     *fileStore
+	preCreate func(tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error)
+	created   []func(tusd.HookEvent)
+	progress  []func(tusd.HookEvent)
+	completed chan tusd.HookEvent
+
+	mu      sync.Mutex
+	uploads map[string]*sparseUpload
+}
+
+type sparseUpload struct {
+	// writes are the PUTs writing to the data file, which finishing waits for
+	writes sync.WaitGroup
+
+	mu       sync.Mutex
+	info     tusd.FileInfo
+	received []byteRange
+	done     bool
+}
+
+// byteRange is the half-open interval [start, end)
+type byteRange struct {
+	start, end int64
+}
+
+// sparseStatus is the JSON representation of a sparse upload
+type sparseStatus struct {
+	ID       string     `json:"id"`
+	URL      string     `json:"url"`
+	Filename string     `json:"filename"`
+	Size     int64      `json:"size"`
+	Received [][2]int64 `json:"received"`
+}
+
+// newSparseUploads resumes the sparse uploads found in the store's directory.
+// Those complete before a restart are handed to the completed uploads again.
+func newSparseUploads(store *fileStore, preCreate func(tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error), created, progress []func(tusd.HookEvent)) *sparseUploads {
+	s := &sparseUploads{
+		store:     store,
+		preCreate: preCreate,
+		created:   created,
+		progress:  progress,
+		completed: make(chan tusd.HookEvent),
+		uploads:   make(map[string]*sparseUpload),
+	}
+	s.resume()
+	return s
+}
+
+// completedUploads delivers the sparse uploads that received every byte, for
+// handleCompletedUploads. Without sparse uploads it is nil and never delivers.
+func (s *sparseUploads) completedUploads() <-chan tusd.HookEvent {
+	if s == nil {
+		return nil
+	}
+	return s.completed
+}
+
+func (s *sparseUploads) resume() {
+	ctx := context.Background()
+	infos, _ := filepath.Glob(filepath.Join(s.store.Path, "*.info"))
+	for _, infoPath := range infos {
+		id := strings.TrimSuffix(filepath.Base(infoPath), ".info")
+		upload, err := s.store.GetUpload(ctx, id)
+		if err != nil {
+			continue
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil || info.Storage[sparseRangesKey] == "" {
+			continue
+		}
+		var ranges [][2]int64
+		if err := json.Unmarshal([]byte(info.Storage[sparseRangesKey]), &ranges); err != nil {
+			slog.Warn("Failed to read the received ranges of a sparse upload",
+				"upload_id", id,
+				"error", err)
+			continue
+		}
+		u := &sparseUpload{info: info}
+		for _, r := range ranges {
+			u.received = append(u.received, byteRange{r[0], r[1]})
+		}
+		s.uploads[id] = u
+		if u.complete() {
+			u.done = true
+			go s.finish(ctx, u, tusd.HTTPRequest{})
+		}
+	}
+
+	// Data files of sparse uploads left by versions that kept them in memory
+	// only, which can't be resumed
+	leftovers, _ := filepath.Glob(filepath.Join(s.store.Path, "*"+sparseSuffix))
+	for _, path := range leftovers {
+		id := strings.TrimSuffix(filepath.Base(path), sparseSuffix)
+		if _, ok := s.uploads[id]; ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.store.Path, id+".info")); errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Removing sparse upload that can't be resumed", "upload_id", id)
+			os.Remove(path)
+		}
+	}
+	if len(s.uploads) > 0 {
+		slog.Info("Resuming sparse uploads", "count", len(s.uploads))
+	}
+}
+
+// addRange records r as received, merging it with overlapping and adjacent
+// ranges, and reports whether this completed the upload
+func (u *sparseUpload) addRange(r byteRange) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// Overlapping a write that completed the upload, whose file is moving
+	if u.done {
+		return false
+	}
+
+	merged := make([]byteRange, 0, len(u.received)+1)
+	for _, existing := range u.received {
+		if existing.end < r.start || existing.start > r.end {
+			merged = append(merged, existing)
+			continue
+		}
+		r.start = min(r.start, existing.start)
+		r.end = max(r.end, existing.end)
+	}
+	merged = append(merged, r)
+	slices.SortFunc(merged, func(a, b byteRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	u.received = merged
+
+	if !u.complete() {
+		u.saveRanges()
+		return false
+	}
+	u.done = true
+	return true
+}
+
+// complete reports whether every byte has been received, with u.mu held
+func (u *sparseUpload) complete() bool {
+	return len(u.received) == 1 && u.received[0] == byteRange{0, u.info.Size}
+}
+
+// receivedBytes is the number of bytes written so far, with u.mu held
+func (u *sparseUpload) receivedBytes() int64 {
+	var n int64
+	for _, r := range u.received {
+		n += r.end - r.start
+	}
+	return n
+}
+
+// saveRanges stores the received ranges in the upload's .info file, with u.mu
+// held. Without it a restart only loses the ranges since the last save.
+func (u *sparseUpload) saveRanges() {
+	ranges := make([][2]int64, len(u.received))
+	for i, r := range u.received {
+		ranges[i] = [2]int64{r.start, r.end}
+	}
+	data, _ := json.Marshal(ranges)
+	u.info.Storage[sparseRangesKey] = string(data)
+	if err := writeUploadInfo(u.info); err != nil {
+		slog.Warn("Failed to save the received ranges of a sparse upload",
+			"upload_id", u.info.ID,
+			"error", err)
+	}
+}
+
+// writeUploadInfo replaces the tusd filestore .info file of an upload, which
+// holds its FileInfo as JSON
+func writeUploadInfo(info tusd.FileInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	infoPath := info.Storage["InfoPath"]
+	// Not ending in .info, which would make it look like an upload
+	tmp := filepath.Join(filepath.Dir(infoPath), ".sparse-"+filepath.Base(infoPath)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, infoPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// startWrite registers a PUT writing to the data file, unless the upload is
+// already complete
+func (u *sparseUpload) startWrite() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done {
+		return false
+	}
+	u.writes.Add(1)
+	return true
+}
+
+func (u *sparseUpload) status() sparseStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s := sparseStatus{
+		ID:       u.info.ID,
+		URL:      basePath + "api/sparse-uploads/" + u.info.ID,
+		Filename: u.info.MetaData["filename"],
+		Size:     u.info.Size,
+		Received: make([][2]int64, len(u.received)),
+	}
+	for i, r := range u.received {
+		s.Received[i] = [2]int64{r.start, r.end}
+	}
+	return s
+}
+
+// event is the hook event of the upload, offset at the bytes received so far
+func (u *sparseUpload) event(ctx context.Context, req tusd.HTTPRequest) tusd.HookEvent {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	info := u.info
+	info.MetaData = maps.Clone(u.info.MetaData)
+	info.Storage = maps.Clone(u.info.Storage)
+	info.Offset = u.receivedBytes()
+	return tusd.HookEvent{Context: ctx, Upload: info, HTTPRequest: req}
+}
+
+// get returns the upload, forgetting it when --upload-expiry removed it
+func (s *sparseUploads) get(id string) (*sparseUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, false
+	}
+	if _, err := os.Stat(u.info.Storage["Path"]); errors.Is(err, os.ErrNotExist) {
+		delete(s.uploads, id)
+		return nil, false
+	}
+	return u, true
+}
+
+func hookRequest(r *http.Request) tusd.HTTPRequest {
+	header := r.Header.Clone()
+	header.Set("Host", r.Host)
+	return tusd.HTTPRequest{
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		RemoteAddr: r.RemoteAddr,
+		Header:     header,
+	}
+}
+
+// writeHookError answers a creation refused by a pre-create hook or the store
+// with the error's status and headers, like tusd does for tus uploads
+func writeHookError(w http.ResponseWriter, err error) {
+	var refused tusd.Error
+	if !errors.As(err, &refused) {
+		slog.Error("Failed to create sparse upload", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	for key, value := range refused.HTTPResponse.Header {
+		if key != "Content-Type" {
+			w.Header().Set(key, value)
+		}
+	}
+	writeJSONError(w, refused.HTTPResponse.StatusCode, refused.Message)
+}
+
+// handleCreate serves POST /api/sparse-uploads with a JSON body naming the file
+// and its total size, and optionally more metadata like Upload-Metadata. It
+// runs the pre-create hooks of tus uploads, and the data file is created
+// without allocating blocks, so ranges can be written in any order.
+func (s *sparseUploads) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Filename string            `json:"filename"`
+		Size     int64             `json:"size"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, sparseCreateLimit)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Filename == "" || req.Size <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "filename and a positive size are required")
+		return
+	}
+	if maxSize > 0 && req.Size > maxSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "upload is larger than the maximum size")
+		return
+	}
+
+	metadata := make(tusd.MetaData, len(req.Metadata)+1)
+	maps.Copy(metadata, req.Metadata)
+	metadata["filename"] = req.Filename
+	info := tusd.FileInfo{Size: req.Size, MetaData: metadata}
+	request := hookRequest(r)
+	if s.preCreate != nil {
+		_, changes, err := s.preCreate(tusd.HookEvent{Context: r.Context(), Upload: info, HTTPRequest: request})
+		if err != nil {
+			writeHookError(w, err)
+			return
+		}
+		if changes.ID != "" {
+			info.ID = changes.ID
+		}
+		if changes.MetaData != nil {
+			info.MetaData = changes.MetaData
+		}
+	}
+	if info.ID == "" {
+		info.ID = s.store.newUploadID()
+	}
+	// Next to the .info file, where tus PATCHes can't append to it
+	info.Storage = map[string]string{"Path": filepath.Join(s.store.Path, info.ID+sparseSuffix)}
+
+	upload, err := s.store.NewUpload(r.Context(), info)
+	if err == nil {
+		info, err = upload.GetInfo(r.Context())
+	}
+	if err != nil {
+		writeHookError(w, err)
+		return
+	}
+	u := &sparseUpload{info: info}
+	u.saveRanges()
+
+	s.mu.Lock()
+	s.uploads[info.ID] = u
+	s.mu.Unlock()
+
+	slog.Info("Sparse upload created",
+		"upload_id", info.ID,
+		"filename", req.Filename,
+		"size", info.Size)
+	event := u.event(r.Context(), request)
+	for _, consume := range s.created {
+		consume(event)
+	}
+	writeJSON(w, http.StatusCreated, u.status())
+}
+
+// handleStatus reports which ranges of a sparse upload have been received
+func (s *sparseUploads) handleStatus(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, u.status())
+}
+
+// handleWrite serves PUT /api/sparse-uploads/{id} with a Content-Range header
+// naming the bytes in the body. Overlapping writes are allowed, the last one wins.
+func (s *sparseUploads) handleWrite(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+
+	first, last, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Content-Range must be bytes first-last/size")
+		return
+	}
+	if total != u.info.Size || first < 0 || last < first || last >= u.info.Size {
+		writeJSONError(w, http.StatusRequestedRangeNotSatisfiable, "range is outside the upload")
+		return
+	}
+	// Once every byte arrived the file is being published
+	if !u.startWrite() {
+		writeJSONError(w, http.StatusConflict, "upload is complete")
+		return
+	}
+	length := last - first + 1
+	n, err := s.writeRange(u, first, length, r.Body)
+	// Recorded before the write counts as done, so finishing sees it
+	var completed bool
+	if err == nil && n == length {
+		completed = u.addRange(byteRange{first, last + 1})
+	}
+	u.writes.Done()
+	if err != nil {
+		slog.Warn("Failed to write sparse upload range",
+			"upload_id", u.info.ID,
+			"first", first,
+			"last", last,
+			"error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to write range")
+		return
+	}
+	if n != length {
+		writeJSONError(w, http.StatusBadRequest, "body is shorter than Content-Range")
+		return
+	}
+
+	request := hookRequest(r)
+	if completed {
+		s.finish(r.Context(), u, request)
+	} else {
+		event := u.event(r.Context(), request)
+		for _, consume := range s.progress {
+			consume(event)
+		}
+	}
+	writeJSON(w, http.StatusOK, u.status())
+}
+
+func (s *sparseUploads) writeRange(u *sparseUpload, offset, length int64, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(u.info.Storage["Path"], os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.NewOffsetWriter(f, offset), io.LimitReader(body, length))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// finish hands a fully received upload to the completed uploads once the PUTs
+// still writing to it are done, under the path finalizeUpload publishes from
+func (s *sparseUploads) finish(ctx context.Context, u *sparseUpload, req tusd.HTTPRequest) {
+	u.writes.Wait()
+	s.mu.Lock()
+	delete(s.uploads, u.info.ID)
+	s.mu.Unlock()
+
+	u.mu.Lock()
+	dataPath := filepath.Join(s.store.Path, u.info.ID)
+	err := os.Rename(u.info.Storage["Path"], dataPath)
+	if err == nil {
+		u.info.Storage["Path"] = dataPath
+		delete(u.info.Storage, sparseRangesKey)
+		err = writeUploadInfo(u.info)
+	}
+	u.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to move finished sparse upload",
+			"upload_id", u.info.ID,
+			"error", err)
+		return
+	}
+	slog.Info("Sparse upload complete", "upload_id", u.info.ID)
+	// Handed over like tusd does with tus uploads, and not dropped when the
+	// client disconnects before it is published
+	s.completed <- u.event(context.WithoutCancel(ctx), req)
+}
+
+// tusMiddleware refuses tus requests for uploads in progress here, a PATCH
+// would write at the offset the data file's size suggests
+func (s *sparseUploads) tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			if _, ok := s.get(strings.Trim(r.URL.Path, "/")); ok {
+				http.Error(w, errSparseUpload.HTTPResponse.Body, errSparseUpload.HTTPResponse.StatusCode)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// sparseMux serves the sparse upload endpoints like runServer registers them
+func sparseMux(s *sparseUploads) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/sparse-uploads", s.handleCreate)
+	mux.HandleFunc("GET /api/sparse-uploads/{id}", s.handleStatus)
+	mux.HandleFunc("PUT /api/sparse-uploads/{id}", s.handleWrite)
+	return mux
+}
+
+func createSparseUpload(t *testing.T, mux http.Handler, body string) (int, sparseStatus) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/sparse-uploads", strings.NewReader(body)))
+	var status sparseStatus
+	if w.Code == http.StatusCreated {
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, status
+}
+
+func writeSparseRange(mux http.Handler, id string, first int64, data string, size int64) int {
+	r := httptest.NewRequest(http.MethodPut, "/api/sparse-uploads/"+id, strings.NewReader(data))
+	r.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, first+int64(len(data))-1, size))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+// completeSparseUpload writes the range completing the upload, which blocks
+// until the upload is handed to the completed uploads, and returns the event
+func completeSparseUpload(t *testing.T, s *sparseUploads, mux http.Handler, id string, first int64, data string, size int64) tusd.HookEvent {
+	t.Helper()
+	done := make(chan int, 1)
+	go func() {
+		done <- writeSparseRange(mux, id, first, data, size)
+	}()
+	event := receiveCompleted(t, s)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("completing write: status %d", code)
+	}
+	return event
+}
+
+// receiveCompleted waits for the upload handed to the completed uploads
+func receiveCompleted(t *testing.T, s *sparseUploads) tusd.HookEvent {
+	t.Helper()
+	select {
+	case event := <-s.completedUploads():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("the complete sparse upload wasn't handed over")
+		return tusd.HookEvent{}
+	}
+}
+
+func TestSparseUploadOutOfOrderAndOverlappingWrites(t *testing.T) {
+	store := newFileStore(t.TempDir(), false, 0, "")
+	s := newSparseUploads(store, nil, nil, nil)
+	mux := sparseMux(s)
+
+	code, created := createSparseUpload(t, mux, `{"filename": "notes.txt", "size": 10, "metadata": {"filetype": "text/plain"}}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create: status %d", code)
+	}
+	for _, write := range []struct {
+		first int64
+		data  string
+	}{
+		{6, "ghij"},
+		{0, "abc"},
+	} {
+		if code := writeSparseRange(mux, created.ID, write.first, write.data, 10); code != http.StatusOK {
+			t.Fatalf("writing %q at %d: status %d", write.data, write.first, code)
+		}
+	}
+	if upload, _ := s.get(created.ID); !slices.Equal(upload.status().Received, [][2]int64{{0, 3}, {6, 10}}) {
+		t.Errorf("received %v, want [[0 3] [6 10]]", upload.status().Received)
+	}
+
+	// Overlaps both, the last write wins
+	event := completeSparseUpload(t, s, mux, created.ID, 2, "CDEF", 10)
+	wantPath := filepath.Join(store.Path, created.ID)
+	if event.Upload.ID != created.ID || event.Upload.Offset != 10 || event.Upload.Storage["Path"] != wantPath {
+		t.Errorf("completed %s at offset %d from %s, want %s at 10 from %s",
+			event.Upload.ID, event.Upload.Offset, event.Upload.Storage["Path"], created.ID, wantPath)
+	}
+	if event.Upload.MetaData["filename"] != "notes.txt" || event.Upload.MetaData["filetype"] != "text/plain" {
+		t.Errorf("completed upload has metadata %v", event.Upload.MetaData)
+	}
+	if data, err := os.ReadFile(wantPath); err != nil || string(data) != "abCDEFghij" {
+		t.Errorf("data file holds %q (%v), want abCDEFghij", data, err)
+	}
+
+	// finalizeUpload reads the upload from the store like a tus upload
+	upload, err := store.GetUpload(t.Context(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := upload.GetInfo(t.Context())
+	if err != nil || info.Offset != info.Size || info.Storage[sparseRangesKey] != "" {
+		t.Errorf("stored upload is at %d of %d with ranges %q (%v)", info.Offset, info.Size, info.Storage[sparseRangesKey], err)
+	}
+	if code := writeSparseRange(mux, created.ID, 0, "a", 10); code != http.StatusNotFound {
+		t.Errorf("writing to the finished upload: status %d, want 404", code)
+	}
+}
+
+func TestSparseUploadWaitsForWritesInFlight(t *testing.T) {
+	s := newSparseUploads(newFileStore(t.TempDir(), false, 0, ""), nil, nil, nil)
+	mux := sparseMux(s)
+	_, created := createSparseUpload(t, mux, `{"filename": "a.bin", "size": 4}`)
+	upload, _ := s.get(created.ID)
+
+	// A PUT still copying its body
+	if !upload.startWrite() {
+		t.Fatal("starting a write was refused")
+	}
+	done := make(chan int)
+	go func() {
+		done <- writeSparseRange(mux, created.ID, 0, "abcd", 4)
+	}()
+	select {
+	case <-s.completedUploads():
+		t.Fatal("the upload was handed over while a write was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if code := writeSparseRange(mux, created.ID, 0, "x", 4); code != http.StatusConflict {
+		t.Errorf("writing while the upload is published: status %d, want 409", code)
+	}
+
+	upload.writes.Done()
+	receiveCompleted(t, s)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("completing write: status %d", code)
+	}
+}
+
+func TestSparseUploadCreateChecks(t *testing.T) {
+	refuse := func(hook tusd.HookEvent) (tusd.HTTPResponse, tusd.FileInfoChanges, error) {
+		if hook.Upload.MetaData["filename"] == "refused.txt" {
+			return tusd.HTTPResponse{}, tusd.FileInfoChanges{}, tusd.NewError("ERR_REFUSED", "refused", http.StatusForbidden)
+		}
+		return tusd.HTTPResponse{}, tusd.FileInfoChanges{ID: "chosen-id"}, nil
+	}
+	var created []string
+	s := newSparseUploads(newFileStore(t.TempDir(), false, 0, ""), refuse, []func(tusd.HookEvent){
+		func(event tusd.HookEvent) { created = append(created, event.Upload.ID) },
+	}, nil)
+	mux := sparseMux(s)
+
+	if code, _ := createSparseUpload(t, mux, `{"filename": "refused.txt", "size": 4}`); code != http.StatusForbidden {
+		t.Errorf("create refused by a hook: status %d, want 403", code)
+	}
+	large := `{"filename": "a.txt", "size": 4, "metadata": {"note": "` + strings.Repeat("x", sparseCreateLimit) + `"}}`
+	if code, _ := createSparseUpload(t, mux, large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("create with a large body: status %d, want 413", code)
+	}
+	code, status := createSparseUpload(t, mux, `{"filename": "a.txt", "size": 4}`)
+	if code != http.StatusCreated || status.ID != "chosen-id" {
+		t.Errorf("create: status %d with ID %q, want 201 with the hook's ID", code, status.ID)
+	}
+	if !slices.Equal(created, []string{"chosen-id"}) {
+		t.Errorf("created consumers saw %v, want only the accepted upload", created)
+	}
+}
+
+func TestSparseUploadResumesAfterRestart(t *testing.T) {
+	store := newFileStore(t.TempDir(), false, 0, "")
+	mux := sparseMux(newSparseUploads(store, nil, nil, nil))
+	_, created := createSparseUpload(t, mux, `{"filename": "a.txt", "size": 6}`)
+	if code := writeSparseRange(mux, created.ID, 3, "def", 6); code != http.StatusOK {
+		t.Fatalf("write: status %d", code)
+	}
+
+	s := newSparseUploads(store, nil, nil, nil)
+	mux = sparseMux(s)
+	upload, ok := s.get(created.ID)
+	if !ok {
+		t.Fatal("the sparse upload wasn't resumed")
+	}
+	if got := upload.status().Received; !slices.Equal(got, [][2]int64{{3, 6}}) {
+		t.Errorf("resumed with ranges %v, want [[3 6]]", got)
+	}
+	event := completeSparseUpload(t, s, mux, created.ID, 0, "abc", 6)
+	if data, err := os.ReadFile(event.Upload.Storage["Path"]); err != nil || string(data) != "abcdef" {
+		t.Errorf("data file holds %q (%v), want abcdef", data, err)
+	}
+}
+
+func TestSparseUploadRefusesTusRequests(t *testing.T) {
+	s := newSparseUploads(newFileStore(t.TempDir(), false, 0, ""), nil, nil, nil)
+	_, created := createSparseUpload(t, sparseMux(s), `{"filename": "a.txt", "size": 4}`)
+	tus := s.tusMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for path, want := range map[string]int{created.ID: http.StatusConflict, "other-id": http.StatusNoContent} {
+		w := httptest.NewRecorder()
+		tus.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/"+path, nil))
+		if w.Code != want {
+			t.Errorf("PATCH %s: status %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func TestSparseUploadAllowedTypes(t *testing.T) {
+	types := parseAllowedTypes([]string{".txt"})
+	var allowed atomic.Pointer[[]string]
+	allowed.Store(&types)
+	preCreate := chainPreCreateHooks([]preCreateHook{allowTypes(&allowed)})
+	dir := t.TempDir()
+	mux := sparseMux(newSparseUploads(newFileStore(dir, false, 0, ""), preCreate, nil, nil))
+
+	if code, _ := createSparseUpload(t, mux, `{"filename": "a.exe", "size": 4}`); code != http.StatusBadRequest {
+		t.Errorf("create with a refused type: status %d, want 400", code)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("refused upload left %d files in the uploads dir", len(entries))
+	}
+	if code, _ := createSparseUpload(t, mux, `{"filename": "a.txt", "size": 4}`); code != http.StatusCreated {
+		t.Errorf("create with an allowed type: status %d, want 201", code)
+	}
+}
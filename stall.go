@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// stallMonitor stops PATCH requests whose upload hasn't made progress for the
+// configured window, even if the connection itself is still open. The window
+// starts with the request, so one that never sends a byte is stopped too.
+// Stopping works like a hook's StopUpload: the request body is closed and
+// tusd terminates the upload.
+type stallMonitor struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	active map[string]*stallEntry
+}
+
+type stallEntry struct {
+	// stop cancels the PATCH request's context
+	stop         context.CancelCauseFunc
+	offset       int64
+	lastProgress time.Time
+}
+
+// newStallMonitor needs the handler's progress notifications passed to observe,
+// so the handler must have been created with NotifyUploadProgress enabled, and
+// the PATCH requests passed through middleware
+func newStallMonitor(timeout time.Duration) *stallMonitor {
+	m := &stallMonitor{
+		timeout: timeout,
+		active:  make(map[string]*stallEntry),
+	}
+	go func() {
+		for now := range time.Tick(stallCheckInterval(timeout)) {
+			m.check(now)
+		}
+	}()
+	return m
+}
+
+// stallCheckInterval checks often enough that a stalled upload is stopped
+// within a few percent of the configured timeout
+func stallCheckInterval(timeout time.Duration) time.Duration {
+	return max(timeout/10, 100*time.Millisecond)
+}
+
+// middleware watches PATCH requests from the moment they reach tusd until they
+// end. The upload ID is the path left after the handler's base path.
+func (m *stallMonitor) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		id := strings.Trim(r.URL.Path, "/")
+		// tusd rejects the request if it isn't the upload's offset
+		offset, _ := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		entry := m.start(id, offset, cancel, time.Now())
+		defer m.end(id, entry)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (m *stallMonitor) start(id string, offset int64, stop context.CancelCauseFunc, now time.Time) *stallEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// A PATCH taking over the upload replaces the one before it
+	entry := &stallEntry{stop: stop, offset: offset, lastProgress: now}
+	m.active[id] = entry
+	return entry
+}
+
+func (m *stallMonitor) end(id string, entry *stallEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active[id] == entry {
+		delete(m.active, id)
+	}
+}
+
+// observe consumes a progress notification
+func (m *stallMonitor) observe(event tusd.HookEvent) {
+	m.progress(event, time.Now())
+}
+
+func (m *stallMonitor) progress(event tusd.HookEvent, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// tusd also reports the offset a PATCH started at, which isn't progress
+	entry, ok := m.active[event.Upload.ID]
+	if !ok || event.Upload.Offset <= entry.offset {
+		return
+	}
+	entry.offset = event.Upload.Offset
+	entry.lastProgress = now
+}
+
+func (m *stallMonitor) check(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, entry := range m.active {
+		if now.Sub(entry.lastProgress) < m.timeout {
+			continue
+		}
+
+		slog.Warn("Stopping stalled upload",
+			"upload_id", id,
+			"offset", entry.offset,
+			"idle", now.Sub(entry.lastProgress).Round(time.Second))
+		// tusd closes the body and terminates the upload for this cause, as for
+		// a hook stopping it
+		entry.stop(tusd.ErrUploadStoppedByServer)
+		delete(m.active, id)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	xslog "golang.org/x/exp/slog"
+)
+
+func TestStallMonitorTracksFromRequestStart(t *testing.T) {
+	m := &stallMonitor{timeout: time.Minute, active: make(map[string]*stallEntry)}
+	started := time.Now()
+	ctx, stop := context.WithCancelCause(context.Background())
+	m.start("upload", 100, stop, started)
+	progress := func(offset int64, at time.Time) {
+		m.progress(tusd.HookEvent{Upload: tusd.FileInfo{ID: "upload", Offset: offset}}, at)
+	}
+
+	// The offset the request started at doesn't count as progress
+	progress(100, started.Add(50*time.Second))
+	m.check(started.Add(59 * time.Second))
+	if ctx.Err() != nil {
+		t.Fatal("stopped before the timeout")
+	}
+	progress(150, started.Add(59*time.Second))
+	m.check(started.Add(90 * time.Second))
+	if ctx.Err() != nil {
+		t.Fatal("stopped within the timeout after progress")
+	}
+	m.check(started.Add(120 * time.Second))
+	if cause := context.Cause(ctx); !errors.Is(cause, tusd.ErrUploadStoppedByServer) {
+		t.Fatalf("stalled request ended with %v, want it stopped", cause)
+	}
+
+	// A request that ended on its own is no longer watched
+	_, stop = context.WithCancelCause(context.Background())
+	entry := m.start("other", 0, stop, started)
+	m.end("other", entry)
+	if len(m.active) != 0 {
+		t.Errorf("%d requests watched after they ended", len(m.active))
+	}
+}
+
+func TestStallMonitorStopsPatchWithoutData(t *testing.T) {
+	composer := tusd.NewStoreComposer()
+	store := newFileStore(t.TempDir(), false, 0, "")
+	store.UseIn(composer)
+	timeout := 200 * time.Millisecond
+	handler, err := tusd.NewHandler(tusd.Config{
+		BasePath:               "/files/",
+		StoreComposer:          composer,
+		NotifyUploadProgress:   true,
+		UploadProgressInterval: stallCheckInterval(timeout),
+		Logger:                 xslog.New(xslog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalls := newStallMonitor(timeout)
+	dispatchHookEvents(handler.UploadProgress, stalls.observe)
+	server := httptest.NewServer(http.StripPrefix("/files/", stalls.middleware(handler)))
+	defer server.Close()
+
+	create, _ := http.NewRequest(http.MethodPost, server.URL+"/files/", nil)
+	create.Header.Set("Tus-Resumable", "1.0.0")
+	create.Header.Set("Upload-Length", "10")
+	resp, err := http.DefaultClient.Do(create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	id := location[strings.LastIndex(location, "/")+1:]
+
+	// The body never sends a byte, so tusd never reports progress
+	body, stalled := io.Pipe()
+	defer stalled.Close()
+	patch, _ := http.NewRequest(http.MethodPatch, location, body)
+	patch.Header.Set("Tus-Resumable", "1.0.0")
+	patch.Header.Set("Upload-Offset", "0")
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	started := time.Now()
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(patch)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusBadRequest {
+			t.Errorf("stalled PATCH: status %d, want 400", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled PATCH wasn't stopped")
+	}
+	if elapsed := time.Since(started); elapsed < timeout {
+		t.Errorf("PATCH stopped after %v, before the %v timeout", elapsed, timeout)
+	}
+	if _, err := store.GetUpload(context.Background(), id); err == nil {
+		t.Error("stalled upload wasn't terminated")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// statsdMetrics sends upload metrics as DogStatsD-style datagrams over UDP.
+// Sending never blocks or fails an upload; lost packets just go uncounted.
+type statsdMetrics struct {
+	conn   net.Conn
+	prefix string
+
+	mu      sync.Mutex
+	started map[string]time.Time
+}
+
+func newStatsdMetrics(addr, prefix string) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdMetrics{
+		conn:    conn,
+		prefix:  strings.TrimSuffix(prefix, "."),
+		started: make(map[string]time.Time),
+	}, nil
+}
+
+func (m *statsdMetrics) send(name, value, kind string, tags []string) {
+	line := fmt.Sprintf("%s.%s:%s|%s", m.prefix, name, value, kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	if _, err := m.conn.Write([]byte(line)); err != nil {
+		slog.Debug("Failed to send StatsD metric", "metric", name, "error", err)
+	}
+}
+
+func (m *statsdMetrics) count(name string, value int64, tags ...string) {
+	m.send(name, fmt.Sprint(value), "c", tags)
+}
+
+func (m *statsdMetrics) timing(name string, d time.Duration, tags ...string) {
+	m.send(name, fmt.Sprintf("%.3f", float64(d.Microseconds())/1000), "ms", tags)
+}
+
+// fileTypeTag tags metrics with the lowercased extension of the upload's filename
+func fileTypeTag(info tusd.FileInfo) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(info.MetaData["filename"]), "."))
+	if ext == "" {
+		ext = "none"
+	}
+	return "type:" + ext
+}
+
+// uploadCreated consumes tusd's created notifications, which the handler must
+// be configured to send
+func (m *statsdMetrics) uploadCreated(event tusd.HookEvent) {
+	m.mu.Lock()
+	m.started[event.Upload.ID] = time.Now()
+	m.mu.Unlock()
+	m.count("uploads.created", 1, fileTypeTag(event.Upload))
+}
+
+// uploadTerminated consumes tusd's terminated notifications
+func (m *statsdMetrics) uploadTerminated(event tusd.HookEvent) {
+	m.mu.Lock()
+	delete(m.started, event.Upload.ID)
+	m.mu.Unlock()
+	m.count("uploads.terminated", 1, fileTypeTag(event.Upload))
+}
+
+// uploadCompleted records a finished upload's size and, if its creation was
+// seen by this process, how long it took
+func (m *statsdMetrics) uploadCompleted(info tusd.FileInfo) {
+	m.mu.Lock()
+	started, ok := m.started[info.ID]
+	delete(m.started, info.ID)
+	m.mu.Unlock()
+
+	// Partial uploads are counted once, as the final upload they make up
+	if info.IsPartial {
+		return
+	}
+	tag := fileTypeTag(info)
+	m.count("uploads.completed", 1, tag)
+	m.count("uploads.bytes", info.Size, tag)
+	if ok {
+		m.timing("uploads.duration", time.Since(started), tag)
+	}
+}
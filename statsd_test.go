@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestStatsdMetrics(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	metrics, err := newStatsdMetrics(listener.LocalAddr().String(), "simple_upload.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.conn.Close()
+	receive := func() string {
+		t.Helper()
+		buf := make([]byte, 1024)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	report := tusd.FileInfo{ID: "a", Size: 5, MetaData: tusd.MetaData{"filename": "Report.PDF"}}
+	metrics.uploadCreated(tusd.HookEvent{Upload: report})
+	if got := receive(); got != "simple_upload.uploads.created:1|c|#type:pdf" {
+		t.Errorf("created sent %q", got)
+	}
+	metrics.uploadCompleted(report)
+	want := []string{
+		"simple_upload.uploads.completed:1|c|#type:pdf",
+		"simple_upload.uploads.bytes:5|c|#type:pdf",
+	}
+	for _, line := range want {
+		if got := receive(); got != line {
+			t.Errorf("completed sent %q, want %q", got, line)
+		}
+	}
+	if got := receive(); !regexp.MustCompile(`^simple_upload\.uploads\.duration:\d+\.\d{3}\|ms\|#type:pdf$`).MatchString(got) {
+		t.Errorf("completed sent %q, want the upload's duration", got)
+	}
+
+	// Parts of a concatenated upload only count as the final upload, and an
+	// upload created before this process started has no duration
+	metrics.uploadCompleted(tusd.FileInfo{ID: "part", Size: 3, IsPartial: true})
+	metrics.uploadCompleted(tusd.FileInfo{ID: "old", Size: 7})
+	for _, line := range []string{"simple_upload.uploads.completed:1|c|#type:none", "simple_upload.uploads.bytes:7|c|#type:none"} {
+		if got := receive(); got != line {
+			t.Errorf("sent %q, want %q", got, line)
+		}
+	}
+
+	metrics.uploadCreated(tusd.HookEvent{Upload: tusd.FileInfo{ID: "b", MetaData: tusd.MetaData{"filename": "notes.txt"}}})
+	receive()
+	metrics.uploadTerminated(tusd.HookEvent{Upload: tusd.FileInfo{ID: "b", MetaData: tusd.MetaData{"filename": "notes.txt"}}})
+	if got := receive(); got != "simple_upload.uploads.terminated:1|c|#type:txt" {
+		t.Errorf("terminated sent %q", got)
+	}
+	if len(metrics.started) != 0 {
+		t.Errorf("%d uploads still timed after finishing", len(metrics.started))
+	}
+}
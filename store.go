@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/tus/tusd/v2/pkg/filestore"
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// errInsufficientStorage is returned to clients when the backing file can't be
+// preallocated because the disk is full
+var errInsufficientStorage = tusd.NewError("ERR_INSUFFICIENT_STORAGE", "not enough free space to store upload", http.StatusInsufficientStorage)
+
+// fileStore wraps the tusd filestore to add optional behavior around upload creation
+type fileStore struct {
+	filestore.FileStore
+
+	// preallocate reserves the declared Upload-Length on disk at creation
+	preallocate bool
+
+	// buffers, when set, provides the copy buffers for writing request bodies
+	buffers *sync.Pool
+
+	// idPrefix is prepended to every generated upload ID
+	idPrefix string
+
+	unsupportedOnce sync.Once
+}
+
+func newFileStore(path string, preallocate bool, writeBufferSize int, idPrefix string) *fileStore {
+	store := &fileStore{
+		FileStore:   filestore.New(path),
+		preallocate: preallocate,
+		idPrefix:    idPrefix,
+	}
+	if writeBufferSize > 0 {
+		store.buffers = newBufferPool(writeBufferSize)
+	}
+	return store
+}
+
+// UseIn registers the wrapper (rather than the embedded filestore) in the composer
+// so that every upload goes through it
+func (store *fileStore) UseIn(composer *tusd.StoreComposer) {
+	composer.UseCore(store)
+	composer.UseTerminater(store)
+	composer.UseConcater(store)
+	composer.UseLengthDeferrer(store)
+	composer.UseContentServer(store)
+}
+
+// validIDPrefix matches prefixes that are safe in file names on every platform
+var validIDPrefix = regexp.MustCompile(`^[A-Za-z0-9_-]{0,32}$`)
+
+// newUploadID returns a random upload ID carrying the instance's prefix, so
+// instances sharing an uploads dir never hand out the same ID
+func (store *fileStore) newUploadID() string {
+	return store.idPrefix + newRandomID()
+}
+
+func (store *fileStore) wrap(upload tusd.Upload) tusd.Upload {
+	if store.buffers == nil {
+		return upload
+	}
+	return &pooledUpload{Upload: upload, pool: store.buffers}
+}
+
+func (store *fileStore) GetUpload(ctx context.Context, id string) (tusd.Upload, error) {
+	upload, err := store.FileStore.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return store.wrap(upload), nil
+}
+
+func (store *fileStore) AsTerminatableUpload(upload tusd.Upload) tusd.TerminatableUpload {
+	return store.FileStore.AsTerminatableUpload(unwrapUpload(upload))
+}
+
+func (store *fileStore) AsLengthDeclarableUpload(upload tusd.Upload) tusd.LengthDeclarableUpload {
+	return store.FileStore.AsLengthDeclarableUpload(unwrapUpload(upload))
+}
+
+func (store *fileStore) AsConcatableUpload(upload tusd.Upload) tusd.ConcatableUpload {
+	return concatableUpload{store.FileStore.AsConcatableUpload(unwrapUpload(upload))}
+}
+
+func (store *fileStore) AsServableUpload(upload tusd.Upload) tusd.ServableUpload {
+	return store.FileStore.AsServableUpload(unwrapUpload(upload))
+}
+
+func (store *fileStore) NewUpload(ctx context.Context, info tusd.FileInfo) (tusd.Upload, error) {
+	upload, err := store.newUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return store.wrap(upload), nil
+}
+
+func (store *fileStore) newUpload(ctx context.Context, info tusd.FileInfo) (tusd.Upload, error) {
+	if info.ID == "" {
+		info.ID = store.newUploadID()
+	}
+	upload, err := store.FileStore.NewUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Final uploads are filled by concatenation, so there is nothing to reserve
+	if !store.preallocate || info.SizeIsDeferred || info.IsFinal || info.Size <= 0 {
+		return upload, nil
+	}
+
+	created, err := upload.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = preallocateFile(created.Storage["Path"], info.Size)
+	switch {
+	case err == nil:
+	case errors.Is(err, errors.ErrUnsupported):
+		store.unsupportedOnce.Do(func() {
+			slog.Warn("Preallocation is not supported on this platform or filesystem, continuing without it",
+				"error", err)
+		})
+	case errors.Is(err, errNoSpace):
+		slog.Warn("Not enough disk space to preallocate upload",
+			"upload_id", created.ID,
+			"size", info.Size)
+		// Don't leave an empty upload behind that can never be completed
+		if terr := store.AsTerminatableUpload(upload).Terminate(ctx); terr != nil {
+			slog.Error("Failed to remove upload after failed preallocation",
+				"upload_id", created.ID,
+				"error", terr)
+		}
+		return nil, errInsufficientStorage
+	default:
+		slog.Warn("Failed to preallocate upload, continuing without it",
+			"upload_id", created.ID,
+			"error", err)
+	}
+
+	return upload, nil
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"golang.org/x/sys/unix"
+)
+
+// skipWithoutPreallocation skips tests on a filesystem lacking fallocate
+func skipWithoutPreallocation(t *testing.T, dir string) {
+	t.Helper()
+	f, err := os.CreateTemp(dir, "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := preallocateFile(f.Name(), 1); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("filesystem of the temporary directory can't preallocate")
+	}
+}
+
+func TestPreallocateReportsNoSpaceAtCreation(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutPreallocation(t, dir)
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		t.Fatal(err)
+	}
+	// More than the filesystem has left
+	size := int64(stat.Bavail)*int64(stat.Bsize) + 1<<30
+
+	store := newFileStore(dir, true, 0, "")
+	_, err := store.NewUpload(context.Background(), tusd.FileInfo{Size: size})
+	if !errors.Is(err, errInsufficientStorage) {
+		t.Fatalf("NewUpload of %d bytes = %v, want errInsufficientStorage", size, err)
+	}
+
+	// The upload that could never complete is removed
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left behind in the uploads dir", len(entries))
+	}
+}
+
+func TestPreallocateReservesBlocks(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutPreallocation(t, dir)
+	store := newFileStore(dir, true, 0, "")
+	upload, err := store.NewUpload(context.Background(), tusd.FileInfo{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := upload.GetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(info.Storage["Path"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The filestore derives the offset from the size, which has to stay 0
+	if stat.Size() != 0 {
+		t.Errorf("preallocated file has size %d, want 0", stat.Size())
+	}
+	if blocks := stat.Sys().(*syscall.Stat_t).Blocks; blocks*512 < 1<<20 {
+		t.Errorf("preallocated file has %d blocks, want at least 1 MiB", blocks)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// templateField matches the {field} placeholders of --filename-template
+var templateField = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// uploadFilename returns the name a finished upload is published under, before
+// sanitization: the client's filename, or --filename-template filled in from the
+// upload's metadata. Besides metadata keys a template can use {date}
+// (2006-01-02), {time} (150405) and {id}. If any field is empty the plain
+// filename is used, so a missing key never produces names like "-report.pdf".
+func uploadFilename(info tusd.FileInfo, now time.Time) string {
+	filename := info.MetaData["filename"]
+	if filenameTemplate == "" || filename == "" {
+		return filename
+	}
+
+	missing := false
+	name := templateField.ReplaceAllStringFunc(filenameTemplate, func(field string) string {
+		var value string
+		switch key := field[1 : len(field)-1]; key {
+		case "date":
+			value = now.Format("2006-01-02")
+		case "time":
+			value = now.Format("150405")
+		case "id":
+			value = info.ID
+		default:
+			value = info.MetaData[key]
+		}
+		if value == "" {
+			missing = true
+		}
+		return value
+	})
+	if missing {
+		return filename
+	}
+	// Metadata values are sanitized together with the rest of the name, so a
+	// field can't smuggle in path separators
+	return name
+}
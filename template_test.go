@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestUploadFilenameTemplate(t *testing.T) {
+	defer func(saved string) { filenameTemplate = saved }(filenameTemplate)
+	now := time.Date(2024, 5, 17, 9, 3, 7, 0, time.UTC)
+	tests := []struct {
+		name, template string
+		metadata       tusd.MetaData
+		want           string
+	}{
+		{"no template", "", tusd.MetaData{"filename": "report.pdf"}, "report.pdf"},
+		{"metadata fields", "{uploader}-{filename}", tusd.MetaData{"filename": "report.pdf", "uploader": "alice"}, "alice-report.pdf"},
+		{"date, time and id", "{date}_{time}_{id}_{filename}", tusd.MetaData{"filename": "report.pdf"}, "2024-05-17_090307_upload-id_report.pdf"},
+		{"missing field", "{uploader}-{filename}", tusd.MetaData{"filename": "report.pdf"}, "report.pdf"},
+		{"empty field", "{uploader}-{filename}", tusd.MetaData{"filename": "report.pdf", "uploader": ""}, "report.pdf"},
+		{"no filename", "{uploader}-{filename}", tusd.MetaData{"uploader": "alice"}, ""},
+		{"not a field", "{up-loader}-{filename}", tusd.MetaData{"filename": "report.pdf"}, "{up-loader}-report.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filenameTemplate = tt.template
+			got := uploadFilename(tusd.FileInfo{ID: "upload-id", MetaData: tt.metadata}, now)
+			if got != tt.want {
+				t.Errorf("uploadFilename with %q = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilenameTemplateTraversal(t *testing.T) {
+	defer func(saved, savedTemplate string) { uploadsDir, filenameTemplate = saved, savedTemplate }(uploadsDir, filenameTemplate)
+	filenameTemplate = "{uploader}-{filename}"
+	for _, uploader := range []string{"../../etc", "..", `..\..\windows`, "a/../../b", "/abs"} {
+		t.Run(uploader, func(t *testing.T) {
+			parent := t.TempDir()
+			uploadsDir = filepath.Join(parent, "uploads")
+			if err := os.Mkdir(uploadsDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(uploadsDir, "upload-id"), []byte("data"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			event := tusd.HookEvent{Upload: tusd.FileInfo{
+				ID:       "upload-id",
+				Size:     4,
+				MetaData: tusd.MetaData{"filename": "report.pdf", "uploader": uploader},
+			}}
+			outcome, err := finalizeUpload(context.Background(), newFileStore(uploadsDir, false, 0, ""), nil, nil, nil, nil, nil, nil, event)
+			if err != nil || outcome != uploadPublished {
+				t.Fatalf("finalizeUpload = %v, %v, want it published", outcome, err)
+			}
+
+			// The field is sanitized with the rest of the name, so the upload
+			// lands in the uploads dir under a single safe name
+			want := sanitizeFilename(uploader + "-report.pdf")
+			if strings.ContainsAny(want, `/\`) || strings.HasPrefix(want, ".") {
+				t.Fatalf("sanitized name is %q", want)
+			}
+			entries, err := os.ReadDir(uploadsDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if name := entry.Name(); name != want && name != want+metaSuffix {
+					t.Errorf("%s in the uploads dir, want only %s", name, want)
+				}
+			}
+			if data, err := os.ReadFile(filepath.Join(uploadsDir, want)); err != nil || string(data) != "data" {
+				t.Errorf("%s holds %q (%v), want the upload", want, data, err)
+			}
+			if top, _ := os.ReadDir(parent); len(top) != 1 {
+				t.Errorf("%d entries next to the uploads dir, want none", len(top)-1)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// thumbnailDir holds the thumbnails in the uploads dir, as {name}.jpg.
+	// Uploaded names never start with a dot, see sanitizeFilename.
+	thumbnailDir = ".thumbs"
+
+	// maxThumbnailSourcePixels bounds the images thumbnails are made of, since
+	// a small compressed file can decode to gigabytes of pixels
+	maxThumbnailSourcePixels = 50_000_000
+)
+
+// thumbnailer makes JPEG previews of finished image uploads as background
+// jobs, one at a time, so at most one decoded image is held in memory
+type thumbnailer struct {
+	dir   string
+	size  int
+	slots chan struct{}
+	jobs  *jobRegistry
+}
+
+func newThumbnailer(dir string, size int, jobs *jobRegistry) *thumbnailer {
+	return &thumbnailer{dir: dir, size: size, slots: make(chan struct{}, 1), jobs: jobs}
+}
+
+// thumbnailPath is where the thumbnail of the upload with the final name is kept
+func thumbnailPath(dir, name string) string {
+	return filepath.Join(dir, thumbnailDir, filepath.FromSlash(name)+".jpg")
+}
+
+// generate starts a thumbnail job for the upload at p, published as name, if it
+// is an image. A thumbnail left from an earlier file of that name is removed.
+func (t *thumbnailer) generate(p, name string) {
+	dst := thumbnailPath(t.dir, name)
+	if !isThumbnailable(p) {
+		os.Remove(dst)
+		return
+	}
+	j := t.jobs.start("thumbnail", func(ctx context.Context, j *job) error {
+		select {
+		case t.slots <- struct{}{}:
+			defer func() { <-t.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := t.write(p, dst)
+		if err != nil {
+			os.Remove(dst)
+			slog.Warn("Failed to generate thumbnail",
+				"path", p,
+				"error", err)
+		}
+		return err
+	})
+	slog.Debug("Generating thumbnail",
+		"path", p,
+		"job_id", j.id)
+}
+
+// isThumbnailable reports whether the file's content is an image format that
+// can be decoded
+func isThumbnailable(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	switch http.DetectContentType(head[:n]) {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+func (t *thumbnailer) write(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+		return fmt.Errorf("image of %dx%d pixels is too large for a thumbnail", config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumbnail-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = jpeg.Encode(tmp, downscale(img, t.size), &jpeg.Options{Quality: 85})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// downscale fits img into size x size pixels, averaging the source pixels each
+// thumbnail pixel covers. Transparent areas become white, JPEG has no alpha.
+// Smaller images keep their size.
+func downscale(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Over)
+
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, size
+	if w > h {
+		dh = max(1, h*size/w)
+	} else {
+		dw = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := range dw {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var r, g, bl, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += int(row[i])
+					g += int(row[i+1])
+					bl += int(row[i+2])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// handleThumbnail serves GET /api/thumbnail/{name...}, 404 for uploads that
+// aren't images or whose thumbnail isn't ready yet
+func handleThumbnail(root *os.Root) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !isUploadPath(name) {
+			writeJSONError(w, http.StatusNotFound, "thumbnail not found")
+			return
+		}
+		f, err := root.Open(path.Join(thumbnailDir, name+".jpg"))
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "thumbnail not found")
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			writeJSONError(w, http.StatusNotFound, "thumbnail not found")
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeContent(w, r, name+".jpg", info.ModTime(), f)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsPolicy is the protocol version and cipher suite selection shared by the
+// HTTP/2 and HTTP/3 listeners
+type tlsPolicy struct {
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+// parseTLSPolicy validates --tls-min-version and --tls-ciphers. Cipher suites
+// only apply to TLS 1.2, as Go doesn't allow configuring the TLS 1.3 ones, so a
+// list combined with a 1.3 minimum is rejected rather than silently ignored.
+// Suites Go considers insecure are never accepted.
+func parseTLSPolicy(minVersion string, ciphers []string) (tlsPolicy, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return tlsPolicy{}, fmt.Errorf("unsupported TLS minimum version %q, expected 1.2 or 1.3", minVersion)
+	}
+	policy := tlsPolicy{minVersion: version}
+
+	if len(ciphers) == 0 {
+		return policy, nil
+	}
+	if version == tls.VersionTLS13 {
+		return tlsPolicy{}, fmt.Errorf("cipher suites can't be configured with TLS 1.3 as the minimum version")
+	}
+
+	for _, name := range ciphers {
+		id, err := lookupCipherSuite(strings.TrimSpace(name))
+		if err != nil {
+			return tlsPolicy{}, err
+		}
+		policy.cipherSuites = append(policy.cipherSuites, id)
+	}
+	return policy, nil
+}
+
+func lookupCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name && slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown TLS 1.2 cipher suite %q", name)
+}
+
+// config returns a tls.Config applying the policy. The HTTP/3 listener always
+// negotiates TLS 1.3, as QUIC requires it.
+func (p tlsPolicy) config(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:     p.minVersion,
+		CipherSuites:   p.cipherSuites,
+		GetCertificate: getCertificate,
+	}
+}
+
+// cipherNames describes the configured cipher suites for the startup log
+func (p tlsPolicy) cipherNames() string {
+	if len(p.cipherSuites) == 0 {
+		return "go-defaults"
+	}
+	names := make([]string, len(p.cipherSuites))
+	for i, id := range p.cipherSuites {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	return strings.Join(names, ",")
+}
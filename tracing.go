@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracer is a no-op until setupTracing installs a real provider, so spans cost
+// next to nothing when tracing is disabled
+var tracer = otel.Tracer("simple-upload")
+
+// setupTracing installs an OTLP/HTTP exporter as the global tracer provider and
+// returns a function that flushes pending spans. An endpoint without a path gets
+// the standard /v1/traces path.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "simple-upload"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a server span per request, continuing any trace
+// context sent by the client
+func tracingMiddleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "simple-upload",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + spanRoute(r.URL.Path)
+		}))
+}
+
+// spanRoute collapses upload URLs so span names don't contain upload IDs
+func spanRoute(path string) string {
+	if strings.HasPrefix(path, "/files/") && len(path) > len("/files/") {
+		return "/files/{id}"
+	}
+	return path
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tusd "github.com/tus/tusd/v2/pkg/handler"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that keeps finished spans in memory
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	saved, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(saved)
+		otel.SetTextMapPropagator(savedPropagator)
+	})
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return exporter
+}
+
+func TestTracingSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	// The request's span continues the client's trace
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	r := httptest.NewRequest(http.MethodPatch, "/files/0123456789abcdef", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("request recorded %d spans, want 1", len(spans))
+	}
+	request := spans[0]
+	if request.Name != "PATCH /files/{id}" || request.SpanContext.TraceID().String() != traceID {
+		t.Errorf("request span %q in trace %s, want PATCH /files/{id} in the client's trace", request.Name, request.SpanContext.TraceID())
+	}
+
+	// Finalizing continues the trace of the request that completed the upload,
+	// here handed over as sparse uploads are
+	exporter.Reset()
+	completed := make(chan tusd.HookEvent, 1)
+	finalized := make(chan struct{}, 1)
+	finalize := func(ctx context.Context, event tusd.HookEvent) (finalizeOutcome, error) {
+		finalized <- struct{}{}
+		return uploadPublished, nil
+	}
+	composer := tusd.NewStoreComposer()
+	newFileStore(t.TempDir(), false, 0, "").UseIn(composer)
+	uploads, err := tusd.NewHandler(tusd.Config{StoreComposer: composer, NotifyCompleteUploads: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := handleCompletedUploads(ctx, uploads, completed, finalize, nil, nil, nil)
+	completed <- tusd.HookEvent{
+		Context: trace.ContextWithSpanContext(context.Background(), request.SpanContext),
+		Upload:  tusd.FileInfo{ID: "0123456789abcdef", Size: 5},
+	}
+	select {
+	case <-finalized:
+	case <-time.After(time.Second):
+		t.Fatal("upload wasn't finalized")
+	}
+	cancel()
+	<-done
+	spans = exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("finalizing recorded %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "finalize upload" || span.Parent.SpanID() != request.SpanContext.SpanID() || span.SpanContext.TraceID() != request.SpanContext.TraceID() {
+		t.Errorf("finalize span %q with parent %s, want it a child of the request span %s", span.Name, span.Parent.SpanID(), request.SpanContext.SpanID())
+	}
+	attributes := map[string]string{}
+	for _, attr := range span.Attributes {
+		attributes[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attributes["upload.id"] != "0123456789abcdef" || attributes["upload.size"] != "5" {
+		t.Errorf("finalize span has attributes %v, want the upload's ID and size", attributes)
+	}
+}
+
+func TestSpanRoute(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/files/", "/files/"},
+		{"/files/0123456789abcdef", "/files/{id}"},
+		{"/api/files", "/api/files"},
+		{"/", "/"},
+	}
+	for _, tt := range tests {
+		if got := spanRoute(tt.path); got != tt.want {
+			t.Errorf("spanRoute(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// openUIDir returns the files of --ui-dir, replacing the embedded web UI. It
+// needs an index.html, or / would show a directory listing.
+func openUIDir(dir string) (fs.FS, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	ui := os.DirFS(dir)
+	index, err := fs.Stat(ui, "index.html")
+	if err != nil {
+		return nil, fmt.Errorf("%s has no index.html: %w", dir, err)
+	}
+	if !index.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s/index.html is not a file", dir)
+	}
+	return ui, nil
+}
+
+// uiOverride is an operator-provided file served in place of an embedded UI asset
+type uiOverride struct {
+	urlPath string
+	file    string
+}
+
+// validateUIOverrides checks that every configured override points at a readable file
+func validateUIOverrides(overrides []uiOverride) error {
+	for _, o := range overrides {
+		if o.file == "" {
+			continue
+		}
+		stat, err := os.Stat(o.file)
+		if err != nil {
+			return fmt.Errorf("override for %s: %w", o.urlPath, err)
+		}
+		if stat.IsDir() {
+			return fmt.Errorf("override for %s: %s is a directory", o.urlPath, o.file)
+		}
+	}
+	return nil
+}
+
+// registerUIOverrides mounts the overrides on the mux. They take precedence over
+// the embedded assets because they are more specific than the "/" catch-all.
+func registerUIOverrides(mux *http.ServeMux, overrides []uiOverride) {
+	for _, o := range overrides {
+		if o.file == "" {
+			continue
+		}
+		file := o.file
+		mux.HandleFunc("GET "+o.urlPath, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, file)
+		})
+	}
+}
@@ -6,7 +6,9 @@ const progressBar = document.getElementById("progress-bar");
 const progressText = document.getElementById("progress-text");
 const statusText = document.getElementById("status");
 
-const UPLOAD_URL = "/files/";
+// Relative, so the UI keeps working when served below --base-url
+const UPLOAD_URL = "files/";
+const TOKEN_KEY = "simple-upload-token";
 
 // Click to open file selector
 dropZone.addEventListener("click", () => fileInput.click());
@@ -42,14 +44,27 @@ function uploadFile(file) {
     statusText.textContent = "";
     statusText.classList.remove("error", "success");
 
+    // Servers started with --auth-token need a bearer token for uploads
+    const token = localStorage.getItem(TOKEN_KEY);
+    const headers = token ? { Authorization: "Bearer " + token } : {};
+
     const upload = new tus.Upload(file, {
         endpoint: UPLOAD_URL,
         retryDelays: [0, 1000, 3000, 5000],
+        headers: headers,
         metadata: {
             filename: file.name,
             filetype: file.type,
         },
         onError: function (error) {
+            if (error.originalResponse && error.originalResponse.getStatus() === 401) {
+                const newToken = prompt(token ? "Upload token rejected, enter it again:" : "This server needs an upload token:");
+                if (newToken) {
+                    localStorage.setItem(TOKEN_KEY, newToken);
+                    uploadFile(file);
+                    return;
+                }
+            }
             console.error("Upload failed:", error);
             statusText.textContent = "Upload failed. Try again.";
             statusText.classList.add("error");
@@ -0,0 +1,6 @@
+import { defineConfig } from 'vite'
+
+// Relative asset URLs, so the built UI works below any --base-url
+export default defineConfig({
+  base: './',
+})
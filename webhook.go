@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the body
+// when --webhook-secret is set
+const webhookSignatureHeader = "X-Simple-Upload-Signature"
+
+// webhookEventHeader names the kind of event in the body, one of the
+// webhook*Event constants
+const webhookEventHeader = "X-Simple-Upload-Event"
+
+const (
+	webhookUploadEvent = "upload.completed"
+	webhookQuotaEvent  = "quota.warning"
+)
+
+// webhookIDHeader carries the ID of the webhook, the same in every attempt,
+// so receivers can drop the duplicates at-least-once delivery may send
+const webhookIDHeader = "X-Simple-Upload-Webhook-ID"
+
+const (
+	webhookTimeout = 10 * time.Second
+
+	// webhookQueueDir holds the webhooks not delivered yet in the uploads dir:
+	// pending/ those waiting for an attempt and failed/ those that ran out of
+	// them
+	webhookQueueDir = ".webhooks"
+)
+
+// defaultWebhookRetries are the delays before the second and third attempt
+var defaultWebhookRetries = []time.Duration{time.Second, 2 * time.Second}
+
+// webhookEvent is the JSON body posted for every finished upload
+type webhookEvent struct {
+	UploadID         string    `json:"upload_id"`
+	Filename         string    `json:"filename"`
+	OriginalFilename string    `json:"original_filename"`
+	Size             int64     `json:"size"`
+	SHA256           string    `json:"sha256"`
+	CompletedAt      time.Time `json:"completed_at"`
+}
+
+// queuedWebhook is a webhook file in the queue, as listed by
+// /api/webhooks/failed
+type queuedWebhook struct {
+	ID string `json:"id"`
+	// Type is sent in webhookEventHeader, Event is the body
+	Type        string          `json:"type"`
+	Event       json.RawMessage `json:"event"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt,omitzero"`
+	LastError   string          `json:"last_error,omitempty"`
+	FailedAt    time.Time       `json:"failed_at,omitzero"`
+}
+
+// webhookNotifier posts finished uploads and quota warnings to --webhook-url.
+// Every webhook is written to the queue before its first attempt and removed
+// once delivered, so webhooks pending when the server stops or crashes are
+// sent after the next start. Those failing every attempt of the
+// --webhook-retries schedule are moved to the failed ones. Deliveries run in
+// the background so a slow receiver doesn't hold up finalizing other uploads.
+type webhookNotifier struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	retries []time.Duration
+
+	pendingDir string
+	failedDir  string
+
+	stop    chan struct{}
+	running sync.WaitGroup
+
+	mu      sync.Mutex
+	pending int
+	failed  int
+}
+
+// newWebhookNotifier opens the queue in dir and resumes the webhooks pending
+// in it
+func newWebhookNotifier(url, secret, dir string, retries []time.Duration) (*webhookNotifier, error) {
+	n := &webhookNotifier{
+		url:        url,
+		secret:     []byte(secret),
+		client:     &http.Client{Timeout: webhookTimeout},
+		retries:    retries,
+		pendingDir: filepath.Join(dir, "pending"),
+		failedDir:  filepath.Join(dir, "failed"),
+		stop:       make(chan struct{}),
+	}
+	for _, dir := range []string{n.pendingDir, n.failedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	failed, err := readQueue(n.failedDir)
+	if err != nil {
+		return nil, err
+	}
+	n.failed = len(failed)
+	pending, err := readQueue(n.pendingDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		slog.Info("Resuming queued webhooks", "count", len(pending))
+	}
+	for _, q := range pending {
+		n.schedule(q)
+	}
+	return n, nil
+}
+
+// notify announces the finished upload dir/filename
+func (n *webhookNotifier) notify(dir, filename, originalFilename, uploadID string) {
+	path := filepath.Join(dir, filename)
+	info, err := os.Stat(path)
+	if err == nil {
+		var sum string
+		if sum, err = fileSHA256(path); err == nil {
+			n.send(webhookUploadEvent, webhookEvent{
+				UploadID:         uploadID,
+				Filename:         filename,
+				OriginalFilename: originalFilename,
+				Size:             info.Size(),
+				SHA256:           sum,
+				CompletedAt:      time.Now().UTC().Truncate(time.Second),
+			})
+			return
+		}
+	}
+	slog.Warn("Failed to prepare webhook",
+		"path", path,
+		"error", err)
+}
+
+// send queues and delivers an event of the kind eventType
+func (n *webhookNotifier) send(eventType string, event any) {
+	// Of plain fields, which always encode
+	body, _ := json.Marshal(event)
+	q := queuedWebhook{
+		ID:          newRandomID(),
+		Type:        eventType,
+		Event:       body,
+		NextAttempt: time.Now(),
+	}
+	// Still attempted when it can't be queued, only without surviving a
+	// restart
+	if err := writeQueued(n.pendingDir, q); err != nil {
+		slog.Warn("Failed to queue webhook", "webhook_id", q.ID, "type", eventType, "error", err)
+	}
+	n.schedule(q)
+}
+
+func (n *webhookNotifier) schedule(q queuedWebhook) {
+	n.mu.Lock()
+	n.pending++
+	n.mu.Unlock()
+	n.running.Go(func() {
+		n.deliver(q)
+	})
+}
+
+// deliver attempts the webhook until it is delivered, fails for good or the
+// notifier is closed, which leaves it in the queue
+func (n *webhookNotifier) deliver(q queuedWebhook) {
+	for {
+		if wait := time.Until(q.NextAttempt); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-n.stop:
+				timer.Stop()
+				return
+			}
+		}
+
+		q.Attempts++
+		retry, err := n.post(q)
+		if err == nil {
+			slog.Debug("Webhook delivered", "webhook_id", q.ID, "type", q.Type, "attempt", q.Attempts)
+			n.dequeue(q, false)
+			return
+		}
+		q.LastError = err.Error()
+		if !retry || q.Attempts > len(n.retries) {
+			slog.Warn("Webhook failed, moved to the failed webhooks",
+				"webhook_id", q.ID,
+				"type", q.Type,
+				"attempts", q.Attempts,
+				"error", err)
+			q.NextAttempt = time.Time{}
+			q.FailedAt = time.Now().UTC()
+			if err := writeQueued(n.failedDir, q); err != nil {
+				slog.Warn("Failed to keep failed webhook", "webhook_id", q.ID, "error", err)
+			}
+			n.dequeue(q, true)
+			return
+		}
+
+		q.NextAttempt = time.Now().Add(n.retries[q.Attempts-1])
+		if err := writeQueued(n.pendingDir, q); err != nil {
+			slog.Warn("Failed to update queued webhook", "webhook_id", q.ID, "error", err)
+		}
+	}
+}
+
+// dequeue removes a webhook that was delivered or moved to failed/
+func (n *webhookNotifier) dequeue(q queuedWebhook, failed bool) {
+	if err := os.Remove(filepath.Join(n.pendingDir, q.ID+".json")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Failed to remove queued webhook", "webhook_id", q.ID, "error", err)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending--
+	if failed {
+		n.failed++
+	}
+}
+
+// post sends one attempt. Client errors (4xx) won't go away by retrying.
+func (n *webhookNotifier) post(q queuedWebhook) (retry bool, err error) {
+	body := []byte(q.Event)
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, q.Type)
+	req.Header.Set(webhookIDHeader, q.ID)
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return false, nil
+}
+
+// depth returns the number of webhooks pending and failed
+func (n *webhookNotifier) depth() (pending, failed int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.pending, n.failed
+}
+
+// close stops the deliveries waiting for their next attempt, which stay in the
+// queue for the next start, and waits for the attempts in flight
+func (n *webhookNotifier) close() {
+	close(n.stop)
+	n.running.Wait()
+}
+
+// handleFailed serves GET /api/webhooks/failed, the webhooks that failed all
+// attempts, oldest first. Requires the admin token.
+func (n *webhookNotifier) handleFailed(adminToken *liveToken) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r, adminToken) {
+			return
+		}
+		failed, err := readQueue(n.failedDir)
+		if err != nil {
+			slog.Error("Failed to read failed webhooks", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to read failed webhooks")
+			return
+		}
+		slices.SortFunc(failed, func(a, b queuedWebhook) int {
+			return a.FailedAt.Compare(b.FailedAt)
+		})
+		writeJSON(w, http.StatusOK, failed)
+	}
+}
+
+// writeQueued replaces the webhook's file in dir. It goes through a synced
+// temporary file, so a crash leaves either version rather than a torn one.
+func writeQueued(dir string, q queuedWebhook) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, q.ID+".json"))
+}
+
+// readQueue returns the webhooks in dir. Temporary files left by a crash are
+// removed, unreadable files are logged and skipped.
+func readQueue(dir string) ([]queuedWebhook, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	queue := []queuedWebhook{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		var q queuedWebhook
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &q)
+		}
+		if err != nil || q.ID+".json" != entry.Name() {
+			slog.Warn("Skipping unreadable queued webhook", "path", path, "error", err)
+			continue
+		}
+		queue = append(queue, q)
+	}
+	return queue, nil
+}
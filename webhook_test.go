@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the webhooks posted to it, answering with status
+type webhookReceiver struct {
+	status atomic.Int32
+
+	mu        sync.Mutex
+	ids       []string
+	codes     []int
+	eventType string
+	event     webhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, status int) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{}
+	r.status.Store(int32(status))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		code := int(r.status.Load())
+		r.mu.Lock()
+		r.ids = append(r.ids, req.Header.Get(webhookIDHeader))
+		r.codes = append(r.codes, code)
+		r.eventType = req.Header.Get(webhookEventHeader)
+		json.Unmarshal(body, &r.event)
+		r.mu.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *webhookReceiver) received() ([]string, []int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ids...), append([]int(nil), r.codes...)
+}
+
+// waitFor polls cond for up to five seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// writeUpload creates a finished upload to announce
+func writeUpload(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.pdf"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestWebhookQueueSurvivesRestart(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	uploads := writeUpload(t)
+	queue := t.TempDir()
+
+	n, err := newWebhookNotifier(server.URL, "", queue, []time.Duration{200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.notify(uploads, "report.pdf", "Report.pdf", "abc123")
+	waitFor(t, "the first attempt", func() bool {
+		ids, _ := receiver.received()
+		return len(ids) == 1
+	})
+	// Stopped with the retry pending, like a server going down
+	n.close()
+
+	pending, err := readQueue(filepath.Join(queue, "pending"))
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("pending webhooks after stopping = %v, %v, want 1", pending, err)
+	}
+	if pending[0].Attempts != 1 || !strings.Contains(pending[0].LastError, "503") {
+		t.Errorf("queued webhook = %+v, want 1 attempt failed with 503", pending[0])
+	}
+	// A write torn by a crash is cleaned up
+	torn := filepath.Join(queue, "pending", ".tmp-123")
+	if err := os.WriteFile(torn, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.status.Store(http.StatusOK)
+	n, err = newWebhookNotifier(server.URL, "", queue, []time.Duration{200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.close()
+	if _, err := os.Stat(torn); !os.IsNotExist(err) {
+		t.Errorf("torn queue file kept: %v", err)
+	}
+	waitFor(t, "the webhook to be delivered", func() bool {
+		pending, _ := n.depth()
+		return pending == 0
+	})
+
+	ids, codes := receiver.received()
+	if len(ids) != 2 || ids[0] != ids[1] || ids[0] != pending[0].ID || codes[1] != http.StatusOK {
+		t.Errorf("attempts with IDs %v answered %v, want the same ID twice, the second delivered", ids, codes)
+	}
+	receiver.mu.Lock()
+	event, eventType := receiver.event, receiver.eventType
+	receiver.mu.Unlock()
+	if eventType != webhookUploadEvent {
+		t.Errorf("%s = %q, want %q", webhookEventHeader, eventType, webhookUploadEvent)
+	}
+	if event.UploadID != "abc123" || event.Filename != "report.pdf" || event.OriginalFilename != "Report.pdf" || event.Size != 5 {
+		t.Errorf("delivered %+v", event)
+	}
+	entries, _ := os.ReadDir(filepath.Join(queue, "pending"))
+	if len(entries) != 0 {
+		t.Errorf("%d files left in the pending queue", len(entries))
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, http.StatusInternalServerError)
+	uploads := writeUpload(t)
+	n, err := newWebhookNotifier(server.URL, "", t.TempDir(), []time.Duration{10 * time.Millisecond, 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.close()
+
+	n.notify(uploads, "report.pdf", "report.pdf", "abc123")
+	waitFor(t, "the webhook to fail", func() bool {
+		pending, failed := n.depth()
+		return pending == 0 && failed == 1
+	})
+	if ids, _ := receiver.received(); len(ids) != 3 {
+		t.Errorf("%d attempts, want 3", len(ids))
+	}
+
+	// A client error isn't retried
+	receiver.status.Store(http.StatusBadRequest)
+	n.notify(uploads, "report.pdf", "report.pdf", "def456")
+	waitFor(t, "the second webhook to fail", func() bool {
+		_, failed := n.depth()
+		return failed == 2
+	})
+	if ids, _ := receiver.received(); len(ids) != 4 {
+		t.Errorf("%d attempts, want 4", len(ids))
+	}
+
+	handler := n.handleFailed(newLiveToken("admin-secret"))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/webhooks/failed", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token = %d, want 401", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/webhooks/failed", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	var failed []queuedWebhook
+	if err := json.Unmarshal(w.Body.Bytes(), &failed); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("%d failed webhooks listed, want 2", len(failed))
+	}
+	for i, want := range []struct {
+		uploadID string
+		attempts int
+	}{{"abc123", 3}, {"def456", 1}} {
+		var event webhookEvent
+		json.Unmarshal(failed[i].Event, &event)
+		if event.UploadID != want.uploadID || failed[i].Type != webhookUploadEvent || failed[i].Attempts != want.attempts || failed[i].FailedAt.IsZero() {
+			t.Errorf("failed webhook %d = %+v, want %s after %d attempts", i, failed[i], want.uploadID, want.attempts)
+		}
+	}
+	if !strings.Contains(failed[0].LastError, "500") {
+		t.Errorf("last error = %q, want the 500 answer", failed[0].LastError)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// writabilityMonitor periodically checks that files can be created in the
+// uploads directory. While they can't, e.g. after the filesystem was remounted
+// read-only, new uploads are refused with 503 instead of failing deep inside
+// the store, and downloads keep working.
+type writabilityMonitor struct {
+	dir      string
+	interval time.Duration
+	readOnly atomic.Bool
+}
+
+func newWritabilityMonitor(dir string, interval time.Duration) *writabilityMonitor {
+	m := &writabilityMonitor{dir: dir, interval: interval}
+	m.check()
+	go func() {
+		for range time.Tick(interval) {
+			m.check()
+		}
+	}()
+	return m
+}
+
+func probeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".writable-check-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte{0})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (m *writabilityMonitor) check() {
+	err := probeWritable(m.dir)
+	switch {
+	case err != nil && !m.readOnly.Swap(true):
+		slog.Error("CRITICAL: uploads directory is not writable, rejecting new uploads until it recovers",
+			"path", m.dir,
+			"error", err)
+	case err == nil && m.readOnly.Swap(false):
+		slog.Warn("Uploads directory is writable again, accepting uploads",
+			"path", m.dir)
+	}
+}
+
+// isUploadWrite reports whether a request writes upload data: tus creation and
+// PATCH requests as well as the sparse upload and file patch endpoints
+func isUploadWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return false
+	}
+	for _, prefix := range []string{"/files", "/api/sparse-uploads", "/api/files/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *writabilityMonitor) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.readOnly.Load() || !isUploadWrite(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(m.interval.Seconds()))))
+		const message = "uploads are temporarily unavailable, the storage is read-only"
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeJSONError(w, http.StatusServiceUnavailable, message)
+			return
+		}
+		http.Error(w, message, http.StatusServiceUnavailable)
+	})
+}
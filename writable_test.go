@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritabilityMonitorTransitions(t *testing.T) {
+	// Removing the directory makes it unwritable even for root, who may
+	// write to read-only directories
+	dir := filepath.Join(t.TempDir(), "uploads")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m := &writabilityMonitor{dir: dir, interval: 5 * time.Second}
+	handler := m.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	writes := [][2]string{
+		{http.MethodPost, "/files/"},
+		{http.MethodPatch, "/files/upload-id"},
+		{http.MethodPut, "/api/sparse-uploads/upload-id"},
+		{http.MethodPatch, "/api/files/report.txt"},
+	}
+	reads := [][2]string{
+		{http.MethodGet, "/api/download/report.txt"},
+		{http.MethodHead, "/files/upload-id"},
+		{http.MethodDelete, "/files/upload-id"},
+		{http.MethodPost, "/api/login"},
+	}
+	expect := func(state string, writeCode int) {
+		t.Helper()
+		for _, req := range writes {
+			if w := request(req[0], req[1]); w.Code != writeCode {
+				t.Errorf("%s: %s %s = %d, want %d", state, req[0], req[1], w.Code, writeCode)
+			}
+		}
+		for _, req := range reads {
+			if w := request(req[0], req[1]); w.Code != http.StatusNoContent {
+				t.Errorf("%s: %s %s = %d, want it served", state, req[0], req[1], w.Code)
+			}
+		}
+	}
+
+	m.check()
+	expect("writable", http.StatusNoContent)
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	m.check()
+	expect("read-only", http.StatusServiceUnavailable)
+	w := request(http.MethodPost, "/files/")
+	if w.Header().Get("Retry-After") != "5" || strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("tus refusal has headers %v, want a plain error with Retry-After 5", w.Header())
+	}
+	w = request(http.MethodPatch, "/api/files/report.txt")
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("API refusal has Content-Type %q, want JSON", w.Header().Get("Content-Type"))
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m.check()
+	expect("writable again", http.StatusNoContent)
+	if probes, _ := filepath.Glob(filepath.Join(dir, ".writable-check-*")); len(probes) != 0 {
+		t.Errorf("probe files %v left behind", probes)
+	}
+}
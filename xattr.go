@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// xattrPrefix namespaces the extended attributes written with --use-xattr
+const xattrPrefix = "user.simple_upload."
+
+var xattrUnsupportedOnce sync.Once
+
+// storeUploadXattrs records the original filename, upload time and SHA-256 of a
+// finished upload as extended attributes, so they travel with the file when it
+// is copied with tools preserving xattrs
+func storeUploadXattrs(path, originalFilename string) {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		slog.Warn("Failed to checksum upload for extended attributes",
+			"path", path,
+			"error", err)
+		return
+	}
+
+	attrs := []struct{ name, value string }{
+		{"filename", originalFilename},
+		{"uploaded_at", time.Now().UTC().Format(time.RFC3339)},
+		{"sha256", sum},
+	}
+	for _, attr := range attrs {
+		err := setXattr(path, xattrPrefix+attr.name, []byte(attr.value))
+		if errors.Is(err, errors.ErrUnsupported) {
+			xattrUnsupportedOnce.Do(func() {
+				slog.Warn("Extended attributes are not supported on this platform or filesystem, continuing without them",
+					"error", err)
+			})
+			return
+		}
+		if err != nil {
+			slog.Warn("Failed to set extended attribute",
+				"path", path,
+				"attribute", xattrPrefix+attr.name,
+				"error", err)
+			return
+		}
+	}
+}
+
+// updateChecksumXattr rewrites the SHA-256 attribute after a file was modified
+func updateChecksumXattr(path string) error {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	err = setXattr(path, xattrPrefix+"sha256", []byte(sum))
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
+
+// readXattrFilename returns the original filename storeUploadXattrs recorded
+// on an open file, or "" when it has none or xattrs are unsupported
+func readXattrFilename(f fs.File) string {
+	file, ok := f.(*os.File)
+	if !ok {
+		return ""
+	}
+	value, err := getXattr(file, xattrPrefix+"filename")
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setXattr sets an extended attribute on the file at path. Filesystems without
+// user xattrs report ENOTSUP, which matches errors.ErrUnsupported.
+func setXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
+
+// getXattr reads an extended attribute of an open file, retrying with a
+// larger buffer if it grew in between
+func getXattr(f *os.File, name string) ([]byte, error) {
+	for {
+		size, err := unix.Fgetxattr(int(f.Fd()), name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Fgetxattr(int(f.Fd()), name, value)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
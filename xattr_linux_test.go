@@ -0,0 +1,109 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadXattrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(path, xattrPrefix+"probe", []byte("1")); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("filesystem of the temporary directory has no user xattrs")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	storeUploadXattrs(path, "Report (final).pdf")
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := readXattrFilename(f); got != "Report (final).pdf" {
+		t.Errorf("filename = %q, want %q", got, "Report (final).pdf")
+	}
+	sum, err := getXattr(f, xattrPrefix+"sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256("hello")
+	if want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"; string(sum) != want {
+		t.Errorf("sha256 = %s, want %s", sum, want)
+	}
+	if _, err := getXattr(f, xattrPrefix+"uploaded_at"); err != nil {
+		t.Errorf("uploaded_at: %v", err)
+	}
+}
+
+func TestReadXattrFilenameMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plain.txt")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := readXattrFilename(f); got != "" {
+		t.Errorf("filename = %q, want none", got)
+	}
+}
+
+func TestFileInfoFallsBackToXattrFilename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Report_final.pdf")
+	if err := os.WriteFile(path, []byte("%PDF-1.7"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(path, xattrPrefix+"filename", []byte("Report (final).pdf")); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("filesystem of the temporary directory has no user xattrs")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	info := func() fileDetails {
+		t.Helper()
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /api/files/{name}/info", handleFileInfo(root.FS()))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/files/Report_final.pdf/info", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var details fileDetails
+		if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+			t.Fatal(err)
+		}
+		return details
+	}
+
+	if got := info().OriginalName; got != "Report (final).pdf" {
+		t.Errorf("original_name without sidecar = %q, want the xattr's", got)
+	}
+
+	// The sidecar wins where there is one
+	sidecar := `{"original_filename": "Report (v2).pdf"}`
+	if err := os.WriteFile(path+metaSuffix, []byte(sidecar), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := info().OriginalName; got != "Report (v2).pdf" {
+		t.Errorf("original_name with sidecar = %q, want the sidecar's", got)
+	}
+}
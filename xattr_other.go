@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// setXattr is not available outside Linux, uploads keep their metadata only in
+// the tusd info file
+func setXattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+func getXattr(f *os.File, name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}